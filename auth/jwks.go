@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// minRefreshInterval limits how often the key set is reloaded, so tokens with random key ids
+// and an unavailable source can't make the service hammer the key set source
+const minRefreshInterval = 10 * time.Second
+
+// maxKeySetSize is the maximum size of the key set document
+const maxKeySetSize = 1 << 20
+
+var (
+	// ErrKeyNotFound is an error returned when the key set doesn't contain the requested key
+	ErrKeyNotFound = errors.New("key not found in key set")
+)
+
+// KeySet is a JSON Web Key Set loaded from a local file or an URL
+// The keys are cached and reloaded when they are older than ttl or an unknown key is requested
+// Only one reload runs at a time, the concurrent callers wait for it, and the source isn't read again
+// for minRefreshInterval after the previous attempt, even if it failed
+type KeySet struct {
+	l      *log.Logger
+	source string
+	ttl    time.Duration
+	client *http.Client
+
+	// minimal interval between the attempts to reload the keys
+	minRefreshInterval time.Duration
+
+	mu       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+
+	// refreshMu guards the fields below, it's never held while the source is read
+	refreshMu   sync.Mutex
+	inflight    *refresh
+	lastAttempt time.Time
+	lastErr     error
+}
+
+// refresh is a reload of the keys in progress, done is closed when it's finished
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+// NewKeySet creates a new KeySet
+// source is a path to the file or http(s) URL of the key set
+func NewKeySet(l *log.Logger, source string, ttl time.Duration) *KeySet {
+	return &KeySet{
+		l:                  l,
+		source:             source,
+		ttl:                ttl,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		minRefreshInterval: minRefreshInterval,
+	}
+}
+
+// Load loads the key set from the source
+func (k *KeySet) Load(ctx context.Context) error {
+	k.refreshMu.Lock()
+	k.lastAttempt = time.Now()
+	k.refreshMu.Unlock()
+
+	err := k.load(ctx)
+
+	k.refreshMu.Lock()
+	k.lastErr = err
+	k.refreshMu.Unlock()
+
+	return err
+}
+
+// Key returns the public key with given id
+// If kid is empty and the key set contains only one key, this key is returned
+func (k *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	loaded, stale := k.keys != nil, time.Since(k.loadedAt) > k.ttl
+	k.mu.RUnlock()
+
+	if !loaded || stale {
+		err := k.refresh(ctx)
+		if err != nil && !loaded {
+			return nil, err
+		}
+		// the stale keys are used if the reload failed, the source may be temporarily unavailable
+	}
+
+	key, ok := k.lookup(kid)
+	if ok {
+		return key, nil
+	}
+
+	// the keys may have been rotated, try to reload them
+	err := k.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok = k.lookup(kid)
+	if ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: kid=%q", ErrKeyNotFound, kid)
+}
+
+// refresh reloads the keys unless the previous attempt was less than minRefreshInterval ago,
+// in that case the error of that attempt is returned
+// If the keys are being reloaded, it waits for that reload instead of starting another one
+func (k *KeySet) refresh(ctx context.Context) error {
+	k.refreshMu.Lock()
+	if r := k.inflight; r != nil {
+		k.refreshMu.Unlock()
+
+		select {
+		case <-r.done:
+			return r.err
+		case <-ctx.Done():
+			return fmt.Errorf("unable to wait for key set reload: %w", ctx.Err())
+		}
+	}
+	if time.Since(k.lastAttempt) < k.minRefreshInterval {
+		err := k.lastErr
+		k.refreshMu.Unlock()
+		return err
+	}
+
+	r := &refresh{done: make(chan struct{})}
+	k.inflight = r
+	k.lastAttempt = time.Now()
+	k.refreshMu.Unlock()
+
+	// the other callers wait for the reload, so it isn't cancelled with the request that started it
+	r.err = k.load(context.WithoutCancel(ctx))
+	if r.err != nil {
+		k.l.Error("Unable to reload key set", "source", k.source, "error", r.err)
+	}
+
+	k.refreshMu.Lock()
+	k.inflight = nil
+	k.lastErr = r.err
+	k.refreshMu.Unlock()
+	close(r.done)
+
+	return r.err
+}
+
+// lookup returns the key with given id from the cached keys
+func (k *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+
+	return key, ok
+}
+
+// load reads the key set from the source and replaces the cached keys
+func (k *KeySet) load(ctx context.Context) error {
+	b, err := k.read(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to read key set from %v: %w", k.source, err)
+	}
+
+	keys, err := parseKeySet(b)
+	if err != nil {
+		return fmt.Errorf("unable to parse key set from %v: %w", k.source, err)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.loadedAt = time.Now()
+	k.mu.Unlock()
+	k.l.Debug("Key set loaded", "source", k.source, "keys", len(keys))
+
+	return nil
+}
+
+// read returns the content of the key set source
+func (k *KeySet) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(k.source, "http://") && !strings.HasPrefix(k.source, "https://") {
+		return os.ReadFile(k.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send request: %w", err)
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			k.l.Error("Unable to close response body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxKeySetSize))
+}
+
+// jsonWebKey defines the fields of JSON Web Key used for signature verification
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseKeySet parses JSON Web Key Set document
+// Keys that are not used for signatures or have unsupported type are skipped
+func parseKeySet(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	err := json.Unmarshal(b, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the public key defined by JSON Web Key, or nil if the key type is unsupported
+func (j jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent is too big")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid key size")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+// decodeBigInt decodes base64url-encoded big-endian unsigned integer
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// DefaultRoleClaim is the default name of the claim that contains segmentify role
+	DefaultRoleClaim = "segmentify_role"
+
+	// DefaultPrefixesClaim is the default name of the claim that contains prefixes of the segments the caller can change
+	DefaultPrefixesClaim = "segmentify_segment_prefixes"
+)
+
+// validMethods are the signing methods accepted by the Verifier, symmetric methods are not allowed
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var (
+	// ErrInvalidToken is an error returned when the token can't be verified
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// VerifierOptions defines the requirements to the tokens and the names of the claims
+type VerifierOptions struct {
+	// Issuer is the required value of the iss claim, not checked if empty
+	Issuer string
+
+	// Audience is the required value of the aud claim, not checked if empty
+	Audience string
+
+	// RoleClaim is the name of the claim with the role, DefaultRoleClaim if empty
+	RoleClaim string
+
+	// PrefixesClaim is the name of the claim with the segment prefixes, DefaultPrefixesClaim if empty
+	PrefixesClaim string
+}
+
+// Verifier verifies JWT bearer tokens against the key set and maps their claims to principals
+type Verifier struct {
+	keys          *KeySet
+	parser        *jwt.Parser
+	roleClaim     string
+	prefixesClaim string
+}
+
+// NewVerifier creates a new Verifier
+func NewVerifier(keys *KeySet, opts VerifierOptions) *Verifier {
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(validMethods),
+		jwt.WithExpirationRequired(),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
+	v := &Verifier{
+		keys:          keys,
+		parser:        jwt.NewParser(parserOpts...),
+		roleClaim:     opts.RoleClaim,
+		prefixesClaim: opts.PrefixesClaim,
+	}
+	if v.roleClaim == "" {
+		v.roleClaim = DefaultRoleClaim
+	}
+	if v.prefixesClaim == "" {
+		v.prefixesClaim = DefaultPrefixesClaim
+	}
+
+	return v
+}
+
+// IsJWT returns true if the token looks like a JWT in compact serialization
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify verifies the token and returns the principal described by its claims
+// The role claim can be a string or a list of strings, the highest known role is used
+func (v *Verifier) Verify(ctx context.Context, token string) (models.Principal, error) {
+	claims := jwt.MapClaims{}
+
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+
+		return v.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return models.Principal{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return models.Principal{}, fmt.Errorf("%w: sub claim is required", ErrInvalidToken)
+	}
+
+	// the issuer is checked only if it's configured, the subjects of different issuers are different callers
+	issuer, _ := claims.GetIssuer()
+
+	role := highestRole(stringsClaim(claims[v.roleClaim]))
+	if role == "" {
+		return models.Principal{}, fmt.Errorf("%w: %v claim doesn't contain known role", ErrInvalidToken, v.roleClaim)
+	}
+
+	return models.Principal{
+		ID:              fmt.Sprintf("jwt:%v/%v", issuer, subject),
+		Name:            subject,
+		Role:            role,
+		SegmentPrefixes: stringsClaim(claims[v.prefixesClaim]),
+	}, nil
+}
+
+// stringsClaim returns the values of the claim which is a string, space separated strings or a list of strings
+func stringsClaim(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, v := range c {
+			if s, ok := v.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// highestRole returns the role with most permissions among the known roles, or empty string if there are none
+func highestRole(roles []string) string {
+	var highest string
+	for _, role := range roles {
+		if !data.RoleAllows(role, data.RoleReader) {
+			continue
+		}
+		if highest == "" || data.RoleAllows(role, highest) {
+			highest = role
+		}
+	}
+
+	return highest
+}
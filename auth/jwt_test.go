@@ -0,0 +1,453 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+
+	"github.com/charmbracelet/log"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "segmentify"
+)
+
+// signingKey is a private key of the test issuer published in the key set with its kid
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingKey{kid: kid, method: jwt.SigningMethodRS256, key: key}
+}
+
+func newECDSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingKey{kid: kid, method: jwt.SigningMethodES256, key: key}
+}
+
+// jwk returns the public part of the key as JSON Web Key
+func (s signingKey) jwk() map[string]string {
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": encode(key.N), "e": encode(big.NewInt(int64(key.E)))}
+	case *ecdsa.PublicKey:
+		// the coordinates of P-256 are 32 bytes long
+		x, y := make([]byte, 32), make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256",
+			"x": base64.RawURLEncoding.EncodeToString(x), "y": base64.RawURLEncoding.EncodeToString(y)}
+	default:
+		panic("unsupported key")
+	}
+}
+
+// sign returns the token with the claims signed by the key
+func (s signingKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(s.method, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+// jwksServer serves the key set with the current keys and counts the requests
+type jwksServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []signingKey
+	failing  bool
+	requests atomic.Int32
+
+	// if it isn't nil, the requests wait until it's closed
+	block chan struct{}
+}
+
+func newJWKSServer(t *testing.T, keys ...signingKey) *jwksServer {
+	t.Helper()
+
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+
+		s.mu.Lock()
+		keys, failing, block := s.keys, s.failing, s.block
+		s.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+		if failing {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		set := struct {
+			Keys []map[string]string `json:"keys"`
+		}{}
+		for _, key := range keys {
+			set.Keys = append(set.Keys, key.jwk())
+		}
+		_ = json.NewEncoder(rw).Encode(set)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// rotate replaces the published keys
+func (s *jwksServer) rotate(keys ...signingKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *jwksServer) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func newTestKeySet(source string) *KeySet {
+	return NewKeySet(log.New(io.Discard), source, time.Hour)
+}
+
+func newTestVerifier(t *testing.T, keys ...signingKey) (*Verifier, *KeySet, *jwksServer) {
+	t.Helper()
+
+	s := newJWKSServer(t, keys...)
+	ks := newTestKeySet(s.URL)
+	v := NewVerifier(ks, VerifierOptions{Issuer: testIssuer, Audience: testAudience})
+
+	return v, ks, s
+}
+
+// validClaims returns the claims accepted by the verifier from newTestVerifier
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                testIssuer,
+		"aud":                testAudience,
+		"sub":                "recommendations-service",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		DefaultRoleClaim:     "writer",
+		DefaultPrefixesClaim: []string{"AVITO_", "TEST_"},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, key := range []signingKey{newRSAKey(t, "rsa"), newECDSAKey(t, "ecdsa")} {
+		t.Run(key.method.Alg(), func(t *testing.T) {
+			v, _, _ := newTestVerifier(t, key)
+
+			principal, err := v.Verify(context.Background(), key.sign(t, validClaims()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal.Name != "recommendations-service" || principal.Role != data.RoleWriter {
+				t.Errorf("principal = %+v, want recommendations-service with role writer", principal)
+			}
+			if principal.ID != "jwt:"+testIssuer+"/recommendations-service" {
+				t.Errorf("principal id = %v, want issuer and subject", principal.ID)
+			}
+			if len(principal.SegmentPrefixes) != 2 || principal.SegmentPrefixes[0] != "AVITO_" || principal.SegmentPrefixes[1] != "TEST_" {
+				t.Errorf("segment prefixes = %v, want [AVITO_ TEST_]", principal.SegmentPrefixes)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsInvalidClaims(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	v, _, _ := newTestVerifier(t, key)
+
+	for name, change := range map[string]func(c jwt.MapClaims){
+		"expired":          func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"without exp":      func(c jwt.MapClaims) { delete(c, "exp") },
+		"not valid yet":    func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() },
+		"wrong issuer":     func(c jwt.MapClaims) { c["iss"] = "https://attacker.example.com" },
+		"without issuer":   func(c jwt.MapClaims) { delete(c, "iss") },
+		"wrong audience":   func(c jwt.MapClaims) { c["aud"] = "other-service" },
+		"without audience": func(c jwt.MapClaims) { delete(c, "aud") },
+		"without subject":  func(c jwt.MapClaims) { delete(c, "sub") },
+		"unknown role":     func(c jwt.MapClaims) { c[DefaultRoleClaim] = "superuser" },
+		"without role":     func(c jwt.MapClaims) { delete(c, DefaultRoleClaim) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			claims := validClaims()
+			change(claims)
+
+			_, err := v.Verify(context.Background(), key.sign(t, claims))
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("error = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnsafeAlgorithms(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	v, _, _ := newTestVerifier(t, key)
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+	none.Header["kid"] = key.kid
+	noneToken, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the attacker signs the token with the public key published in the key set as HMAC secret
+	public, err := x509.MarshalPKIXPublicKey(key.key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	hmac.Header["kid"] = key.kid
+	hmacToken, err := hmac.SignedString(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"none": noneToken, "HS256": hmacToken} {
+		t.Run(name, func(t *testing.T) {
+			_, err := v.Verify(context.Background(), token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("error = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnknownSigner(t *testing.T) {
+	v, _, _ := newTestVerifier(t, newRSAKey(t, "rsa"))
+
+	// the key has the published kid, but it isn't the published key
+	_, err := v.Verify(context.Background(), newRSAKey(t, "rsa").sign(t, validClaims()))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestVerifyRoleClaim(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+
+	for name, tc := range map[string]struct {
+		claim interface{}
+		want  string
+	}{
+		"string":             {claim: "reader", want: data.RoleReader},
+		"space separated":    {claim: "reader admin", want: data.RoleAdmin},
+		"list":               {claim: []string{"reader", "writer"}, want: data.RoleWriter},
+		"list with unknown":  {claim: []string{"superuser", "reader"}, want: data.RoleReader},
+		"highest role first": {claim: []string{"admin", "reader"}, want: data.RoleAdmin},
+	} {
+		t.Run(name, func(t *testing.T) {
+			v, _, _ := newTestVerifier(t, key)
+			claims := validClaims()
+			claims[DefaultRoleClaim] = tc.claim
+
+			principal, err := v.Verify(context.Background(), key.sign(t, claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal.Role != tc.want {
+				t.Errorf("role = %v, want %v", principal.Role, tc.want)
+			}
+		})
+	}
+
+	t.Run("custom claim", func(t *testing.T) {
+		s := newJWKSServer(t, key)
+		v := NewVerifier(newTestKeySet(s.URL), VerifierOptions{RoleClaim: "roles"})
+		claims := validClaims()
+		delete(claims, DefaultRoleClaim)
+		claims["roles"] = "admin"
+
+		principal, err := v.Verify(context.Background(), key.sign(t, claims))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if principal.Role != data.RoleAdmin {
+			t.Errorf("role = %v, want %v", principal.Role, data.RoleAdmin)
+		}
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := newRSAKey(t, "2026-01"), newECDSAKey(t, "2026-02")
+	v, ks, s := newTestVerifier(t, oldKey)
+	ks.minRefreshInterval = 0
+
+	_, err := v.Verify(context.Background(), oldKey.sign(t, validClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token signed by the new key makes the cached key set reload before its ttl
+	s.rotate(oldKey, newKey)
+	_, err = v.Verify(context.Background(), newKey.sign(t, validClaims()))
+	if err != nil {
+		t.Fatalf("token signed by the rotated key: %v", err)
+	}
+
+	// the old key isn't trusted after it's removed from the key set and the cached key set expires
+	s.rotate(newKey)
+	ks.ttl = 0
+	_, err = v.Verify(context.Background(), oldKey.sign(t, validClaims()))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token signed by the removed key: error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestKeySetLimitsReloads(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	s := newJWKSServer(t, key)
+	ks := newTestKeySet(s.URL)
+
+	_, err := ks.Key(context.Background(), key.kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the unknown key ids don't reload the key set again within minRefreshInterval
+	for i := 0; i < 10; i++ {
+		_, err = ks.Key(context.Background(), "unknown")
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+	if n := s.requests.Load(); n != 1 {
+		t.Errorf("key set requested %v times, want 1", n)
+	}
+}
+
+func TestKeySetBacksOffAfterFailedReload(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	s := newJWKSServer(t, key)
+	s.setFailing(true)
+	ks := newTestKeySet(s.URL)
+
+	for i := 0; i < 10; i++ {
+		_, err := ks.Key(context.Background(), key.kid)
+		if err == nil {
+			t.Fatal("key returned while the key set is unavailable")
+		}
+	}
+	if n := s.requests.Load(); n != 1 {
+		t.Errorf("unavailable key set requested %v times, want 1", n)
+	}
+
+	// the source is read again after minRefreshInterval
+	s.setFailing(false)
+	ks.refreshMu.Lock()
+	ks.lastAttempt = time.Now().Add(-ks.minRefreshInterval)
+	ks.refreshMu.Unlock()
+
+	_, err := ks.Key(context.Background(), key.kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeySetUsesStaleKeysIfReloadFails(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	s := newJWKSServer(t, key)
+	ks := NewKeySet(log.New(io.Discard), s.URL, time.Nanosecond)
+	ks.minRefreshInterval = 0
+
+	err := ks.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.setFailing(true)
+	_, err = ks.Key(context.Background(), key.kid)
+	if err != nil {
+		t.Errorf("stale key isn't used: %v", err)
+	}
+}
+
+func TestKeySetReloadsOnce(t *testing.T) {
+	key := newRSAKey(t, "rsa")
+	s := newJWKSServer(t, key)
+	block := make(chan struct{})
+	s.mu.Lock()
+	s.block = block
+	s.mu.Unlock()
+	ks := newTestKeySet(s.URL)
+
+	const callers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ks.Key(context.Background(), key.kid)
+			errs <- err
+		}()
+	}
+
+	// the lookups of the cached keys aren't blocked by the reload
+	for s.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, ok := ks.lookup(key.kid)
+	if ok {
+		t.Error("key found before the key set is loaded")
+	}
+
+	close(block)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := s.requests.Load(); n != 1 {
+		t.Errorf("key set requested %v times by concurrent callers, want 1", n)
+	}
+}
@@ -0,0 +1,191 @@
+// Package certs provides the TLS configuration of the server with the certificates reloaded from disk
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// Client authentication modes
+const (
+	// ClientAuthNone doesn't request the client certificates
+	ClientAuthNone = "none"
+
+	// ClientAuthOptional verifies the client certificate against the CA if the client sends it
+	ClientAuthOptional = "optional"
+
+	// ClientAuthRequire rejects the connections without the client certificate signed by the CA
+	ClientAuthRequire = "require"
+)
+
+var (
+	// ErrUnknownClientAuth is an error returned when the mode isn't one of ClientAuthNone, ClientAuthOptional and ClientAuthRequire
+	ErrUnknownClientAuth = errors.New("unknown client authentication mode")
+
+	// ErrNoCACertificates is an error returned when the CA file doesn't contain PEM certificates
+	ErrNoCACertificates = errors.New("no CA certificates found")
+)
+
+// Files defines the PEM files of the server certificate and the CA of the client certificates
+type Files struct {
+	// certificate chain of the server
+	CertFile string
+
+	// private key of the server certificate
+	KeyFile string
+
+	// CA the client certificates are verified against, empty if they aren't verified
+	ClientCAFile string
+}
+
+// Reloader keeps the certificate and the client CA loaded from the files
+// The connections use the files loaded by the last successful Reload, so the files can be replaced
+// without restart, e.g. by cert-manager
+type Reloader struct {
+	l     *log.Logger
+	files Files
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// contents of the loaded files, the files are parsed again only if they change
+	loaded [][]byte
+}
+
+// New returns the Reloader with the files loaded, an error is returned if they can't be loaded
+func New(l *log.Logger, files Files) (*Reloader, error) {
+	r := &Reloader{l: l, files: files}
+
+	err := r.Reload(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload loads the files again if they changed since the last load
+// If the new files are incorrect, the previous ones are kept and the error is returned
+func (r *Reloader) Reload(context.Context) error {
+	contents := make([][]byte, 0, 3)
+	for _, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile} {
+		if name == "" {
+			contents = append(contents, nil)
+			continue
+		}
+
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("unable to read %v: %w", name, err)
+		}
+		contents = append(contents, b)
+	}
+
+	r.mu.RLock()
+	unchanged := r.loaded != nil && equal(r.loaded, contents)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return fmt.Errorf("unable to parse certificate %v with key %v: %w", r.files.CertFile, r.files.KeyFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("unable to parse certificate %v: %w", r.files.CertFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.files.ClientCAFile != "" {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(contents[2]) {
+			return fmt.Errorf("unable to parse %v: %w", r.files.ClientCAFile, ErrNoCACertificates)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.loaded = contents
+	r.mu.Unlock()
+
+	r.l.Info("Loaded TLS certificate", "subject", cert.Leaf.Subject.String(), "not_after", cert.Leaf.NotAfter, "client_ca", r.files.ClientCAFile)
+
+	return nil
+}
+
+// TLSConfig returns the configuration of the server using the loaded files, clientAuth is one of ClientAuth* modes
+func (r *Reloader) TLSConfig(clientAuth string) (*tls.Config, error) {
+	var authType tls.ClientAuthType
+	switch clientAuth {
+	case ClientAuthNone:
+		authType = tls.NoClientCert
+	case ClientAuthOptional:
+		authType = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		authType = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownClientAuth, clientAuth)
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the configurations returned by GetConfigForClient aren't adjusted by http.Server, so HTTP/2 is set here
+		NextProtos: []string{"h2", "http/1.1"},
+		ClientAuth: authType,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return r.cert, nil
+		},
+	}
+	if authType != tls.NoClientCert {
+		// the client certificates of every connection are verified against the current CA
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			c := config.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = r.clientCAs
+			return c, nil
+		}
+	}
+
+	return config, nil
+}
+
+// Subject returns the identity of the client certificate: its common name,
+// or the whole distinguished name if there is no common name
+func Subject(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+
+	return cert.Subject.String()
+}
+
+// equal returns true if the contents of the files are the same
+func equal(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,325 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// testCert is a certificate with its private key signed by the parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+var serial int64
+
+func newTestCert(t *testing.T, commonName string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"segmentify"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// writeFiles writes the certificate, its key and the CA to the files
+func writeFiles(t *testing.T, files Files, c *testCert, ca *testCert) {
+	t.Helper()
+
+	for name, content := range map[string][]byte{files.CertFile: c.certPEM(), files.KeyFile: c.keyPEM(t)} {
+		err := os.WriteFile(name, content, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files.ClientCAFile != "" {
+		err := os.WriteFile(files.ClientCAFile, ca.certPEM(), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestFiles(t *testing.T) Files {
+	dir := t.TempDir()
+
+	return Files{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+}
+
+// servedCertificate returns the certificate the configuration serves
+func servedCertificate(t *testing.T, config *tls.Config) *x509.Certificate {
+	t.Helper()
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert.Leaf
+}
+
+func TestReload(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	files := newTestFiles(t)
+	writeFiles(t, files, newTestCert(t, "first", ca, false), ca)
+
+	r, err := New(log.New(io.Discard), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := r.TLSConfig(ClientAuthNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCertificate(t, config).Subject.CommonName; cn != "first" {
+		t.Fatalf("served certificate = %v, want first", cn)
+	}
+
+	// the replaced files are used by the same configuration
+	writeFiles(t, files, newTestCert(t, "second", ca, false), ca)
+	err = r.Reload(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCertificate(t, config).Subject.CommonName; cn != "second" {
+		t.Errorf("served certificate after reload = %v, want second", cn)
+	}
+
+	// the incorrect files are reported and the previous certificate is kept
+	err = os.WriteFile(files.KeyFile, newTestCert(t, "other", ca, false).keyPEM(t), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Reload(context.Background())
+	if err == nil {
+		t.Error("certificate with the key of another certificate is loaded")
+	}
+	if cn := servedCertificate(t, config).Subject.CommonName; cn != "second" {
+		t.Errorf("served certificate after failed reload = %v, want second", cn)
+	}
+}
+
+func TestNewRejectsIncorrectFiles(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+
+	t.Run("missing file", func(t *testing.T) {
+		files := newTestFiles(t)
+		_, err := New(log.New(io.Discard), files)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("error = %v, want %v", err, os.ErrNotExist)
+		}
+	})
+
+	t.Run("CA without certificates", func(t *testing.T) {
+		files := newTestFiles(t)
+		writeFiles(t, files, newTestCert(t, "server", ca, false), ca)
+		err := os.WriteFile(files.ClientCAFile, []byte("not a certificate"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = New(log.New(io.Discard), files)
+		if !errors.Is(err, ErrNoCACertificates) {
+			t.Errorf("error = %v, want %v", err, ErrNoCACertificates)
+		}
+	})
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	files := newTestFiles(t)
+	writeFiles(t, files, newTestCert(t, "server", ca, false), ca)
+
+	r, err := New(log.New(io.Discard), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for mode, want := range map[string]tls.ClientAuthType{
+		ClientAuthNone:     tls.NoClientCert,
+		ClientAuthOptional: tls.VerifyClientCertIfGiven,
+		ClientAuthRequire:  tls.RequireAndVerifyClientCert,
+	} {
+		config, err := r.TLSConfig(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ClientAuth != want {
+			t.Errorf("%v: client auth = %v, want %v", mode, config.ClientAuth, want)
+		}
+		if config.MinVersion != tls.VersionTLS12 || len(config.NextProtos) == 0 || config.NextProtos[0] != "h2" {
+			t.Errorf("%v: min version = %x, next protos = %v, want TLS 1.2 and h2", mode, config.MinVersion, config.NextProtos)
+		}
+		if (config.GetConfigForClient != nil) != (mode != ClientAuthNone) {
+			t.Errorf("%v: client CA is used = %v", mode, config.GetConfigForClient != nil)
+		}
+	}
+
+	_, err = r.TLSConfig("sometimes")
+	if !errors.Is(err, ErrUnknownClientAuth) {
+		t.Errorf("error = %v, want %v", err, ErrUnknownClientAuth)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	files := newTestFiles(t)
+	writeFiles(t, files, newTestCert(t, "localhost", ca, false), ca)
+
+	r, err := New(log.New(io.Discard), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := r.TLSConfig(ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	handshake := func(client *testCert) (string, error) {
+		// the alerts are buffered by the loopback connection, so the side sending them doesn't wait for the other one
+		clientConn, serverConn := tcpPipe(t)
+
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}
+		}
+
+		server := tls.Server(serverConn, config)
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- server.Handshake() }()
+
+		clientErr := tls.Client(clientConn, clientConfig).Handshake()
+		err := <-serverErr
+		if err != nil {
+			return "", err
+		}
+		if clientErr != nil {
+			return "", clientErr
+		}
+
+		chains := server.ConnectionState().VerifiedChains
+		return Subject(chains[0][0]), nil
+	}
+
+	subject, err := handshake(newTestCert(t, "backoffice.internal", ca, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "backoffice.internal" {
+		t.Errorf("client subject = %v, want backoffice.internal", subject)
+	}
+
+	_, err = handshake(nil)
+	if err == nil {
+		t.Error("connection without client certificate is accepted")
+	}
+
+	_, err = handshake(newTestCert(t, "attacker", newTestCert(t, "other ca", nil, true), false))
+	if err == nil {
+		t.Error("client certificate signed by another CA is accepted")
+	}
+}
+
+// tcpPipe returns both ends of a loopback TCP connection, they're closed at the end of the test
+func tcpPipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	return client, server
+}
+
+func TestSubject(t *testing.T) {
+	withCN := newTestCert(t, "backoffice.internal", nil, false)
+	if got := Subject(withCN.cert); got != "backoffice.internal" {
+		t.Errorf("subject = %v, want common name", got)
+	}
+
+	withoutCN := newTestCert(t, "", nil, false)
+	if got := Subject(withoutCN.cert); got != "O=segmentify" {
+		t.Errorf("subject = %v, want distinguished name", got)
+	}
+}
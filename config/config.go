@@ -0,0 +1,558 @@
+// Package config loads the configuration of the service from the defaults, a YAML or TOML file,
+// environment variables and flags, every source overrides the previous ones
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvFile is a name of the environment variable that contains the path to the configuration file
+const EnvFile = "CONFIG_FILE"
+
+// redacted replaces the secrets in the printed configuration
+const redacted = "REDACTED"
+
+var (
+	// ErrInvalidConfig is an error returned when the configuration has incorrect values
+	ErrInvalidConfig = errors.New("invalid configuration")
+
+	// ErrUnknownFileFormat is an error returned when the configuration file isn't YAML or TOML
+	ErrUnknownFileFormat = errors.New("configuration file must have .yaml, .yml or .toml extension")
+)
+
+// Config is the configuration of the service
+type Config struct {
+	Server      Server      `yaml:"server" toml:"server"`
+	Admin       Admin       `yaml:"admin" toml:"admin"`
+	Database    Database    `yaml:"database" toml:"database"`
+	Log         Log         `yaml:"log" toml:"log"`
+	Auth        Auth        `yaml:"auth" toml:"auth"`
+	RateLimit   RateLimit   `yaml:"rate_limit" toml:"rate_limit"`
+	Idempotency Idempotency `yaml:"idempotency" toml:"idempotency"`
+	Expiration  Expiration  `yaml:"expiration" toml:"expiration"`
+	History     History     `yaml:"history" toml:"history"`
+	OpenAPI     OpenAPI     `yaml:"openapi" toml:"openapi"`
+	Tracing     Tracing     `yaml:"tracing" toml:"tracing"`
+}
+
+// Server defines the HTTP server
+type Server struct {
+	// address the server listens on, e.g. :9090
+	BindAddress string `yaml:"bind_address" toml:"bind_address"`
+
+	// max time to read request from the client
+	ReadTimeout time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+
+	// max time to write response to the client
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+
+	// max time for connections using TCP Keep-Alive
+	IdleTimeout time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+
+	// max time to wait for the current requests on shutdown
+	ShutdownGrace time.Duration `yaml:"shutdown_grace" toml:"shutdown_grace"`
+
+	// how long readiness fails before the server stops accepting connections on shutdown
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" toml:"shutdown_drain_delay"`
+
+	// CORS policy
+	CORS CORS `yaml:"cors" toml:"cors"`
+
+	// addresses or CIDR networks of the reverse proxies whose X-Forwarded-Proto header is trusted
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+
+	// TLS of the server, it serves plain HTTP if there is no certificate
+	TLS TLS `yaml:"tls" toml:"tls"`
+}
+
+// TLS defines the certificates of the server and the verification of the client certificates
+type TLS struct {
+	// PEM files of the certificate chain and its private key
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+
+	// PEM file of the CA the client certificates are verified against
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+
+	// none, optional or require
+	ClientAuth string `yaml:"client_auth" toml:"client_auth"`
+
+	// how often the files are checked for changes
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+// CORS defines the cross-origin requests allowed by the server
+type CORS struct {
+	// origins allowed to make the requests, * allows all of them
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+}
+
+// Database defines the connection to the database
+type Database struct {
+	// connection string of postgresql database, it's a secret
+	ConnectionString string `yaml:"connection_string" toml:"connection_string"`
+
+	// how long the attempts to connect are retried on start
+	ConnectTimeout time.Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+
+	// maximum number of open connections, 0 means unlimited
+	MaxOpenConns int `yaml:"max_open_conns" toml:"max_open_conns"`
+
+	// maximum number of idle connections kept in the pool
+	MaxIdleConns int `yaml:"max_idle_conns" toml:"max_idle_conns"`
+
+	// maximum time the connection is reused, 0 means forever
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+
+	// maximum duration of every query
+	QueryTimeout time.Duration `yaml:"query_timeout" toml:"query_timeout"`
+
+	// how often the segments and users' segments are counted for the metrics
+	StatsInterval time.Duration `yaml:"stats_interval" toml:"stats_interval"`
+}
+
+// Log defines the logs of the service
+type Log struct {
+	// minimal level of the logs: debug, info, warn, error or fatal
+	Level string `yaml:"level" toml:"level"`
+
+	// format of the logs: text, json or logfmt
+	Format string `yaml:"format" toml:"format"`
+
+	// format of the access log: logfmt, json or none to disable it
+	AccessFormat string `yaml:"access_format" toml:"access_format"`
+}
+
+// Auth defines the authentication of the clients
+type Auth struct {
+	// API key with admin role stored in the database on start, it's a secret
+	AdminAPIKey string `yaml:"admin_api_key" toml:"admin_api_key"`
+
+	// path to the file or URL with JSON Web Key Set used to verify bearer tokens, empty disables bearer tokens
+	JWKSSource string `yaml:"jwks_source" toml:"jwks_source"`
+
+	// how long the JSON Web Key Set is cached
+	JWKSCacheTTL time.Duration `yaml:"jwks_cache_ttl" toml:"jwks_cache_ttl"`
+
+	// required issuer of bearer tokens
+	JWTIssuer string `yaml:"jwt_issuer" toml:"jwt_issuer"`
+
+	// required audience of bearer tokens
+	JWTAudience string `yaml:"jwt_audience" toml:"jwt_audience"`
+
+	// name of the claim with segmentify role
+	JWTRoleClaim string `yaml:"jwt_role_claim" toml:"jwt_role_claim"`
+
+	// name of the claim with prefixes of the segments the caller can change
+	JWTPrefixesClaim string `yaml:"jwt_prefixes_claim" toml:"jwt_prefixes_claim"`
+}
+
+// RateLimit defines the limits of the read and write requests of every client
+type RateLimit struct {
+	Read  Limit `yaml:"read" toml:"read"`
+	Write Limit `yaml:"write" toml:"write"`
+}
+
+// Limit defines the rate limit of the group of the requests
+type Limit struct {
+	// requests per second, 0 disables the limit
+	Rate float64 `yaml:"rate" toml:"rate"`
+
+	// number of requests the client can make at once
+	Burst int `yaml:"burst" toml:"burst"`
+}
+
+// Admin defines the listener of the operational endpoints and runtime controls
+type Admin struct {
+	// address the admin listener binds to, empty disables it and the operational endpoints are served publicly
+	BindAddress string `yaml:"bind_address" toml:"bind_address"`
+}
+
+// Idempotency defines storing of the responses to the requests with Idempotency-Key header
+type Idempotency struct {
+	// how long the responses are stored
+	KeyTTL time.Duration `yaml:"key_ttl" toml:"key_ttl"`
+
+	// how often the expired responses are deleted
+	PurgeInterval time.Duration `yaml:"purge_interval" toml:"purge_interval"`
+}
+
+// Expiration defines removal of the users' segments after their expiration date
+type Expiration struct {
+	// how often the expired segments are removed
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+
+	// maximum number of segments removed in one transaction
+	BatchSize int `yaml:"batch_size" toml:"batch_size"`
+}
+
+// History defines the files with users' segments history
+type History struct {
+	// directory the CSV files are written to and served from
+	Dir string `yaml:"dir" toml:"dir"`
+}
+
+// OpenAPI defines validation of the requests against the OpenAPI document
+type OpenAPI struct {
+	// off, requests or test, in test mode the responses are validated too
+	Validation string `yaml:"validation" toml:"validation"`
+}
+
+// Tracing defines the export of OpenTelemetry spans
+type Tracing struct {
+	// none, stdout or otlp
+	Exporter string `yaml:"exporter" toml:"exporter"`
+}
+
+// Default returns the configuration used if there is no other value
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			BindAddress:        ":9090",
+			ReadTimeout:        5 * time.Second,
+			WriteTimeout:       10 * time.Second,
+			IdleTimeout:        120 * time.Second,
+			ShutdownGrace:      30 * time.Second,
+			ShutdownDrainDelay: 5 * time.Second,
+			CORS: CORS{
+				AllowedOrigins: []string{"*"},
+			},
+			TLS: TLS{
+				ClientAuth:     "none",
+				ReloadInterval: time.Minute,
+			},
+		},
+		Database: Database{
+			ConnectTimeout:  time.Minute,
+			MaxOpenConns:    20,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			QueryTimeout:    5 * time.Second,
+			StatsInterval:   30 * time.Second,
+		},
+		Log: Log{
+			Level:        "info",
+			Format:       "text",
+			AccessFormat: "logfmt",
+		},
+		Auth: Auth{
+			JWKSCacheTTL: 5 * time.Minute,
+		},
+		RateLimit: RateLimit{
+			Read:  Limit{Rate: 50, Burst: 100},
+			Write: Limit{Rate: 10, Burst: 20},
+		},
+		Idempotency: Idempotency{
+			KeyTTL:        24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		Expiration: Expiration{
+			Interval:  time.Minute,
+			BatchSize: 1000,
+		},
+		History: History{
+			Dir: "history",
+		},
+		OpenAPI: OpenAPI{
+			Validation: "off",
+		},
+		Tracing: Tracing{
+			Exporter: "none",
+		},
+	}
+}
+
+// Load returns the configuration: the defaults overridden by the file, environment variables and flags in args
+// The file is set by -config flag or CONFIG_FILE environment variable. The configuration isn't validated
+func Load(name string, args []string) (*Config, error) {
+	// the flags are parsed first to find the file, they are applied again after it
+	file := os.Getenv(EnvFile)
+	fs, _ := Default().flagSet(name, &file)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	c := Default()
+	if file != "" {
+		err = c.loadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fs, envs := c.flagSet(name, &file)
+	err = c.loadEnv(fs, envs)
+	if err != nil {
+		return nil, err
+	}
+
+	// the flags were already checked
+	_ = fs.Parse(args)
+
+	return c, nil
+}
+
+// Usage writes the flags with their environment variables and defaults to w
+func Usage(name string, w io.Writer) {
+	file := ""
+	fs, _ := Default().flagSet(name, &file)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// loadFile overrides the configuration with the values from YAML or TOML file
+func (c *Config) loadFile(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		err = d.Decode(c)
+		if errors.Is(err, io.EOF) {
+			// the file is empty
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), c)
+		if err == nil && len(md.Undecoded()) != 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("%w: %v", ErrUnknownFileFormat, file)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse configuration file %v: %w", file, err)
+	}
+
+	return nil
+}
+
+// loadEnv overrides the configuration with the environment variables of the flags, envs maps the flags to them
+// Empty variables are ignored
+func (c *Config) loadEnv(fs *flag.FlagSet, envs map[string]string) error {
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := os.Getenv(envs[name])
+		if value == "" {
+			continue
+		}
+
+		err := fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q of %v: %w", value, envs[name], err)
+		}
+	}
+
+	return nil
+}
+
+// flagSet returns the flags bound to the fields of the configuration with their current values as defaults
+// and the environment variables of the flags
+func (c *Config) flagSet(name string, file *string) (*flag.FlagSet, map[string]string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	b := binder{fs: fs, envs: make(map[string]string)}
+
+	fs.StringVar(file, "config", *file, fmt.Sprintf("path to YAML or TOML configuration file (env %v)", EnvFile))
+
+	b.string(&c.Server.BindAddress, "server.bind-address", "BIND_ADDRESS", "address the server listens on")
+	b.duration(&c.Server.ReadTimeout, "server.read-timeout", "READ_TIMEOUT", "max time to read request from the client")
+	b.duration(&c.Server.WriteTimeout, "server.write-timeout", "WRITE_TIMEOUT", "max time to write response to the client")
+	b.duration(&c.Server.IdleTimeout, "server.idle-timeout", "IDLE_TIMEOUT", "max time for connections using TCP Keep-Alive")
+	b.duration(&c.Server.ShutdownGrace, "server.shutdown-grace", "SHUTDOWN_GRACE", "max time to wait for the current requests on shutdown")
+	b.duration(&c.Server.ShutdownDrainDelay, "server.shutdown-drain-delay", "SHUTDOWN_DRAIN_DELAY", "how long readiness fails before the server stops accepting connections on shutdown")
+	b.list(&c.Server.CORS.AllowedOrigins, "server.cors.allowed-origins", "CORS_ALLOWED_ORIGINS", "comma-separated origins allowed to make cross-origin requests, * allows all of them")
+	b.list(&c.Server.TrustedProxies, "server.trusted-proxies", "TRUSTED_PROXIES", "comma-separated addresses or CIDR networks of the reverse proxies whose X-Forwarded-Proto header is trusted")
+	b.string(&c.Server.TLS.CertFile, "server.tls.cert-file", "TLS_CERT_FILE", "PEM file of the server certificate chain, empty serves plain HTTP")
+	b.string(&c.Server.TLS.KeyFile, "server.tls.key-file", "TLS_KEY_FILE", "PEM file of the private key of the server certificate")
+	b.string(&c.Server.TLS.ClientCAFile, "server.tls.client-ca-file", "TLS_CLIENT_CA_FILE", "PEM file of the CA the client certificates are verified against")
+	b.string(&c.Server.TLS.ClientAuth, "server.tls.client-auth", "TLS_CLIENT_AUTH", "verification of the client certificates: none, optional or require")
+	b.duration(&c.Server.TLS.ReloadInterval, "server.tls.reload-interval", "TLS_RELOAD_INTERVAL", "how often the certificate files are checked for changes")
+	b.string(&c.Admin.BindAddress, "admin.bind-address", "ADMIN_BIND_ADDRESS", "address of the admin listener with pprof, metrics, probes and runtime controls, empty disables it")
+
+	b.string(&c.Database.ConnectionString, "database.connection-string", "DB_CONNECTION_STRING", "connection string of postgresql database")
+	b.duration(&c.Database.ConnectTimeout, "database.connect-timeout", "DB_CONNECT_TIMEOUT", "how long the attempts to connect to the database are retried on start")
+	b.int(&c.Database.MaxOpenConns, "database.max-open-conns", "DB_MAX_OPEN_CONNS", "maximum number of open connections to the database, 0 means unlimited")
+	b.int(&c.Database.MaxIdleConns, "database.max-idle-conns", "DB_MAX_IDLE_CONNS", "maximum number of idle connections kept in the pool")
+	b.duration(&c.Database.ConnMaxLifetime, "database.conn-max-lifetime", "DB_CONN_MAX_LIFETIME", "maximum time the connection is reused, 0 means forever")
+	b.duration(&c.Database.QueryTimeout, "database.query-timeout", "DB_QUERY_TIMEOUT", "maximum duration of every query")
+	b.duration(&c.Database.StatsInterval, "database.stats-interval", "DB_STATS_INTERVAL", "how often the segments and users' segments are counted for the metrics")
+
+	b.string(&c.Log.Level, "log.level", "LOG_LEVEL", "minimal level of the logs: debug, info, warn, error or fatal")
+	b.string(&c.Log.Format, "log.format", "LOG_FORMAT", "format of the logs: text, json or logfmt")
+	b.string(&c.Log.AccessFormat, "log.access-format", "ACCESS_LOG_FORMAT", "format of the access log: logfmt, json or none to disable it")
+
+	b.string(&c.Auth.AdminAPIKey, "auth.admin-api-key", "ADMIN_API_KEY", "API key with admin role stored in the database on start")
+	b.string(&c.Auth.JWKSSource, "auth.jwks-source", "JWKS_SOURCE", "path to the file or URL with JSON Web Key Set used to verify bearer tokens")
+	b.duration(&c.Auth.JWKSCacheTTL, "auth.jwks-cache-ttl", "JWKS_CACHE_TTL", "how long the JSON Web Key Set is cached")
+	b.string(&c.Auth.JWTIssuer, "auth.jwt-issuer", "JWT_ISSUER", "required issuer of bearer tokens")
+	b.string(&c.Auth.JWTAudience, "auth.jwt-audience", "JWT_AUDIENCE", "required audience of bearer tokens")
+	b.string(&c.Auth.JWTRoleClaim, "auth.jwt-role-claim", "JWT_ROLE_CLAIM", "name of the claim with segmentify role")
+	b.string(&c.Auth.JWTPrefixesClaim, "auth.jwt-prefixes-claim", "JWT_PREFIXES_CLAIM", "name of the claim with prefixes of the segments the caller can change")
+
+	b.float(&c.RateLimit.Read.Rate, "rate-limit.read.rate", "RATE_LIMIT_READ_RATE", "read requests per second allowed for every client, 0 disables the limit")
+	b.int(&c.RateLimit.Read.Burst, "rate-limit.read.burst", "RATE_LIMIT_READ_BURST", "read requests every client can make at once")
+	b.float(&c.RateLimit.Write.Rate, "rate-limit.write.rate", "RATE_LIMIT_WRITE_RATE", "write requests per second allowed for every client, 0 disables the limit")
+	b.int(&c.RateLimit.Write.Burst, "rate-limit.write.burst", "RATE_LIMIT_WRITE_BURST", "write requests every client can make at once")
+
+	b.duration(&c.Idempotency.KeyTTL, "idempotency.key-ttl", "IDEMPOTENCY_KEY_TTL", "how long the responses to the requests with Idempotency-Key header are stored")
+	b.duration(&c.Idempotency.PurgeInterval, "idempotency.purge-interval", "IDEMPOTENCY_PURGE_INTERVAL", "how often the expired responses to the requests with Idempotency-Key header are deleted")
+	b.duration(&c.Expiration.Interval, "expiration.interval", "EXPIRATION_INTERVAL", "how often the users' segments are removed after their expiration date")
+	b.int(&c.Expiration.BatchSize, "expiration.batch-size", "EXPIRATION_BATCH_SIZE", "maximum number of expired users' segments removed in one transaction")
+	b.string(&c.History.Dir, "history.dir", "HISTORY_DIR", "directory the CSV files with users' segments history are written to")
+	b.string(&c.OpenAPI.Validation, "openapi.validation", "OPENAPI_VALIDATION", "validation against the OpenAPI document: off, requests or test")
+	b.string(&c.Tracing.Exporter, "tracing.exporter", "TRACING_EXPORTER", "exporter of OpenTelemetry spans: none, stdout or otlp")
+
+	return fs, b.envs
+}
+
+// Validate returns ErrInvalidConfig listing all the incorrect values of the configuration
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Server.BindAddress)
+	check(err == nil, "server.bind_address must be host:port, got %q", c.Server.BindAddress)
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(c.Server.ShutdownGrace > 0, "server.shutdown_grace must be positive")
+	check(c.Server.ShutdownDrainDelay >= 0, "server.shutdown_drain_delay must not be negative")
+	check(len(c.Server.CORS.AllowedOrigins) != 0, "server.cors.allowed_origins must not be empty")
+	_, err = c.Server.TrustedProxyNetworks()
+	check(err == nil, "server.trusted_proxies must be IP addresses or CIDR networks: %v", err)
+	tlsConfig := c.Server.TLS
+	check((tlsConfig.CertFile == "") == (tlsConfig.KeyFile == ""), "server.tls.cert_file and server.tls.key_file must be set together")
+	check(oneOf(tlsConfig.ClientAuth, "none", "optional", "require"), "server.tls.client_auth must be none, optional or require, got %q", tlsConfig.ClientAuth)
+	check(tlsConfig.ClientAuth == "none" || tlsConfig.CertFile != "", "server.tls.client_auth requires server.tls.cert_file")
+	check((tlsConfig.ClientAuth == "none") == (tlsConfig.ClientCAFile == ""), "server.tls.client_ca_file must be set if and only if server.tls.client_auth isn't none")
+	check(tlsConfig.ReloadInterval > 0, "server.tls.reload_interval must be positive")
+
+	check(c.Database.ConnectionString != "", "database.connection_string is required")
+	check(c.Database.ConnectTimeout > 0, "database.connect_timeout must be positive")
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "database.max_idle_conns must not be greater than database.max_open_conns")
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime must not be negative")
+	check(c.Database.QueryTimeout > 0, "database.query_timeout must be positive")
+	check(c.Database.StatsInterval > 0, "database.stats_interval must be positive")
+
+	check(oneOf(c.Log.Level, "debug", "info", "warn", "error", "fatal"), "log.level must be debug, info, warn, error or fatal, got %q", c.Log.Level)
+	check(oneOf(c.Log.Format, "text", "json", "logfmt"), "log.format must be text, json or logfmt, got %q", c.Log.Format)
+	check(oneOf(c.Log.AccessFormat, "logfmt", "json", "none"), "log.access_format must be logfmt, json or none, got %q", c.Log.AccessFormat)
+
+	check(c.Auth.JWKSCacheTTL > 0, "auth.jwks_cache_ttl must be positive")
+
+	for group, limit := range map[string]Limit{"read": c.RateLimit.Read, "write": c.RateLimit.Write} {
+		check(limit.Rate >= 0, "rate_limit.%v.rate must not be negative", group)
+		check(limit.Burst >= 1, "rate_limit.%v.burst must be positive", group)
+	}
+
+	check(c.Admin.BindAddress == "" || c.Admin.BindAddress != c.Server.BindAddress, "admin.bind_address must differ from server.bind_address")
+	check(c.Idempotency.KeyTTL > 0, "idempotency.key_ttl must be positive")
+	check(c.Idempotency.PurgeInterval > 0, "idempotency.purge_interval must be positive")
+	check(c.Expiration.Interval > 0, "expiration.interval must be positive")
+	check(c.Expiration.BatchSize >= 1, "expiration.batch_size must be positive")
+	check(c.History.Dir != "", "history.dir is required")
+	check(oneOf(c.OpenAPI.Validation, "off", "requests", "test"), "openapi.validation must be off, requests or test, got %q", c.OpenAPI.Validation)
+	check(oneOf(c.Tracing.Exporter, "none", "stdout", "otlp"), "tracing.exporter must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// TrustedProxyNetworks returns the networks of the trusted proxies, the addresses are networks with one address
+func (s Server) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(s.TrustedProxies))
+	for _, proxy := range s.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address %q", proxy)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Redacted returns a copy of the configuration with the secrets replaced
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Server.CORS.AllowedOrigins = append([]string(nil), c.Server.CORS.AllowedOrigins...)
+	r.Server.TrustedProxies = append([]string(nil), c.Server.TrustedProxies...)
+
+	for _, secret := range []*string{&r.Database.ConnectionString, &r.Auth.AdminAPIKey} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+
+	return &r
+}
+
+// WriteYAML writes the configuration to w in YAML format, the secrets must be redacted before
+func (c *Config) WriteYAML(w io.Writer) error {
+	e := yaml.NewEncoder(w)
+	e.SetIndent(2)
+
+	err := e.Encode(c)
+	if err != nil {
+		return fmt.Errorf("unable to encode configuration: %w", err)
+	}
+
+	return e.Close()
+}
+
+// oneOf returns true if the value is one of the values
+func oneOf(value string, values ...string) bool {
+	for _, v := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
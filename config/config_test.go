@@ -0,0 +1,202 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes the configuration file to the temporary directory and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(file, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// validConfig returns the default configuration with the required values set
+func validConfig() *Config {
+	c := Default()
+	c.Database.ConnectionString = "postgres://segmentify@localhost/segmentify"
+
+	return c
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+server:
+  bind_address: ":8080"
+  read_timeout: 7s
+log:
+  level: debug
+  format: json
+`)
+	t.Setenv(EnvFile, file)
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("READ_TIMEOUT", "")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example, ,https://b.example")
+
+	c, err := Load("segmentify", []string{"-log.level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file overrides the defaults, empty environment variables are ignored
+	if c.Server.BindAddress != ":8080" || c.Server.ReadTimeout != 7*time.Second || c.Log.Format != "json" {
+		t.Errorf("values from the file aren't applied: %+v, %+v", c.Server, c.Log)
+	}
+	// the flags override the environment variables
+	if c.Log.Level != "error" {
+		t.Errorf("log level = %v, want error", c.Log.Level)
+	}
+	if got := strings.Join(c.Server.CORS.AllowedOrigins, ","); got != "https://a.example,https://b.example" {
+		t.Errorf("allowed origins = %v", got)
+	}
+	// the defaults are kept
+	if c.Server.WriteTimeout != Default().Server.WriteTimeout {
+		t.Errorf("write timeout = %v, want the default", c.Server.WriteTimeout)
+	}
+}
+
+func TestLoadFileFormats(t *testing.T) {
+	t.Setenv(EnvFile, "")
+
+	t.Run("toml", func(t *testing.T) {
+		file := writeFile(t, "config.toml", "[expiration]\nbatch_size = 10\n")
+		c, err := Load("segmentify", []string{"-config", file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Expiration.BatchSize != 10 {
+			t.Errorf("batch size = %v, want 10", c.Expiration.BatchSize)
+		}
+	})
+
+	t.Run("empty yaml", func(t *testing.T) {
+		file := writeFile(t, "config.yml", "")
+		_, err := Load("segmentify", []string{"-config", file})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("unknown keys", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"config.yaml": "server:\n  bind_adress: \":8080\"\n",
+			"config.toml": "[server]\nbind_adress = \":8080\"\n",
+		} {
+			_, err := Load("segmentify", []string{"-config", writeFile(t, name, content)})
+			if err == nil {
+				t.Errorf("%v with unknown key is loaded", name)
+			}
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := Load("segmentify", []string{"-config", writeFile(t, "config.json", "{}")})
+		if !errors.Is(err, ErrUnknownFileFormat) {
+			t.Errorf("error = %v, want %v", err, ErrUnknownFileFormat)
+		}
+	})
+}
+
+func TestLoadRejectsIncorrectValues(t *testing.T) {
+	t.Setenv(EnvFile, "")
+
+	t.Setenv("EXPIRATION_BATCH_SIZE", "many")
+	_, err := Load("segmentify", nil)
+	if err == nil || !strings.Contains(err.Error(), "EXPIRATION_BATCH_SIZE") {
+		t.Errorf("error = %v, want invalid EXPIRATION_BATCH_SIZE", err)
+	}
+	t.Setenv("EXPIRATION_BATCH_SIZE", "")
+
+	_, err = Load("segmentify", []string{"extra"})
+	if err == nil {
+		t.Error("positional arguments are accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	err := validConfig().Validate()
+	if err != nil {
+		t.Fatalf("default configuration with connection string is invalid: %v", err)
+	}
+
+	c := validConfig()
+	c.Server.BindAddress = "9090"
+	c.Server.TLS.CertFile = "server.pem"
+	c.Log.Level = "verbose"
+	c.RateLimit.Write.Burst = 0
+	c.Admin.BindAddress = c.Server.BindAddress
+
+	err = c.Validate()
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("error = %v, want %v", err, ErrInvalidConfig)
+	}
+	for _, problem := range []string{
+		"server.bind_address",
+		"server.tls.cert_file and server.tls.key_file",
+		"log.level",
+		"rate_limit.write.burst",
+		"admin.bind_address",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error %q doesn't mention %v", err, problem)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := validConfig()
+	c.Auth.AdminAPIKey = "secret"
+
+	r := c.Redacted()
+	if r.Database.ConnectionString != redacted || r.Auth.AdminAPIKey != redacted {
+		t.Errorf("secrets aren't redacted: %v, %v", r.Database.ConnectionString, r.Auth.AdminAPIKey)
+	}
+	if c.Auth.AdminAPIKey != "secret" {
+		t.Error("original configuration is changed")
+	}
+
+	var b bytes.Buffer
+	err := r.WriteYAML(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "secret") || !strings.Contains(b.String(), "admin_api_key: REDACTED") {
+		t.Errorf("written configuration:\n%v", b.String())
+	}
+}
+
+func TestTrustedProxyNetworks(t *testing.T) {
+	s := Server{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.10", "::1"}}
+	networks, err := s.TrustedProxyNetworks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.10/32", "::1/128"}
+	if len(networks) != len(want) {
+		t.Fatalf("networks = %v, want %v", networks, want)
+	}
+	for i := range want {
+		if networks[i].String() != want[i] {
+			t.Errorf("network %v = %v, want %v", i, networks[i], want[i])
+		}
+	}
+
+	c := validConfig()
+	c.Server.TrustedProxies = []string{"proxy.internal"}
+	err = c.Validate()
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "server.trusted_proxies") {
+		t.Errorf("error = %v, want invalid server.trusted_proxies", err)
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// binder defines the flags bound to the fields of the configuration and remembers their environment variables
+type binder struct {
+	fs   *flag.FlagSet
+	envs map[string]string
+}
+
+func (b binder) string(p *string, name, env, usage string) {
+	b.fs.StringVar(p, name, *p, b.usage(name, env, usage))
+}
+
+func (b binder) duration(p *time.Duration, name, env, usage string) {
+	b.fs.DurationVar(p, name, *p, b.usage(name, env, usage))
+}
+
+func (b binder) float(p *float64, name, env, usage string) {
+	b.fs.Float64Var(p, name, *p, b.usage(name, env, usage))
+}
+
+func (b binder) int(p *int, name, env, usage string) {
+	b.fs.IntVar(p, name, *p, b.usage(name, env, usage))
+}
+
+func (b binder) list(p *[]string, name, env, usage string) {
+	b.fs.Var((*listValue)(p), name, b.usage(name, env, usage))
+}
+
+// usage remembers the environment variable of the flag and returns the usage mentioning it
+func (b binder) usage(name, env, usage string) string {
+	b.envs[name] = env
+	return fmt.Sprintf("%v (env %v)", usage, env)
+}
+
+// listValue is a flag.Value of comma-separated list
+type listValue []string
+
+// String returns the items separated by commas
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+// Set replaces the items with the comma-separated ones from s, empty items are skipped
+func (l *listValue) Set(s string) error {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*l = items
+
+	return nil
+}
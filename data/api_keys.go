@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/tracing"
+)
+
+const (
+	// RoleReader allows to read segments, user's segments and history
+	RoleReader = "reader"
+
+	// RoleWriter allows everything RoleReader does and to change segments and user's segments
+	RoleWriter = "writer"
+
+	// RoleAdmin allows everything RoleWriter does and to manage API keys
+	RoleAdmin = "admin"
+
+	// apiKeyPrefix makes segmentify API keys recognizable
+	apiKeyPrefix = "sgm_"
+
+	// apiKeyLength is a number of random bytes in the API key
+	apiKeyLength = 32
+)
+
+// roleLevels defines the hierarchy of the roles, every role includes the permissions of the roles below it
+var roleLevels = map[string]int{
+	RoleReader: 1,
+	RoleWriter: 2,
+	RoleAdmin:  3,
+}
+
+var (
+	// ErrAPIKeyNotFound is an error returned when an API key can not be found in the database
+	ErrAPIKeyNotFound = fmt.Errorf("API key not found")
+
+	// ErrInvalidAPIKey is an error returned when an API key is unknown or revoked
+	ErrInvalidAPIKey = fmt.Errorf("invalid API key")
+)
+
+// RoleAllows returns true if the role has the permissions of the required role
+func RoleAllows(role, required string) bool {
+	level, ok := roleLevels[role]
+	if !ok {
+		return false
+	}
+
+	return level >= roleLevels[required]
+}
+
+// CreateAPIKey generates a new API key and stores its hash in the database
+// The returned response is the only place where the API key itself is available
+func (s *SegmentifyDB) CreateAPIKey(ctx context.Context, request models.CreateAPIKeyRequest) (models.CreateAPIKeyResponse, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.CreateAPIKey")
+	defer span.End()
+
+	b := make([]byte, apiKeyLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return models.CreateAPIKeyResponse{}, fmt.Errorf("unable to generate API key: %w", err)
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+
+	keyDB, err := s.db.InsertAPIKey(ctx, request.Name, hashAPIKey(key), request.Role)
+	if err != nil {
+		return models.CreateAPIKeyResponse{}, fmt.Errorf("unable to insert API key: %w", err)
+	}
+
+	return models.CreateAPIKeyResponse{
+		APIKey: toAPIKey(keyDB),
+		Key:    key,
+	}, nil
+}
+
+// EnsureAPIKey makes the given API key the only active key with given name
+// It's used to bootstrap the first admin key, when the key is changed the previous one is revoked
+func (s *SegmentifyDB) EnsureAPIKey(ctx context.Context, name, key, role string) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.EnsureAPIKey")
+	defer span.End()
+
+	revoked, err := s.db.ReplaceAPIKey(ctx, name, hashAPIKey(key), role)
+	if err != nil {
+		return fmt.Errorf("unable to replace API key: %w", err)
+	}
+	if revoked > 0 {
+		s.l.Info("Previous API keys revoked", "name", name, "revoked", revoked)
+	}
+
+	return nil
+}
+
+// Authenticate returns the active API key matching the given key
+func (s *SegmentifyDB) Authenticate(ctx context.Context, key string) (models.APIKey, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.Authenticate")
+	defer span.End()
+
+	keyDB, err := s.db.SelectActiveAPIKeyByHash(ctx, hashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.APIKey{}, ErrInvalidAPIKey
+		}
+		return models.APIKey{}, fmt.Errorf("unable to get API key: %w", err)
+	}
+
+	return toAPIKey(keyDB), nil
+}
+
+// GetAPIKeys returns all API keys from the database
+func (s *SegmentifyDB) GetAPIKeys(ctx context.Context) (models.APIKeys, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.GetAPIKeys")
+	defer span.End()
+
+	keysDB, err := s.db.SelectAPIKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get API keys: %w", err)
+	}
+
+	keys := make(models.APIKeys, len(keysDB))
+	for i, keyDB := range keysDB {
+		keys[i] = toAPIKey(keyDB)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes the API key with given id
+func (s *SegmentifyDB) RevokeAPIKey(ctx context.Context, id int) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.RevokeAPIKey")
+	defer span.End()
+
+	err := s.db.RevokeAPIKey(ctx, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAPIKeyNotFound
+		}
+		return fmt.Errorf("unable to revoke API key: %w", err)
+	}
+
+	return nil
+}
+
+// hashAPIKey returns hex-encoded SHA-256 hash of the API key
+// API keys are long random strings, so a fast hash is enough to store them safely
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// toAPIKey converts the database API key into the API one
+func toAPIKey(keyDB models.APIKeyDB) models.APIKey {
+	key := models.APIKey{
+		ID:        keyDB.ID,
+		Name:      keyDB.Name,
+		Role:      keyDB.Role,
+		CreatedAt: keyDB.CreatedAt,
+	}
+
+	if keyDB.RevokedAt.Valid {
+		key.RevokedAt = &keyDB.RevokedAt.Time
+	}
+
+	return key
+}
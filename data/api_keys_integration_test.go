@@ -0,0 +1,59 @@
+package data_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/peyuaa/segmentify/data"
+)
+
+func TestEnsureAPIKeyRevokesReplacedKey(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	name := newSlug("BOOTSTRAP")
+	oldKey, newKey := newSlug("OLD_KEY"), newSlug("NEW_KEY")
+
+	err := s.EnsureAPIKey(ctx, name, oldKey, data.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the restart with the same key keeps it
+	err = s.EnsureAPIKey(ctx, name, oldKey, data.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Authenticate(ctx, oldKey)
+	if err != nil {
+		t.Fatalf("key isn't active after restart: %v", err)
+	}
+
+	// the rotated key replaces the previous one
+	err = s.EnsureAPIKey(ctx, name, newKey, data.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Authenticate(ctx, newKey)
+	if err != nil {
+		t.Fatalf("new key isn't active: %v", err)
+	}
+	_, err = s.Authenticate(ctx, oldKey)
+	if !errors.Is(err, data.ErrInvalidAPIKey) {
+		t.Errorf("old key error = %v, want %v", err, data.ErrInvalidAPIKey)
+	}
+
+	active := 0
+	keys, err := s.GetAPIKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if key.Name == name && key.RevokedAt == nil {
+			active++
+		}
+	}
+	if active != 1 {
+		t.Errorf("%v active keys named %v, want 1", active, name)
+	}
+}
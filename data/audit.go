@@ -0,0 +1,89 @@
+package data
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/tracing"
+)
+
+const (
+	// DefaultAuditLimit is a number of audit log records returned if the limit isn't specified
+	DefaultAuditLimit = 100
+
+	// MaxAuditLimit is a maximum number of audit log records returned at once
+	MaxAuditLimit = 1000
+)
+
+// ErrInvalidAuditLimit is an error returned when the requested number of audit log records is out of range
+var ErrInvalidAuditLimit = fmt.Errorf("limit must be between 1 and %v", MaxAuditLimit)
+
+// RecordAudit appends the record to the audit log
+func (s *SegmentifyDB) RecordAudit(ctx context.Context, entry models.AuditEntry) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.RecordAudit")
+	defer span.End()
+
+	err := s.db.InsertAuditEntry(ctx, models.AuditEntryDB{
+		Actor:         entry.Actor,
+		Reason:        entry.Reason,
+		Method:        entry.Method,
+		Route:         entry.Route,
+		Path:          entry.Path,
+		PayloadDigest: entry.PayloadDigest,
+		Status:        entry.Status,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to insert audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// GetAuditLog returns a page of the audit log records matching the filter, the newest first
+// If the filter has no limit, DefaultAuditLimit is used
+func (s *SegmentifyDB) GetAuditLog(ctx context.Context, filter models.AuditFilter) (models.AuditPage, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.GetAuditLog")
+	defer span.End()
+
+	if filter.Limit == 0 {
+		filter.Limit = DefaultAuditLimit
+	}
+	if filter.Limit < 0 || filter.Limit > MaxAuditLimit {
+		return models.AuditPage{}, ErrInvalidAuditLimit
+	}
+
+	limit := filter.Limit
+	// select one more record to know if there is the next page
+	filter.Limit++
+
+	entriesDB, err := s.db.SelectAuditEntries(ctx, filter)
+	if err != nil {
+		return models.AuditPage{}, fmt.Errorf("unable to get audit entries: %w", err)
+	}
+
+	page := models.AuditPage{
+		Entries: make([]models.AuditEntry, 0, len(entriesDB)),
+	}
+	if len(entriesDB) > limit {
+		entriesDB = entriesDB[:limit]
+		next := entriesDB[limit-1].ID
+		page.NextBeforeID = &next
+	}
+
+	for _, e := range entriesDB {
+		page.Entries = append(page.Entries, models.AuditEntry{
+			ID:            e.ID,
+			CreatedAt:     e.CreatedAt,
+			Actor:         e.Actor,
+			Reason:        e.Reason,
+			Method:        e.Method,
+			Route:         e.Route,
+			Path:          e.Path,
+			PayloadDigest: e.PayloadDigest,
+			Status:        e.Status,
+		})
+	}
+
+	return page, nil
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/peyuaa/segmentify/models"
+)
+
+// ErrPreconditionFailed is an error returned when the resource was changed since the client got it
+var ErrPreconditionFailed = fmt.Errorf("resource was changed, its ETag doesn't match")
+
+// ETag returns the strong entity tag of the JSON representation of v
+func ETag(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal json: %w", err)
+	}
+
+	sum := sha256.Sum256(b)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// ETagMatches returns true if etag matches any of the tags, "*" matches any etag
+// If weak is set, weak tags (W/"...") are compared by value, as If-None-Match requires,
+// otherwise they never match, as If-Match requires
+func ETagMatches(etag string, tags []string, weak bool) bool {
+	for _, tag := range tags {
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// userETag returns the entity tag of user's segments
+// User's segments expire at the beginning of the day, so the tag includes the current date
+func userETag(userID int, v models.UserVersionDB) string {
+	return fmt.Sprintf(`"u%d-%d-%s"`, userID, v.Version, v.Date.Format("20060102"))
+}
+
+// checkIfMatch returns ErrPreconditionFailed if ifMatch is set and doesn't match etag
+func checkIfMatch(etag string, ifMatch []string) error {
+	if ifMatch == nil || ETagMatches(etag, ifMatch, false) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: current ETag is %v", ErrPreconditionFailed, etag)
+}
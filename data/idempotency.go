@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/peyuaa/segmentify/db"
+	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/tracing"
+)
+
+var (
+	// ErrIdempotencyKeyReused is an error returned when the idempotency key is reused for a different request
+	ErrIdempotencyKeyReused = fmt.Errorf("idempotency key was used for a different request")
+
+	// ErrIdempotencyKeyInProgress is an error returned when the first request with the idempotency key isn't handled yet
+	ErrIdempotencyKeyInProgress = fmt.Errorf("request with the same idempotency key is in progress")
+)
+
+// ClaimIdempotencyKey reserves the idempotency key of the principal for the request with given digest
+// If the key was already used for the same request less than ttl ago, the stored response is returned,
+// otherwise the response is nil and the caller must save the response with SaveIdempotentResponse
+// or release the key with ReleaseIdempotencyKey
+func (s *SegmentifyDB) ClaimIdempotencyKey(ctx context.Context, principal, key, requestDigest string, ttl time.Duration) (*models.IdempotentResponse, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.ClaimIdempotencyKey")
+	defer span.End()
+
+	err := s.db.InsertIdempotencyKey(ctx, principal, key, requestDigest, time.Now().Add(-ttl))
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, db.ErrAlreadyExists) {
+		return nil, fmt.Errorf("unable to insert idempotency key: %w", err)
+	}
+
+	stored, err := s.db.SelectIdempotencyKey(ctx, principal, key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// the first request has failed and released the key in the meantime
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return nil, fmt.Errorf("unable to get idempotency key: %w", err)
+	}
+
+	if stored.RequestDigest != requestDigest {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !stored.Status.Valid {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	response := &models.IdempotentResponse{
+		Status: int(stored.Status.Int32),
+		Body:   stored.ResponseBody,
+	}
+	if len(stored.ResponseHeaders) != 0 {
+		err = json.Unmarshal(stored.ResponseHeaders, &response.Header)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unmarshal response headers: %w", err)
+		}
+	}
+
+	return response, nil
+}
+
+// SaveIdempotentResponse stores the response to the request with the idempotency key of the principal
+func (s *SegmentifyDB) SaveIdempotentResponse(ctx context.Context, principal, key string, response models.IdempotentResponse) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.SaveIdempotentResponse")
+	defer span.End()
+
+	headers, err := json.Marshal(response.Header)
+	if err != nil {
+		return fmt.Errorf("unable to marshal response headers: %w", err)
+	}
+
+	err = s.db.UpdateIdempotencyResponse(ctx, principal, key, response.Status, headers, response.Body)
+	if err != nil {
+		return fmt.Errorf("unable to update idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the idempotency key of the principal, so the request can be retried
+func (s *SegmentifyDB) ReleaseIdempotencyKey(ctx context.Context, principal, key string) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.ReleaseIdempotencyKey")
+	defer span.End()
+
+	err := s.db.DeleteIdempotencyKey(ctx, principal, key)
+	if err != nil {
+		return fmt.Errorf("unable to delete idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeIdempotencyKeys deletes the idempotency keys used more than ttl ago
+// Returns the number of deleted keys
+func (s *SegmentifyDB) PurgeIdempotencyKeys(ctx context.Context, ttl time.Duration) (int64, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.PurgeIdempotencyKeys")
+	defer span.End()
+
+	deleted, err := s.db.DeleteExpiredIdempotencyKeys(ctx, time.Now().Add(-ttl))
+	if err != nil {
+		return 0, fmt.Errorf("unable to delete expired idempotency keys: %w", err)
+	}
+
+	return deleted, nil
+}
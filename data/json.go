@@ -2,9 +2,13 @@ package data
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 )
 
+// ErrTrailingData is an error returned when there is something after the JSON value
+var ErrTrailingData = errors.New("unexpected data after JSON value")
+
 // ToJSON serializes the given interface into a string based JSON format
 func ToJSON(i interface{}, w io.Writer) error {
 	e := json.NewEncoder(w)
@@ -19,3 +23,28 @@ func FromJSON(i interface{}, r io.Reader) error {
 
 	return d.Decode(i)
 }
+
+// FromJSONStrict deserializes the object from JSON string in an io.Reader to the given interface
+// Unlike FromJSON, it fails if the JSON contains fields unknown to the object
+// or if there is anything after the JSON value
+func FromJSONStrict(i interface{}, r io.Reader) error {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+
+	err := d.Decode(i)
+	if err != nil {
+		return err
+	}
+
+	// only whitespace may follow the value
+	_, err = d.Token()
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil
+	case err == nil, errors.As(err, &syntaxErr):
+		return ErrTrailingData
+	default:
+		return err
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/peyuaa/segmentify/db"
 	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/tracing"
 
 	"github.com/charmbracelet/log"
 )
@@ -25,6 +26,18 @@ var (
 	// ErrIncorrectChangeUserSegmentsRequest is an error returned when a request to change user segments is incorrect
 	ErrIncorrectChangeUserSegmentsRequest = fmt.Errorf("incorrect change user segments request")
 
+	// ErrUserAlreadyHasSegment is an error returned when a segment is added to the user who already has it
+	ErrUserAlreadyHasSegment = fmt.Errorf("user already has segment")
+
+	// ErrUserDoesNotHaveSegment is an error returned when a segment is removed from the user who doesn't have it
+	ErrUserDoesNotHaveSegment = fmt.Errorf("user doesn't have segment")
+
+	// ErrDuplicatedSegment is an error returned when a request contains the same segment more than once
+	ErrDuplicatedSegment = fmt.Errorf("duplicated segment")
+
+	// ErrConflictingSegmentActions is an error returned when a request both adds and removes the same segment
+	ErrConflictingSegmentActions = fmt.Errorf("segment is both added and removed")
+
 	// ErrNoUserData is an error returned when there is no user data about segments for given userID
 	ErrNoUserData = fmt.Errorf("no user data about segments for given userID")
 
@@ -37,28 +50,30 @@ var (
 type SegmentifyDB struct {
 	l  *log.Logger
 	db *db.PostgresWrapper
+
+	// directory the files with users' segments history are written to
+	historyDir string
 }
 
-// New creates a new SegmentifyDB service
-func New(l *log.Logger, db *db.PostgresWrapper) *SegmentifyDB {
+// New creates a new SegmentifyDB service, the files with users' segments history are written to historyDir
+func New(l *log.Logger, db *db.PostgresWrapper, historyDir string) *SegmentifyDB {
 	return &SegmentifyDB{
-		l:  l,
-		db: db,
+		l:          l,
+		db:         db,
+		historyDir: historyDir,
 	}
 }
 
-// Add adds a new segment to the database
-func (s *SegmentifyDB) Add(ctx context.Context, segment models.CreateSegmentRequest) error {
-	exists, err := s.db.IsSegmentExists(ctx, segment.Slug)
-	if err != nil {
-		return fmt.Errorf("unable to check segment existence: %w", err)
-	}
-	if exists {
-		return ErrSegmentAlreadyExists
-	}
+// Add adds a new segment to the database, meta describes who creates the segment and why
+func (s *SegmentifyDB) Add(ctx context.Context, segment models.CreateSegmentRequest, meta models.ChangeMeta) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.Add")
+	defer span.End()
 
-	err = s.db.InsertSegment(ctx, segment.Slug)
+	err := s.db.InsertSegment(ctx, segment.Slug, meta)
 	if err != nil {
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return ErrSegmentAlreadyExists
+		}
 		return fmt.Errorf("unable to insert segment: %w", err)
 	}
 
@@ -67,6 +82,9 @@ func (s *SegmentifyDB) Add(ctx context.Context, segment models.CreateSegmentRequ
 
 // GetSegments returns all segments from the database
 func (s *SegmentifyDB) GetSegments(ctx context.Context) (models.Segments, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.GetSegments")
+	defer span.End()
+
 	segmentsDB, err := s.db.SelectSegments(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get segments: %w", err)
@@ -82,6 +100,9 @@ func (s *SegmentifyDB) GetSegments(ctx context.Context) (models.Segments, error)
 
 // GetSegmentBySlug returns a segment from the database by slug
 func (s *SegmentifyDB) GetSegmentBySlug(ctx context.Context, slug string) (models.Segment, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.GetSegmentBySlug")
+	defer span.End()
+
 	segmentDB, err := s.db.SelectSegmentBySlug(ctx, slug)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -95,21 +116,40 @@ func (s *SegmentifyDB) GetSegmentBySlug(ctx context.Context, slug string) (model
 	return segment, nil
 }
 
-// Delete deletes a segment from the database
-func (s *SegmentifyDB) Delete(ctx context.Context, slug string) error {
-	isDeleted, err := s.db.IsSegmentDeleted(ctx, slug)
+// Delete deletes a segment from the database, meta describes who deletes the segment and why
+// If ifMatch is not nil, the segment is deleted only if its ETag matches any of the tags,
+// the segment is locked while its ETag is checked, so it isn't changed before the deletion
+func (s *SegmentifyDB) Delete(ctx context.Context, slug string, meta models.ChangeMeta, ifMatch []string) error {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.Delete")
+	defer span.End()
+
+	err := s.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if ifMatch != nil {
+			segmentDB, err := s.db.SelectSegmentBySlugForUpdate(ctx, tx, slug)
+			if err != nil {
+				return err
+			}
+
+			etag, err := ETag(models.Segment(segmentDB))
+			if err != nil {
+				return err
+			}
+
+			err = checkIfMatch(etag, ifMatch)
+			if err != nil {
+				return err
+			}
+		}
+
+		return s.db.DeleteSegment(ctx, tx, slug, meta)
+	})
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return ErrSegmentNotFound
 		}
-		return fmt.Errorf("unable to check whether segment is active: %w", err)
-	}
-	if isDeleted {
-		return ErrSegmentNotFound
-	}
-
-	err = s.db.DeleteSegment(ctx, slug)
-	if err != nil {
+		if errors.Is(err, ErrPreconditionFailed) {
+			return err
+		}
 		return fmt.Errorf("unable to delete segment: %w", err)
 	}
 	return nil
@@ -7,49 +7,85 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	// history/userID/startDate/endDate
-	historyDirTemplate = "history/%v/%v/%v"
+	// userID/startDate/endDate in the history directory
+	historyDirTemplate = "%v/%v/%v"
 
 	historyFileName = "history.csv"
 
 	operationAdd    = "add"
 	operationRemove = "remove"
+
+	resultStatusOK       = "ok"
+	resultStatusRejected = "rejected"
+
+	resultCodeSegmentNotFound    = "segment_not_found"
+	resultCodeSegmentDeleted     = "segment_deleted"
+	resultCodeAlreadyMember      = "already_member"
+	resultCodeNotMember          = "not_member"
+	resultCodeDuplicated         = "duplicated_segment"
+	resultCodeConflictingActions = "conflicting_actions"
+	resultCodeUnknown            = "unknown"
 )
 
 // ChangeUserSegments changes user's segments
-func (s *SegmentifyDB) ChangeUserSegments(ctx context.Context, us models.UserSegmentsRequest) error {
-	// check if the add segments exists
-	for _, segment := range us.AddSegments {
-		got, err := s.GetSegmentBySlug(ctx, segment.Slug)
-		if err != nil {
-			return fmt.Errorf("unable to get segment \"%v\": %w", segment.Slug, err)
-		}
-		if got.IsDeleted {
-			return fmt.Errorf("can't add deleted segment \"%v\" to user: %w", segment.Slug, ErrSegmentDeleted)
-		}
+// Every add and remove item of the request is checked separately. By default, if any of them is incorrect,
+// nothing is changed and the error is returned. If us.Partial is set, the correct items are applied
+// and the incorrect ones are reported in the result.
+// If us.DryRun is set, all the checks are performed, but nothing is written to the database.
+// Returns the resulting user's segments and the changes applied (or that would be applied in case of dry run)
+// The checks and the changes are made in one transaction, so concurrent requests can't interfere with each other.
+// meta describes who changes the segments and why, it's stored in the user's history.
+// If ifMatch is not nil, the segments are changed only if the ETag of user's segments matches any of the tags
+func (s *SegmentifyDB) ChangeUserSegments(ctx context.Context, us models.UserSegmentsRequest, meta models.ChangeMeta, ifMatch []string) (change models.UserSegmentsChange, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.ChangeUserSegments")
+	defer span.End()
+
+	err = s.db.WithTx(ctx, func(tx *sql.Tx) error {
+		change, err = s.changeUserSegments(ctx, tx, us, meta, ifMatch)
+		return err
+	})
+	if err != nil {
+		return models.UserSegmentsChange{}, err
 	}
 
-	// check if the remove segments exists
-	for _, segment := range us.RemoveSegments {
-		_, err := s.GetSegmentBySlug(ctx, segment.Slug)
-		if err != nil {
-			return fmt.Errorf("unable to get segment \"%v\": %w", segment.Slug, err)
-		}
+	return change, nil
+}
+
+// changeUserSegments changes user's segments using transaction tx
+func (s *SegmentifyDB) changeUserSegments(ctx context.Context, tx *sql.Tx, us models.UserSegmentsRequest, meta models.ChangeMeta, ifMatch []string) (models.UserSegmentsChange, error) {
+	err := s.db.LockUser(ctx, tx, us.ID)
+	if err != nil {
+		return models.UserSegmentsChange{}, fmt.Errorf("unable to lock user: %w", err)
+	}
+
+	etag, err := s.currentUserETag(ctx, tx, us.ID)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	err = checkIfMatch(etag, ifMatch)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
 	}
 
 	// get user's segments
-	userSegments, err := s.db.GetUsersSegments(ctx, us.ID)
+	userSegments, err := s.db.SelectActiveUserSegments(ctx, tx, us.ID)
 	if err != nil {
-		return fmt.Errorf("unable to get user's segments: %w", err)
+		return models.UserSegmentsChange{}, fmt.Errorf("unable to get user's segments: %w", err)
 	}
 
 	// create map of user's segments
@@ -60,22 +96,211 @@ func (s *SegmentifyDB) ChangeUserSegments(ctx context.Context, us models.UserSeg
 		userSegmentsMap[segment.Slug] = struct{}{}
 	}
 
-	var errorMessage strings.Builder
-	var isError bool
+	addErrs, removeErrs, err := s.checkUserSegmentsRequest(ctx, tx, us, userSegmentsMap)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	if !us.Partial {
+		err = strictUserSegmentsError(append(addErrs, removeErrs...))
+		if err != nil {
+			return models.UserSegmentsChange{}, err
+		}
+	}
+
+	change := models.UserSegmentsChange{
+		ID:         us.ID,
+		ChangeMeta: meta,
+		DryRun:     us.DryRun,
+		ETag:       etag,
+		Added:      []models.SegmentAdd{},
+		Removed:    []models.SegmentDelete{},
+		Updated:    []models.SegmentAdd{},
+		Results:    make([]models.UserSegmentResult, 0, len(us.AddSegments)+len(us.RemoveSegments)),
+	}
+
+	for i, segment := range us.AddSegments {
+		if addErrs[i] == nil {
+			change.Added = append(change.Added, segment)
+		}
+		change.Results = append(change.Results, userSegmentResult(segment.Slug, operationAdd, addErrs[i]))
+	}
+
+	for i, segment := range us.RemoveSegments {
+		if removeErrs[i] == nil {
+			change.Removed = append(change.Removed, segment)
+		}
+		change.Results = append(change.Results, userSegmentResult(segment.Slug, operationRemove, removeErrs[i]))
+	}
+
+	if us.DryRun {
+		// predict the user's segments after the change
+		removeMap := make(map[string]struct{}, len(change.Removed))
+		for _, segment := range change.Removed {
+			removeMap[segment.Slug] = struct{}{}
+		}
+
+		change.ActiveSegments = make(models.ActiveSegments, 0, len(userSegments)+len(change.Added))
+		for _, segment := range userSegments {
+			if _, ok := removeMap[segment.Slug]; !ok {
+				change.ActiveSegments = append(change.ActiveSegments, models.ActiveSegment{Slug: segment.Slug})
+			}
+		}
+		for _, segment := range change.Added {
+			change.ActiveSegments = append(change.ActiveSegments, models.ActiveSegment{Slug: segment.Slug})
+		}
+
+		return change, nil
+	}
+
+	userSegmentsDB := models.UserSegmentsDB{
+		ID:             us.ID,
+		AddSegments:    make([]models.SegmentAddDB, len(change.Added)),
+		RemoveSegments: make([]models.SegmentDeleteDB, len(change.Removed)),
+		Meta:           meta,
+	}
+
+	for i, segment := range change.Added {
+		userSegmentsDB.AddSegments[i] = toSegmentAddDB(segment)
+	}
+
+	for i, segment := range change.Removed {
+		userSegmentsDB.RemoveSegments[i] = models.SegmentDeleteDB(segment)
+	}
+
+	// add the segments to the user
+	err = s.db.ChangeUsersSegments(ctx, tx, userSegmentsDB)
+	if err != nil {
+		return models.UserSegmentsChange{}, fmt.Errorf("unable to change user segments: %w", err)
+	}
+
+	if len(change.Added)+len(change.Removed) != 0 {
+		err = s.db.IncrementUserVersion(ctx, tx, us.ID)
+		if err != nil {
+			return models.UserSegmentsChange{}, fmt.Errorf("unable to increment user version: %w", err)
+		}
+
+		change.ETag, err = s.currentUserETag(ctx, tx, us.ID)
+		if err != nil {
+			return models.UserSegmentsChange{}, err
+		}
+	}
+
+	change.ActiveSegments, err = s.activeSegments(ctx, tx, us.ID)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	return change, nil
+}
+
+// checkUserSegmentsRequest checks every add and remove item of the request against the user's segments using transaction tx
+// Returns the reason why the item can't be applied, or nil if it can, for every add and remove item.
+// The returned error is not nil only if the check itself failed
+func (s *SegmentifyDB) checkUserSegmentsRequest(ctx context.Context, tx *sql.Tx, us models.UserSegmentsRequest, userSegmentsMap map[string]struct{}) (addErrs, removeErrs []error, err error) {
+	addErrs = make([]error, len(us.AddSegments))
+	removeErrs = make([]error, len(us.RemoveSegments))
 
-	// check that user don't already have the segments we want to add
+	addMap := make(map[string]struct{}, len(us.AddSegments))
 	for _, segment := range us.AddSegments {
+		addMap[segment.Slug] = struct{}{}
+	}
+
+	removeMap := make(map[string]struct{}, len(us.RemoveSegments))
+	for _, segment := range us.RemoveSegments {
+		removeMap[segment.Slug] = struct{}{}
+	}
+
+	slugs := make([]string, 0, len(us.AddSegments)+len(us.RemoveSegments))
+	for _, segment := range us.AddSegments {
+		slugs = append(slugs, segment.Slug)
+	}
+	for _, segment := range us.RemoveSegments {
+		slugs = append(slugs, segment.Slug)
+	}
+
+	segments, err := s.getSegmentsForShare(ctx, tx, slugs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[string]struct{}, len(us.AddSegments))
+	for i, segment := range us.AddSegments {
+		if _, ok := removeMap[segment.Slug]; ok {
+			addErrs[i] = fmt.Errorf("%w \"%v\"", ErrConflictingSegmentActions, segment.Slug)
+			continue
+		}
+		if _, ok := seen[segment.Slug]; ok {
+			addErrs[i] = fmt.Errorf("%w \"%v\"", ErrDuplicatedSegment, segment.Slug)
+			continue
+		}
+		seen[segment.Slug] = struct{}{}
+
+		got, ok := segments[segment.Slug]
+		if !ok {
+			addErrs[i] = fmt.Errorf("unable to get segment \"%v\": %w", segment.Slug, ErrSegmentNotFound)
+			continue
+		}
+
+		if got.IsDeleted {
+			addErrs[i] = fmt.Errorf("can't add deleted segment \"%v\" to user: %w", segment.Slug, ErrSegmentDeleted)
+			continue
+		}
+
+		// check that user don't already have the segment we want to add
 		if _, ok := userSegmentsMap[segment.Slug]; ok {
-			isError = true
-			errorMessage.WriteString(fmt.Sprintf("user already have segment \"%v\"\n", segment.Slug))
+			addErrs[i] = fmt.Errorf("%w \"%v\"", ErrUserAlreadyHasSegment, segment.Slug)
 		}
 	}
 
-	// check that user have the segments we want to remove
-	for _, segment := range us.RemoveSegments {
+	seen = make(map[string]struct{}, len(us.RemoveSegments))
+	for i, segment := range us.RemoveSegments {
+		if _, ok := addMap[segment.Slug]; ok {
+			removeErrs[i] = fmt.Errorf("%w \"%v\"", ErrConflictingSegmentActions, segment.Slug)
+			continue
+		}
+		if _, ok := seen[segment.Slug]; ok {
+			removeErrs[i] = fmt.Errorf("%w \"%v\"", ErrDuplicatedSegment, segment.Slug)
+			continue
+		}
+		seen[segment.Slug] = struct{}{}
+
+		if _, ok := segments[segment.Slug]; !ok {
+			removeErrs[i] = fmt.Errorf("unable to get segment \"%v\": %w", segment.Slug, ErrSegmentNotFound)
+			continue
+		}
+
+		// check that user have the segment we want to remove
 		if _, ok := userSegmentsMap[segment.Slug]; !ok {
+			removeErrs[i] = fmt.Errorf("%w \"%v\"", ErrUserDoesNotHaveSegment, segment.Slug)
+		}
+	}
+
+	return addErrs, removeErrs, nil
+}
+
+// strictUserSegmentsError returns the error of the whole request if any of its items is incorrect
+// Unknown and deleted segments take precedence over the other errors
+func strictUserSegmentsError(errs []error) error {
+	for _, err := range errs {
+		if errors.Is(err, ErrSegmentNotFound) {
+			return err
+		}
+	}
+
+	for _, err := range errs {
+		if errors.Is(err, ErrSegmentDeleted) {
+			return err
+		}
+	}
+
+	var errorMessage strings.Builder
+	var isError bool
+
+	for _, err := range errs {
+		if err != nil {
 			isError = true
-			errorMessage.WriteString(fmt.Sprintf("user don't have segment \"%v\"\n", segment.Slug))
+			errorMessage.WriteString(err.Error() + "\n")
 		}
 	}
 
@@ -83,52 +308,246 @@ func (s *SegmentifyDB) ChangeUserSegments(ctx context.Context, us models.UserSeg
 		return fmt.Errorf("%w: %v", ErrIncorrectChangeUserSegmentsRequest, errorMessage.String())
 	}
 
-	userSegmentsDB := models.UserSegmentsDB{
-		ID:             us.ID,
-		AddSegments:    make([]models.SegmentAddDB, len(us.AddSegments)),
-		RemoveSegments: make([]models.SegmentDeleteDB, len(us.RemoveSegments)),
+	return nil
+}
+
+// userSegmentResult creates the result of the item of the request to change user's segments
+func userSegmentResult(slug, action string, err error) models.UserSegmentResult {
+	if err == nil {
+		return models.UserSegmentResult{
+			Slug:   slug,
+			Action: action,
+			Status: resultStatusOK,
+		}
 	}
 
-	for i, segment := range us.AddSegments {
-		userSegmentsDB.AddSegments[i] = models.SegmentAddDB{
-			Slug: segment.Slug,
-			Expired: sql.NullString{
-				String: segment.Expired,
-				Valid:  true,
-			},
+	return models.UserSegmentResult{
+		Slug:   slug,
+		Action: action,
+		Status: resultStatusRejected,
+		Code:   resultCode(err),
+		Error:  err.Error(),
+	}
+}
+
+// resultCode returns the machine-readable code of the item error
+func resultCode(err error) string {
+	switch {
+	case errors.Is(err, ErrSegmentNotFound):
+		return resultCodeSegmentNotFound
+	case errors.Is(err, ErrSegmentDeleted):
+		return resultCodeSegmentDeleted
+	case errors.Is(err, ErrUserAlreadyHasSegment):
+		return resultCodeAlreadyMember
+	case errors.Is(err, ErrUserDoesNotHaveSegment):
+		return resultCodeNotMember
+	case errors.Is(err, ErrDuplicatedSegment):
+		return resultCodeDuplicated
+	case errors.Is(err, ErrConflictingSegmentActions):
+		return resultCodeConflictingActions
+	default:
+		return resultCodeUnknown
+	}
+}
+
+// SetUserSegments replaces user's segments with the given ones
+// If dryRun is set, the changes are computed, but not written to the database.
+// Returns the resulting user's segments and the changes applied (or that would be applied in case of dry run).
+// meta describes who changes the segments and why, it's stored in the user's history.
+// If ifMatch is not nil, the segments are replaced only if the ETag of user's segments matches any of the tags
+func (s *SegmentifyDB) SetUserSegments(ctx context.Context, userID int, segments []models.SegmentAdd, dryRun bool, meta models.ChangeMeta, ifMatch []string) (change models.UserSegmentsChange, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.SetUserSegments")
+	defer span.End()
+
+	err = s.db.WithTx(ctx, func(tx *sql.Tx) error {
+		change, err = s.setUserSegments(ctx, tx, userID, segments, dryRun, meta, ifMatch)
+		return err
+	})
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	return change, nil
+}
+
+// setUserSegments replaces user's segments with the given ones using transaction tx
+func (s *SegmentifyDB) setUserSegments(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAdd, dryRun bool, meta models.ChangeMeta, ifMatch []string) (models.UserSegmentsChange, error) {
+	var errorMessage strings.Builder
+	var isError bool
+
+	// check that the segments are not duplicated
+	segmentsMap := make(map[string]struct{}, len(segments))
+	for _, segment := range segments {
+		if _, ok := segmentsMap[segment.Slug]; ok {
+			isError = true
+			errorMessage.WriteString(fmt.Sprintf("segment \"%v\" is duplicated\n", segment.Slug))
 		}
+		segmentsMap[segment.Slug] = struct{}{}
+	}
 
-		if segment.Expired == "" {
-			userSegmentsDB.AddSegments[i].Expired.Valid = false
+	if isError {
+		return models.UserSegmentsChange{}, fmt.Errorf("%w: %v", ErrIncorrectChangeUserSegmentsRequest, errorMessage.String())
+	}
+
+	err := s.db.LockUser(ctx, tx, userID)
+	if err != nil {
+		return models.UserSegmentsChange{}, fmt.Errorf("unable to lock user: %w", err)
+	}
+
+	etag, err := s.currentUserETag(ctx, tx, userID)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	err = checkIfMatch(etag, ifMatch)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	slugs := make([]string, len(segments))
+	for i, segment := range segments {
+		slugs[i] = segment.Slug
+	}
+
+	found, err := s.getSegmentsForShare(ctx, tx, slugs)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	// check if the segments exists
+	for _, segment := range segments {
+		got, ok := found[segment.Slug]
+		if !ok {
+			return models.UserSegmentsChange{}, fmt.Errorf("unable to get segment \"%v\": %w", segment.Slug, ErrSegmentNotFound)
+		}
+		if got.IsDeleted {
+			return models.UserSegmentsChange{}, fmt.Errorf("can't add deleted segment \"%v\" to user: %w", segment.Slug, ErrSegmentDeleted)
 		}
 	}
 
-	for i, segment := range us.RemoveSegments {
-		userSegmentsDB.RemoveSegments[i] = models.SegmentDeleteDB(segment)
+	segmentsDB := make([]models.SegmentAddDB, len(segments))
+	for i, segment := range segments {
+		segmentsDB[i] = toSegmentAddDB(segment)
 	}
 
-	// add the segments to the user
-	err = s.db.ChangeUsersSegments(ctx, userSegmentsDB)
+	diffDB, err := s.db.SetUsersSegments(ctx, tx, userID, segmentsDB, dryRun, meta)
 	if err != nil {
-		return fmt.Errorf("unable to change user segments: %w", err)
+		return models.UserSegmentsChange{}, fmt.Errorf("unable to set user segments: %w", err)
 	}
 
-	return nil
+	change := models.UserSegmentsChange{
+		ID:         userID,
+		ChangeMeta: meta,
+		DryRun:     dryRun,
+		ETag:       etag,
+		Added:      make([]models.SegmentAdd, len(diffDB.AddSegments)),
+		Removed:    make([]models.SegmentDelete, len(diffDB.RemoveSegments)),
+		Updated:    make([]models.SegmentAdd, len(diffDB.UpdateSegments)),
+	}
+
+	for i, segment := range diffDB.AddSegments {
+		change.Added[i] = fromSegmentAddDB(segment)
+	}
+
+	for i, segment := range diffDB.RemoveSegments {
+		change.Removed[i] = models.SegmentDelete(segment)
+	}
+
+	for i, segment := range diffDB.UpdateSegments {
+		change.Updated[i] = fromSegmentAddDB(segment)
+	}
+
+	if dryRun {
+		// the user will have exactly the requested segments
+		change.ActiveSegments = make(models.ActiveSegments, len(segments))
+		for i, segment := range segments {
+			change.ActiveSegments[i] = models.ActiveSegment{Slug: segment.Slug}
+		}
+
+		return change, nil
+	}
+
+	change.ETag, err = s.currentUserETag(ctx, tx, userID)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	change.ActiveSegments, err = s.activeSegments(ctx, tx, userID)
+	if err != nil {
+		return models.UserSegmentsChange{}, err
+	}
+
+	return change, nil
 }
 
-// GetUsersSegments returns user's segments
-func (s *SegmentifyDB) GetUsersSegments(ctx context.Context, userID int) (models.ActiveSegments, error) {
-	segmentsDB, err := s.db.GetUsersSegments(ctx, userID)
+// getSegmentsForShare returns the segments with given slugs by slug using transaction tx
+// The segments can't be deleted until the end of the transaction. Unknown slugs are absent from the result
+func (s *SegmentifyDB) getSegmentsForShare(ctx context.Context, tx *sql.Tx, slugs []string) (map[string]models.SegmentDB, error) {
+	segmentsDB, err := s.db.SelectSegmentsBySlugsForShare(ctx, tx, slugs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get segments by slugs: %w", err)
+	}
+
+	segments := make(map[string]models.SegmentDB, len(segmentsDB))
+	for _, segment := range segmentsDB {
+		segments[segment.Slug] = segment
+	}
+
+	return segments, nil
+}
+
+// activeSegments returns user's segments using transaction tx
+func (s *SegmentifyDB) activeSegments(ctx context.Context, tx *sql.Tx, userID int) (models.ActiveSegments, error) {
+	segmentsDB, err := s.db.SelectActiveUserSegments(ctx, tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve user's segments: %w", err)
+	}
+
+	segments := make(models.ActiveSegments, len(segmentsDB))
+	for i, segmentDB := range segmentsDB {
+		segments[i] = models.ActiveSegment{
+			Slug: segmentDB.Slug,
+		}
+	}
+
+	return segments, nil
+}
+
+// toSegmentAddDB converts the API segment into the database one
+func toSegmentAddDB(segment models.SegmentAdd) models.SegmentAddDB {
+	return models.SegmentAddDB{
+		Slug: segment.Slug,
+		Expired: sql.NullString{
+			String: segment.Expired,
+			Valid:  segment.Expired != "",
+		},
+	}
+}
+
+// fromSegmentAddDB converts the database segment into the API one
+func fromSegmentAddDB(segment models.SegmentAddDB) models.SegmentAdd {
+	return models.SegmentAdd{
+		Slug:    segment.Slug,
+		Expired: segment.Expired.String,
+	}
+}
+
+// GetUsersSegments returns user's segments and their ETag
+func (s *SegmentifyDB) GetUsersSegments(ctx context.Context, userID int) (models.ActiveSegments, string, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.GetUsersSegments")
+	defer span.End()
+
+	segmentsDB, version, err := s.db.GetUsersSegments(ctx, userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return models.ActiveSegments{}, ErrNoUserData
+			return models.ActiveSegments{}, "", ErrNoUserData
 		}
-		return models.ActiveSegments{}, fmt.Errorf("unable to get user's segments: %w", err)
+		return models.ActiveSegments{}, "", fmt.Errorf("unable to get user's segments: %w", err)
 	}
 
 	// in some cases GetUsersSegments returns empty slice instead of sql.ErrNoRows
 	if len(segmentsDB) == 0 {
-		return models.ActiveSegments{}, ErrNoUserData
+		return models.ActiveSegments{}, "", ErrNoUserData
 	}
 
 	segments := make(models.ActiveSegments, len(segmentsDB))
@@ -138,11 +557,28 @@ func (s *SegmentifyDB) GetUsersSegments(ctx context.Context, userID int) (models
 		}
 	}
 
-	return segments, nil
+	return segments, userETag(userID, version), nil
+}
+
+// currentUserETag returns the ETag of user's segments using transaction tx
+func (s *SegmentifyDB) currentUserETag(ctx context.Context, tx *sql.Tx, userID int) (string, error) {
+	version, err := s.db.SelectUserVersion(ctx, tx, userID)
+	if err != nil {
+		return "", fmt.Errorf("unable to get user version: %w", err)
+	}
+
+	return userETag(userID, version), nil
 }
 
-// GetUserHistory returns user's segments history
+// GetUserHistory writes user's segments history to csv file and returns its path relative to the history directory
 func (s *SegmentifyDB) GetUserHistory(ctx context.Context, userID int, from, to time.Time) (filename string, err error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.GetUserHistory", trace.WithAttributes(
+		attribute.Int("user.id", userID),
+		attribute.String("history.from", from.Format(time.RFC3339)),
+		attribute.String("history.to", to.Format(time.RFC3339)),
+	))
+	defer span.End()
+
 	history, err := s.db.GetUsersHistory(ctx, userID, from, to)
 
 	switch {
@@ -156,12 +592,16 @@ func (s *SegmentifyDB) GetUserHistory(ctx context.Context, userID int, from, to
 		return filename, fmt.Errorf("unable to get user's segments history: %w", err)
 	}
 
-	preparedHistory := s.prepareHistoryEntries(history, from, to)
+	preparedHistory := s.prepareHistoryEntries(ctx, history, from, to)
 
-	return s.writeCSV(preparedHistory, from, to)
+	return s.writeCSV(ctx, preparedHistory, from, to)
 }
 
-func (s *SegmentifyDB) prepareHistoryEntries(db models.UserSegmentsHistoryDB, from, to time.Time) models.UserHistory {
+func (s *SegmentifyDB) prepareHistoryEntries(ctx context.Context, db models.UserSegmentsHistoryDB, from, to time.Time) models.UserHistory {
+	_, span := tracing.Start(ctx, "SegmentifyDB.prepareHistoryEntries",
+		trace.WithAttributes(attribute.Int("history.rows", len(db))))
+	defer span.End()
+
 	// len(db) is a minimum capacity of history, because every entry could be added and removed in the same period of time
 	history := make(models.UserHistory, 0, len(db))
 
@@ -172,6 +612,8 @@ func (s *SegmentifyDB) prepareHistoryEntries(db models.UserSegmentsHistoryDB, fr
 				Slug:      entry.Slug,
 				Operation: operationAdd,
 				Date:      entry.DateAdded,
+				Actor:     entry.AddedBy,
+				Reason:    entry.AddedReason,
 			})
 		}
 		if entry.DateRemoved.Valid && entry.DateRemoved.Time.After(from) && entry.DateRemoved.Time.Before(to) {
@@ -180,19 +622,26 @@ func (s *SegmentifyDB) prepareHistoryEntries(db models.UserSegmentsHistoryDB, fr
 				Slug:      entry.Slug,
 				Operation: operationRemove,
 				Date:      entry.DateRemoved.Time,
+				Actor:     entry.RemovedBy,
+				Reason:    entry.RemovedReason,
 			})
 		}
 	}
 
 	// sort history by date ascending
 	sort.Sort(history)
+	span.SetAttributes(attribute.Int("history.entries", len(history)))
 
 	return history
 }
 
 // writeCSV writes user's segments history to csv file
-// and returns the path to the file and the error if any
-func (s *SegmentifyDB) writeCSV(history models.UserHistory, from, to time.Time) (path string, err error) {
+// and returns the path to the file relative to the history directory and the error if any
+func (s *SegmentifyDB) writeCSV(ctx context.Context, history models.UserHistory, from, to time.Time) (path string, err error) {
+	_, span := tracing.Start(ctx, "SegmentifyDB.writeCSV",
+		trace.WithAttributes(attribute.Int("history.entries", len(history))))
+	defer func() { tracing.End(span, err) }()
+
 	// history[0] exists because we checked that len(history) > 0
 	userID := history[0].ID
 
@@ -204,28 +653,56 @@ func (s *SegmentifyDB) writeCSV(history models.UserHistory, from, to time.Time)
 			segment.Slug,
 			segment.Operation,
 			segment.Date.Format(time.RFC3339),
+			segment.Actor,
+			segment.Reason,
 		}
 	}
 
 	dir := fmt.Sprintf(historyDirTemplate,
 		userID, from.Format("2006-01-02"), to.Format("2006-01-02"))
 
-	err = os.MkdirAll(dir, os.ModePerm)
+	err = os.MkdirAll(filepath.Join(s.historyDir, dir), os.ModePerm)
 	if err != nil {
 		return path, fmt.Errorf("unable to create directory: %w", err)
 	}
 
-	// create csv file in directory "history/userID/startDate/endDate/history.csv"
-	file, err := os.Create(dir + "/" + historyFileName)
+	// create csv file in directory "userID/startDate/endDate/history.csv" of the history directory
+	path = dir + "/" + historyFileName
+	file, err := os.Create(filepath.Join(s.historyDir, path))
 	if err != nil {
-		return path, fmt.Errorf("unable to create csv file: %w", err)
+		return "", fmt.Errorf("unable to create csv file: %w", err)
 	}
+	defer func() {
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("unable to close csv file: %w", closeErr)
+		}
+	}()
 
 	// write csv file
 	err = csv.NewWriter(file).WriteAll(records)
 	if err != nil {
-		return path, fmt.Errorf("unable to write to csv file: %w", err)
+		return "", fmt.Errorf("unable to write to csv file: %w", err)
 	}
 
-	return file.Name(), nil
+	return path, nil
+}
+
+// ReapExpiredSegments removes the users' segments which expired in batches of batchSize
+// The removals are recorded in user history on the expiration date. Returns the number of removed segments
+func (s *SegmentifyDB) ReapExpiredSegments(ctx context.Context, batchSize int) (int64, error) {
+	ctx, span := tracing.Start(ctx, "SegmentifyDB.ReapExpiredSegments")
+	defer span.End()
+
+	var total int64
+	for {
+		deleted, err := s.db.DeleteExpiredUserSegments(ctx, batchSize, models.ExpirationMeta)
+		total += deleted
+		if err != nil {
+			return total, fmt.Errorf("unable to delete expired users' segments: %w", err)
+		}
+		if deleted < int64(batchSize) {
+			return total, nil
+		}
+	}
 }
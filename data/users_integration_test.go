@@ -0,0 +1,294 @@
+package data_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/db"
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/charmbracelet/log"
+)
+
+// concurrency is the number of concurrent requests in every test
+const concurrency = 10
+
+var testMeta = models.ChangeMeta{Actor: "integration-test", Reason: "concurrency test"}
+
+// newTestStorage returns the storage connected to the database from DB_CONNECTION_STRING with the schema applied,
+// the test is skipped if the variable isn't set
+func newTestStorage(t *testing.T) *data.SegmentifyDB {
+	t.Helper()
+
+	connectionString := os.Getenv("DB_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("DB_CONNECTION_STRING isn't set, skipping integration test")
+	}
+
+	l := log.New(io.Discard)
+	ctx := context.Background()
+	conn, err := db.Connect(ctx, l, connectionString, db.ConnectOptions{Timeout: 10 * time.Second, MaxOpenConns: 2 * concurrency})
+	if err != nil {
+		t.Fatalf("unable to connect to database: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	p := db.New(l, conn, 30*time.Second)
+	_, err = p.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("unable to migrate database, db/init.sql must be applied: %v", err)
+	}
+	err = p.CheckSchema(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data.New(l, p, t.TempDir())
+}
+
+// newSlug returns a slug which doesn't exist in the database yet
+func newSlug(name string) string {
+	return fmt.Sprintf("IT_%v_%d", name, rand.Int63())
+}
+
+// newUserID returns an id of a user without segments
+func newUserID() int {
+	return 1_000_000_000 + rand.Intn(1_000_000_000)
+}
+
+// runConcurrently calls f from n goroutines at once and returns their errors
+func runConcurrently(n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = f(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	return errs
+}
+
+// countErrors returns the number of nil errors and fails the test if any error isn't one of allowed
+func countErrors(t *testing.T, errs []error, allowed ...error) (succeeded int) {
+	t.Helper()
+
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+
+		known := false
+		for _, target := range allowed {
+			if errors.Is(err, target) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			t.Errorf("unexpected error, it would be 500: %v", err)
+		}
+	}
+
+	return succeeded
+}
+
+func TestConcurrentSegmentCreation(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	slug := newSlug("CREATE")
+
+	errs := runConcurrently(concurrency, func(int) error {
+		return s.Add(ctx, models.CreateSegmentRequest{Slug: slug}, testMeta)
+	})
+
+	// one request creates the segment, the others get 409
+	succeeded := countErrors(t, errs, data.ErrSegmentAlreadyExists)
+	if succeeded != 1 {
+		t.Errorf("segment created %v times, want 1", succeeded)
+	}
+}
+
+func TestConcurrentAddOfSameSegmentToUser(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	slug := newSlug("ADD")
+	userID := newUserID()
+
+	err := s.Add(ctx, models.CreateSegmentRequest{Slug: slug}, testMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := runConcurrently(concurrency, func(int) error {
+		_, err := s.ChangeUserSegments(ctx, models.UserSegmentsRequest{
+			ID:          userID,
+			AddSegments: []models.SegmentAdd{{Slug: slug}},
+		}, testMeta, nil)
+		return err
+	})
+
+	// one request adds the segment, the others see that the user already has it and get 400
+	succeeded := countErrors(t, errs, data.ErrIncorrectChangeUserSegmentsRequest)
+	if succeeded != 1 {
+		t.Errorf("segment added %v times, want 1", succeeded)
+	}
+
+	segments, _, err := s.GetUsersSegments(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].Slug != slug {
+		t.Errorf("user segments = %v, want only %v", segments, slug)
+	}
+}
+
+func TestConcurrentAddToUserAndSegmentDeletion(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+
+	for i := 0; i < concurrency; i++ {
+		slug := newSlug("DELETE")
+		userID := newUserID()
+
+		err := s.Add(ctx, models.CreateSegmentRequest{Slug: slug}, testMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var addErr error
+		errs := runConcurrently(2, func(i int) error {
+			if i == 0 {
+				_, addErr = s.ChangeUserSegments(ctx, models.UserSegmentsRequest{
+					ID:          userID,
+					AddSegments: []models.SegmentAdd{{Slug: slug}},
+				}, testMeta, nil)
+				return addErr
+			}
+			return s.Delete(ctx, slug, testMeta, nil)
+		})
+
+		// the deletion always succeeds, the addition either happens before it or gets 400
+		countErrors(t, errs, data.ErrSegmentDeleted)
+		if errs[1] != nil {
+			t.Errorf("deletion failed: %v", errs[1])
+		}
+
+		// the deleted segment is never active for the user
+		segments, _, err := s.GetUsersSegments(ctx, userID)
+		if err != nil && !errors.Is(err, data.ErrNoUserData) {
+			t.Fatal(err)
+		}
+		if len(segments) != 0 {
+			t.Errorf("user has deleted segment %v, add error: %v", slug, addErr)
+		}
+	}
+}
+
+func TestConcurrentSegmentDeletionWithIfMatch(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	slug := newSlug("DELETE_IF_MATCH")
+
+	err := s.Add(ctx, models.CreateSegmentRequest{Slug: slug}, testMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, err := s.GetSegmentBySlug(ctx, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag, err := data.ETag(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the segment is locked while its ETag is checked, the requests after the deletion see the deleted segment and get 412
+	errs := runConcurrently(concurrency, func(int) error {
+		return s.Delete(ctx, slug, testMeta, []string{etag})
+	})
+	succeeded := countErrors(t, errs, data.ErrPreconditionFailed)
+	if succeeded != 1 {
+		t.Errorf("segment deleted %v times, want 1", succeeded)
+	}
+}
+
+func TestConcurrentSetUserSegmentsWithIfMatch(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	userID := newUserID()
+
+	slugs := make([]string, concurrency)
+	for i := range slugs {
+		slugs[i] = newSlug("SET")
+		err := s.Add(ctx, models.CreateSegmentRequest{Slug: slugs[i]}, testMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	change, err := s.SetUserSegments(ctx, userID, []models.SegmentAdd{{Slug: slugs[0]}}, false, testMeta, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every request replaces the segments it has seen, only the first one wins, the others get 412
+	errs := runConcurrently(concurrency, func(i int) error {
+		_, err := s.SetUserSegments(ctx, userID, []models.SegmentAdd{{Slug: slugs[i]}}, false, testMeta, []string{change.ETag})
+		return err
+	})
+	succeeded := countErrors(t, errs, data.ErrPreconditionFailed)
+	if succeeded != 1 {
+		t.Errorf("segments replaced %v times, want 1", succeeded)
+	}
+}
+
+func TestConcurrentSetUserSegments(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	userID := newUserID()
+
+	slugs := make([]string, concurrency)
+	for i := range slugs {
+		slugs[i] = newSlug("PUT")
+		err := s.Add(ctx, models.CreateSegmentRequest{Slug: slugs[i]}, testMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the requests without If-Match are serialized, every one of them succeeds
+	errs := runConcurrently(concurrency, func(i int) error {
+		_, err := s.SetUserSegments(ctx, userID, []models.SegmentAdd{{Slug: slugs[i]}}, false, testMeta, nil)
+		return err
+	})
+	succeeded := countErrors(t, errs)
+	if succeeded != concurrency {
+		t.Errorf("%v requests succeeded, want %v", succeeded, concurrency)
+	}
+
+	// the user has the segment of the last request only
+	segments, _, err := s.GetUsersSegments(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("user segments = %v, want exactly one", segments)
+	}
+}
@@ -3,6 +3,9 @@ package data
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -15,12 +18,56 @@ type ValidationError struct {
 
 // Error returns the validation error message
 func (v ValidationError) Error() string {
-	return fmt.Sprintf(
-		"Key: '%s' Error: Field validation for '%s' failed on the '%s' tag",
-		v.Namespace(),
-		v.Field(),
-		v.Tag(),
-	)
+	return v.Message()
+}
+
+// Path returns the path to the field in the JSON request, e.g. add[0].slug
+func (v ValidationError) Path() string {
+	// the namespace starts with the name of the validated struct
+	_, path, found := strings.Cut(v.Namespace(), ".")
+	if !found {
+		return v.Namespace()
+	}
+
+	return path
+}
+
+// Message returns human-readable validation error message
+func (v ValidationError) Message() string {
+	field := v.Path()
+	isString := v.Kind() == reflect.String
+	isList := v.Kind() == reflect.Slice || v.Kind() == reflect.Array || v.Kind() == reflect.Map
+
+	switch v.Tag() {
+	case "required":
+		return fmt.Sprintf("%v is required", field)
+	case "min":
+		if isString {
+			return fmt.Sprintf("%v must be at least %v characters long", field, v.Param())
+		}
+		if isList {
+			return fmt.Sprintf("%v must contain at least %v items", field, v.Param())
+		}
+		return fmt.Sprintf("%v must be at least %v", field, v.Param())
+	case "max":
+		if isString {
+			return fmt.Sprintf("%v must be at most %v characters long", field, v.Param())
+		}
+		if isList {
+			return fmt.Sprintf("%v must contain at most %v items", field, v.Param())
+		}
+		return fmt.Sprintf("%v must be at most %v", field, v.Param())
+	case "gt":
+		return fmt.Sprintf("%v must be greater than %v", field, v.Param())
+	case "oneof":
+		return fmt.Sprintf("%v must be one of: %v", field, strings.ReplaceAll(v.Param(), " ", ", "))
+	case "datetime":
+		return fmt.Sprintf("%v must be a date and time in format %v", field, v.Param())
+	case "slug":
+		return fmt.Sprintf("%v must contain only latin letters, digits and underscores", field)
+	default:
+		return fmt.Sprintf("%v is incorrect, it failed on the '%v' rule", field, v.Tag())
+	}
 }
 
 // ValidationErrors is a collection of ValidationError
@@ -36,6 +83,9 @@ func (v ValidationErrors) Errors() []string {
 	return errs
 }
 
+// slugRegexp matches the segment slugs, it must be the same as in the routes
+var slugRegexp = regexp.MustCompile(`^[a-zA-Z_0-9]+$`)
+
 // Validation wraps the go-playground/validator
 type Validation struct {
 	validate *validator.Validate
@@ -45,6 +95,26 @@ type Validation struct {
 func NewValidation() *Validation {
 	validate := validator.New()
 
+	// report the fields by their names in JSON
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	// segment slugs are used in the URLs, so they can contain only the characters allowed by the routes
+	err := validate.RegisterValidation("slug", func(fl validator.FieldLevel) bool {
+		return slugRegexp.MatchString(fl.Field().String())
+	})
+	if err != nil {
+		panic(fmt.Sprintf("unable to register slug validation: %v", err))
+	}
+
 	return &Validation{validate}
 }
 
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/peyuaa/segmentify/models"
+)
+
+// InsertAPIKey inserts API key with given name, hash and role into the database
+// Returns ErrAlreadyExists if the API key with given hash already exists
+func (p *PostgresWrapper) InsertAPIKey(ctx context.Context, name, keyHash, role string) (_ models.APIKeyDB, err error) {
+	ctx, end := p.instrument(ctx, "InsertAPIKey")
+	defer end(&err)
+	key := models.APIKeyDB{
+		Name:    name,
+		KeyHash: keyHash,
+		Role:    role,
+	}
+
+	err = p.db.QueryRowContext(ctx,
+		"INSERT INTO api_keys (name, key_hash, role) VALUES ($1, $2, $3) ON CONFLICT (key_hash) DO NOTHING RETURNING id, created_at",
+		name, keyHash, role).
+		Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.APIKeyDB{}, ErrAlreadyExists
+		}
+		return models.APIKeyDB{}, fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return key, nil
+}
+
+// ReplaceAPIKey makes the API key with given hash the only active key with given name in one transaction
+// The other active keys with the name are revoked and the key is inserted if it doesn't exist yet,
+// the revoked key with given hash stays revoked. Returns the number of revoked keys
+func (p *PostgresWrapper) ReplaceAPIKey(ctx context.Context, name, keyHash, role string) (revoked int64, err error) {
+	ctx, end := p.instrument(ctx, "ReplaceAPIKey")
+	defer end(&err)
+	err = p.WithTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE api_keys SET revoked_at = NOW() WHERE name = $1 AND key_hash <> $2 AND revoked_at IS NULL",
+			name, keyHash)
+		if err != nil {
+			return fmt.Errorf("unable to execute query: %w", err)
+		}
+
+		revoked, err = res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("unable to get affected rows: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO api_keys (name, key_hash, role) VALUES ($1, $2, $3) ON CONFLICT (key_hash) DO NOTHING",
+			name, keyHash, role)
+		if err != nil {
+			return fmt.Errorf("unable to execute query: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revoked, nil
+}
+
+// SelectActiveAPIKeyByHash returns not revoked API key with given hash from the database
+func (p *PostgresWrapper) SelectActiveAPIKeyByHash(ctx context.Context, keyHash string) (_ models.APIKeyDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectActiveAPIKeyByHash")
+	defer end(&err)
+	var key models.APIKeyDB
+	err = p.db.QueryRowContext(ctx,
+		"SELECT id, name, key_hash, role, created_at, revoked_at FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL",
+		keyHash).
+		Scan(&key.ID, &key.Name, &key.KeyHash, &key.Role, &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		return models.APIKeyDB{}, fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return key, nil
+}
+
+// SelectAPIKeys returns a list of all API keys from the database, revoked keys are included
+func (p *PostgresWrapper) SelectAPIKeys(ctx context.Context) (_ models.APIKeysDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectAPIKeys")
+	defer end(&err)
+	rows, err := p.db.QueryContext(ctx, "SELECT id, name, key_hash, role, created_at, revoked_at FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			p.logger(ctx).Error("Unable to close rows", "error", err)
+		}
+	}()
+
+	keys := models.APIKeysDB{}
+	for rows.Next() {
+		var key models.APIKeyDB
+		if err := rows.Scan(&key.ID, &key.Name, &key.KeyHash, &key.Role, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey marks API key with given id as revoked
+// Returns sql.ErrNoRows if there is no active API key with given id
+func (p *PostgresWrapper) RevokeAPIKey(ctx context.Context, id int) (err error) {
+	ctx, end := p.instrument(ctx, "RevokeAPIKey")
+	defer end(&err)
+	res, err := p.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to get affected rows: %w", err)
+	}
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/peyuaa/segmentify/models"
+)
+
+// InsertAuditEntry appends the record to the audit log
+func (p *PostgresWrapper) InsertAuditEntry(ctx context.Context, entry models.AuditEntryDB) (err error) {
+	ctx, end := p.instrument(ctx, "InsertAuditEntry")
+	defer end(&err)
+	_, err = p.db.ExecContext(ctx,
+		"INSERT INTO audit_log (actor, reason, method, route, path, payload_digest, status) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		entry.Actor, entry.Reason, entry.Method, entry.Route, entry.Path, entry.PayloadDigest, entry.Status)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// SelectAuditEntries returns records of the audit log matching the filter, the newest first
+func (p *PostgresWrapper) SelectAuditEntries(ctx context.Context, filter models.AuditFilter) (_ models.AuditEntriesDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectAuditEntries")
+	defer end(&err)
+	var conditions []string
+	var args []any
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Actor != "" {
+		addCondition("actor = $%d", filter.Actor)
+	}
+	if filter.Method != "" {
+		addCondition("method = $%d", filter.Method)
+	}
+	if filter.Route != "" {
+		addCondition("route = $%d", filter.Route)
+	}
+	if filter.Status != 0 {
+		addCondition("status = $%d", filter.Status)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at <= $%d", filter.To)
+	}
+	if filter.BeforeID != 0 {
+		addCondition("id < $%d", filter.BeforeID)
+	}
+
+	query := "SELECT id, created_at, actor, reason, method, route, path, payload_digest, status FROM audit_log"
+	if len(conditions) != 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			p.logger(ctx).Error("Unable to close rows", "error", err)
+		}
+	}()
+
+	entries := models.AuditEntriesDB{}
+	for rows.Next() {
+		var e models.AuditEntryDB
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.Reason, &e.Method, &e.Route, &e.Path, &e.PayloadDigest, &e.Status)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+
+	return entries, nil
+}
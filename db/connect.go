@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// connectInitialDelay is the delay after the first failed attempt to connect, it's doubled after every attempt
+	connectInitialDelay = 500 * time.Millisecond
+
+	// connectMaxDelay is the maximum delay between the attempts to connect
+	connectMaxDelay = 10 * time.Second
+)
+
+// ConnectOptions defines the connection to the database and its pool
+type ConnectOptions struct {
+	// how long the attempts to connect are retried
+	Timeout time.Duration
+
+	// maximum number of open connections, 0 means unlimited
+	MaxOpenConns int
+
+	// maximum number of idle connections kept in the pool
+	MaxIdleConns int
+
+	// maximum time the connection is reused, 0 means forever
+	ConnMaxLifetime time.Duration
+}
+
+// Connect opens the database with the connection string and pings it until it's reachable or opts.Timeout passes
+// The attempts are retried with exponential backoff and jitter, so the database started at the same time
+// as the service isn't flooded with connections. It gives up if the next attempt would be after the timeout
+func Connect(ctx context.Context, l *log.Logger, connectionString string, opts ConnectOptions) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	delay := connectInitialDelay
+	for attempt := 1; ; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil {
+			return db, nil
+		}
+
+		// equal jitter: wait at least a half of the delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		deadline, _ := ctx.Deadline()
+		if ctx.Err() != nil || time.Until(deadline) < wait {
+			_ = db.Close()
+			return nil, fmt.Errorf("unable to connect to database in %v after %v attempts: %w", opts.Timeout, attempt, err)
+		}
+
+		l.Warn("Database isn't reachable, retrying", "attempt", attempt, "retry_in", wait.Round(time.Millisecond), "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+
+		delay = min(delay*2, connectMaxDelay)
+	}
+}
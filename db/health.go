@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ErrSchemaNotApplied is an error returned when the tables of the service don't exist, db/init.sql or the migrations aren't applied
+var ErrSchemaNotApplied = errors.New("database schema isn't applied")
+
+// tables are the tables created by db/init.sql and the migrations
+var tables = []string{
+	"api_keys",
+	"audit_log",
+	"idempotency_keys",
+	"segments",
+	"user_segment_history",
+	"user_versions",
+	"users_segments",
+}
+
+// Ping checks that the database is reachable
+func (p *PostgresWrapper) Ping(ctx context.Context) (err error) {
+	ctx, end := p.instrument(ctx, "Ping")
+	defer end(&err)
+	err = p.db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to ping database: %w", err)
+	}
+
+	return nil
+}
+
+// CheckSchema returns ErrSchemaNotApplied listing the missing tables if any of the tables of the service doesn't exist
+func (p *PostgresWrapper) CheckSchema(ctx context.Context) (err error) {
+	ctx, end := p.instrument(ctx, "CheckSchema")
+	defer end(&err)
+	var missing []string
+	err = p.db.QueryRowContext(ctx,
+		"SELECT COALESCE(array_agg(t), '{}') FROM unnest($1::text[]) AS t WHERE to_regclass('public.' || t) IS NULL",
+		pq.Array(tables)).
+		Scan(pq.Array(&missing))
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("%w: missing tables %v", ErrSchemaNotApplied, missing)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/peyuaa/segmentify/models"
+)
+
+// InsertIdempotencyKey stores the idempotency key of the principal without a response
+// The key created before expiredBefore is replaced
+// Returns ErrAlreadyExists if the principal already has the key which isn't expired
+func (p *PostgresWrapper) InsertIdempotencyKey(ctx context.Context, principal, key, requestDigest string, expiredBefore time.Time) (err error) {
+	ctx, end := p.instrument(ctx, "InsertIdempotencyKey")
+	defer end(&err)
+	return p.WithTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			"DELETE FROM idempotency_keys WHERE principal = $1 AND key = $2 AND created_at < $3",
+			principal, key, expiredBefore)
+		if err != nil {
+			return fmt.Errorf("unable to execute query: %w", err)
+		}
+
+		res, err := tx.ExecContext(ctx,
+			"INSERT INTO idempotency_keys (principal, key, request_digest) VALUES ($1, $2, $3) ON CONFLICT (principal, key) DO NOTHING",
+			principal, key, requestDigest)
+		if err != nil {
+			return fmt.Errorf("unable to execute query: %w", err)
+		}
+
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("unable to get affected rows: %w", err)
+		}
+		if inserted == 0 {
+			return ErrAlreadyExists
+		}
+
+		return nil
+	})
+}
+
+// SelectIdempotencyKey returns the idempotency key of the principal with the stored response
+func (p *PostgresWrapper) SelectIdempotencyKey(ctx context.Context, principal, key string) (_ models.IdempotencyKeyDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectIdempotencyKey")
+	defer end(&err)
+	var k models.IdempotencyKeyDB
+	err = p.db.QueryRowContext(ctx,
+		"SELECT principal, key, request_digest, status, response_headers, response_body, created_at FROM idempotency_keys WHERE principal = $1 AND key = $2",
+		principal, key).
+		Scan(&k.Principal, &k.Key, &k.RequestDigest, &k.Status, &k.ResponseHeaders, &k.ResponseBody, &k.CreatedAt)
+	if err != nil {
+		return models.IdempotencyKeyDB{}, fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return k, nil
+}
+
+// UpdateIdempotencyResponse stores the response to the request with the idempotency key of the principal
+func (p *PostgresWrapper) UpdateIdempotencyResponse(ctx context.Context, principal, key string, status int, headers, body []byte) (err error) {
+	ctx, end := p.instrument(ctx, "UpdateIdempotencyResponse")
+	defer end(&err)
+	_, err = p.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $3, response_headers = $4, response_body = $5 WHERE principal = $1 AND key = $2",
+		principal, key, status, headers, body)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteIdempotencyKey deletes the idempotency key of the principal
+func (p *PostgresWrapper) DeleteIdempotencyKey(ctx context.Context, principal, key string) (err error) {
+	ctx, end := p.instrument(ctx, "DeleteIdempotencyKey")
+	defer end(&err)
+	_, err = p.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE principal = $1 AND key = $2", principal, key)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes the idempotency keys created before expiredBefore
+// Returns the number of deleted keys
+func (p *PostgresWrapper) DeleteExpiredIdempotencyKeys(ctx context.Context, expiredBefore time.Time) (_ int64, err error) {
+	ctx, end := p.instrument(ctx, "DeleteExpiredIdempotencyKeys")
+	defer end(&err)
+	res, err := p.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < $1", expiredBefore)
+	if err != nil {
+		return 0, fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get affected rows: %w", err)
+	}
+
+	return deleted, nil
+}
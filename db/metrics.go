@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/peyuaa/segmentify/metrics"
+	"github.com/peyuaa/segmentify/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	segmentsActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "segments_active"),
+		"Number of segments which aren't deleted.", nil, nil)
+
+	membershipsActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "user_segments_active"),
+		"Number of users' segments which aren't expired or deleted.", nil, nil)
+
+	membershipsExpiredDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "user_segments_expired"),
+		"Number of users' segments which are expired but still stored.", nil, nil)
+)
+
+// RegisterMetrics registers the metrics of the database in r and starts recording the calls of the methods:
+// duration and errors per method, connection pool stats and the number of segments and users' segments
+// counted by CollectStats
+func (p *PostgresWrapper) RegisterMetrics(r *metrics.Registry) error {
+	m, err := metrics.NewDB(r)
+	if err != nil {
+		return err
+	}
+
+	stats := &statsCollector{}
+	err = r.Register(
+		collectors.NewDBStatsCollector(p.db, metrics.Namespace),
+		stats,
+	)
+	if err != nil {
+		return err
+	}
+
+	p.m = m
+	p.stats = stats
+	return nil
+}
+
+// instrument starts the span of the method call and returns the context with it and the query timeout
+// and the function recording the duration of the call and its error, it must be deferred with the named result err.
+// sql.ErrNoRows and ErrAlreadyExists aren't failures, they are expected results of the methods
+func (p *PostgresWrapper) instrument(ctx context.Context, method string) (context.Context, func(err *error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "PostgresWrapper."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation", method),
+		),
+	)
+
+	cancel := context.CancelFunc(func() {})
+	if p.queryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.queryTimeout)
+	}
+
+	return ctx, func(err *error) {
+		cancel()
+
+		failed := *err != nil && !errors.Is(*err, sql.ErrNoRows) && !errors.Is(*err, ErrAlreadyExists)
+		p.m.Observe(method, time.Since(start), failed)
+
+		if failed {
+			tracing.End(span, *err)
+			return
+		}
+		span.End()
+	}
+}
+
+// statsCollector exposes the number of segments and users' segments counted by CollectStats
+// The scrapes don't query the database, nothing is sent until the first successful count
+type statsCollector struct {
+	mu        sync.Mutex
+	collected bool
+	segments  int64
+	active    int64
+	expired   int64
+}
+
+// Describe sends the descriptors of the metrics to ch
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- segmentsActiveDesc
+	ch <- membershipsActiveDesc
+	ch <- membershipsExpiredDesc
+}
+
+// Collect sends the last counted values to ch
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.collected {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(segmentsActiveDesc, prometheus.GaugeValue, float64(c.segments))
+	ch <- prometheus.MustNewConstMetric(membershipsActiveDesc, prometheus.GaugeValue, float64(c.active))
+	ch <- prometheus.MustNewConstMetric(membershipsExpiredDesc, prometheus.GaugeValue, float64(c.expired))
+}
+
+// CollectStats counts the segments and users' segments exposed by the metrics, it's run periodically by a worker
+// The previous values are kept if the query fails
+func (p *PostgresWrapper) CollectStats(ctx context.Context) (err error) {
+	if p.stats == nil {
+		return nil
+	}
+
+	ctx, end := p.instrument(ctx, "CollectStats")
+	defer end(&err)
+
+	var segments, active, expired int64
+	err = p.db.QueryRowContext(ctx, `SELECT
+		(SELECT count(*) FROM segments WHERE is_deleted = false),
+		(SELECT count(*) FROM users_segments JOIN segments ON segments.slug = users_segments.slug
+			WHERE segments.is_deleted = false AND (expiration_date IS NULL OR expiration_date > NOW())),
+		(SELECT count(*) FROM users_segments WHERE expiration_date <= NOW())`).
+		Scan(&segments, &active, &expired)
+	if err != nil {
+		return fmt.Errorf("unable to count segments: %w", err)
+	}
+
+	p.stats.mu.Lock()
+	defer p.stats.mu.Unlock()
+	p.stats.collected = true
+	p.stats.segments, p.stats.active, p.stats.expired = segments, active, expired
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatsCollector(t *testing.T) {
+	c := &statsCollector{}
+	if n := testutil.CollectAndCount(c); n != 0 {
+		t.Errorf("metrics before the first count = %v, want 0", n)
+	}
+
+	c.collected = true
+	c.segments, c.active, c.expired = 3, 10, 2
+	expected := `
+# HELP segmentify_segments_active Number of segments which aren't deleted.
+# TYPE segmentify_segments_active gauge
+segmentify_segments_active 3
+# HELP segmentify_user_segments_active Number of users' segments which aren't expired or deleted.
+# TYPE segmentify_user_segments_active gauge
+segmentify_user_segments_active 10
+# HELP segmentify_user_segments_expired Number of users' segments which are expired but still stored.
+# TYPE segmentify_user_segments_expired gauge
+segmentify_user_segments_expired 2
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectStatsWithoutMetrics(t *testing.T) {
+	// the wrapper without the registered metrics doesn't query the database
+	p := New(nil, nil, 0)
+	err := p.CollectStats(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// migrationLockClass is the first key of the advisory lock taken while the migrations are applied
+const migrationLockClass = 2
+
+// ErrInvalidMigration is an error returned when the name of the migration file isn't <version>_<name>.sql
+var ErrInvalidMigration = errors.New("invalid migration")
+
+// migrationFiles are the changes of the schema made after db/init.sql, they are applied in the order of the versions
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a versioned change of the schema
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Migrate applies the migrations from db/migrations which aren't applied yet and returns their names
+// Every migration is recorded in schema_migrations table, all of them are applied in one transaction,
+// so the instances starting at the same time apply them once
+func (p *PostgresWrapper) Migrate(ctx context.Context) (applied []string, err error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.WithTx(ctx, func(tx *sql.Tx) error {
+		applied = nil
+
+		_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, 0)", migrationLockClass)
+		if err != nil {
+			return fmt.Errorf("unable to lock migrations: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamp with time zone DEFAULT now() NOT NULL
+		)`)
+		if err != nil {
+			return fmt.Errorf("unable to create schema_migrations table: %w", err)
+		}
+
+		var versions []int64
+		err = tx.QueryRowContext(ctx, "SELECT COALESCE(array_agg(version), '{}') FROM schema_migrations").
+			Scan(pq.Array(&versions))
+		if err != nil {
+			return fmt.Errorf("unable to select applied migrations: %w", err)
+		}
+		done := make(map[int]bool, len(versions))
+		for _, version := range versions {
+			done[int(version)] = true
+		}
+
+		for _, m := range migrations {
+			if done[m.version] {
+				continue
+			}
+
+			_, err = tx.ExecContext(ctx, m.sql)
+			if err != nil {
+				return fmt.Errorf("unable to apply migration %v: %w", m.name, err)
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+			if err != nil {
+				return fmt.Errorf("unable to record migration %v: %w", m.name, err)
+			}
+			applied = append(applied, m.name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// loadMigrations returns the migrations from migrations directory of fsys sorted by version
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list migrations: %w", err)
+	}
+
+	migrations := make([]migration, 0, len(files))
+	versions := make(map[int]string, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		prefix, _, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("%w: %v must be named <version>_<name>.sql", ErrInvalidMigration, file)
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("%w: %v and %v have the same version", ErrInvalidMigration, other, name)
+		}
+		versions[version] = name
+
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read migration %v: %w", file, err)
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(b)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return migrations, nil
+}
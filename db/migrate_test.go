@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations are embedded")
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %v has version %v, want %v: versions must be consecutive", m.name, m.version, i+1)
+		}
+		if m.sql == "" {
+			t.Errorf("migration %v is empty", m.name)
+		}
+	}
+}
+
+func TestLoadMigrationsSortsByVersion(t *testing.T) {
+	migrations, err := loadMigrations(fstest.MapFS{
+		"migrations/0010_c.sql": {Data: []byte("SELECT 3")},
+		"migrations/0002_b.sql": {Data: []byte("SELECT 2")},
+		"migrations/0001_a.sql": {Data: []byte("SELECT 1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range migrations {
+		names = append(names, m.name)
+	}
+	want := []string{"0001_a", "0002_b", "0010_c"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] || names[2] != want[2] {
+		t.Errorf("migrations = %v, want %v", names, want)
+	}
+}
+
+func TestLoadMigrationsRejectsInvalidNames(t *testing.T) {
+	for name, files := range map[string]fstest.MapFS{
+		"no version": {"migrations/api_keys.sql": {}},
+		"zero":       {"migrations/0000_api_keys.sql": {}},
+		"duplicate":  {"migrations/0001_a.sql": {}, "migrations/1_b.sql": {}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadMigrations(files)
+			if !errors.Is(err, ErrInvalidMigration) {
+				t.Errorf("error = %v, want %v", err, ErrInvalidMigration)
+			}
+		})
+	}
+}
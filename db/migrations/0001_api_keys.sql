@@ -0,0 +1,10 @@
+-- API keys of the clients, only the SHA-256 hashes of the keys are stored
+
+CREATE TABLE IF NOT EXISTS public.api_keys (
+    id serial PRIMARY KEY,
+    name text NOT NULL,
+    key_hash text NOT NULL UNIQUE,
+    role text NOT NULL,
+    created_at timestamp without time zone DEFAULT now() NOT NULL,
+    revoked_at timestamp without time zone
+);
@@ -0,0 +1,13 @@
+-- actor and reason of the changes of the segments and the users' segments
+
+ALTER TABLE public.segments
+    ADD COLUMN IF NOT EXISTS created_by text DEFAULT ''::text NOT NULL,
+    ADD COLUMN IF NOT EXISTS created_reason text DEFAULT ''::text NOT NULL,
+    ADD COLUMN IF NOT EXISTS deleted_by text DEFAULT ''::text NOT NULL,
+    ADD COLUMN IF NOT EXISTS deleted_reason text DEFAULT ''::text NOT NULL;
+
+ALTER TABLE public.user_segment_history
+    ADD COLUMN IF NOT EXISTS added_by text DEFAULT ''::text NOT NULL,
+    ADD COLUMN IF NOT EXISTS added_reason text DEFAULT ''::text NOT NULL,
+    ADD COLUMN IF NOT EXISTS removed_by text DEFAULT ''::text NOT NULL,
+    ADD COLUMN IF NOT EXISTS removed_reason text DEFAULT ''::text NOT NULL;
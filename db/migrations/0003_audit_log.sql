@@ -0,0 +1,31 @@
+-- append-only audit log of the mutating calls
+
+CREATE TABLE IF NOT EXISTS public.audit_log (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    actor text NOT NULL,
+    reason text DEFAULT ''::text NOT NULL,
+    method text NOT NULL,
+    route text NOT NULL,
+    path text NOT NULL,
+    payload_digest text DEFAULT ''::text NOT NULL,
+    status integer NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON public.audit_log USING btree (actor, id);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON public.audit_log USING btree (created_at);
+
+CREATE OR REPLACE FUNCTION public.audit_log_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON public.audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE DELETE OR UPDATE ON public.audit_log FOR EACH ROW EXECUTE FUNCTION public.audit_log_append_only();
+
+DROP TRIGGER IF EXISTS audit_log_truncate ON public.audit_log;
+CREATE TRIGGER audit_log_truncate BEFORE TRUNCATE ON public.audit_log FOR EACH STATEMENT EXECUTE FUNCTION public.audit_log_append_only();
@@ -0,0 +1,14 @@
+-- stored responses to the requests with Idempotency-Key header
+
+CREATE TABLE IF NOT EXISTS public.idempotency_keys (
+    principal text NOT NULL,
+    key text NOT NULL,
+    request_digest text NOT NULL,
+    status integer,
+    response_headers jsonb,
+    response_body bytea,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    PRIMARY KEY (principal, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON public.idempotency_keys USING btree (created_at);
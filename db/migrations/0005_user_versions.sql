@@ -0,0 +1,6 @@
+-- versions of the users' segments used in ETags
+
+CREATE TABLE IF NOT EXISTS public.user_versions (
+    user_id integer PRIMARY KEY,
+    version bigint DEFAULT 0 NOT NULL
+);
@@ -3,45 +3,71 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/peyuaa/segmentify/logging"
+	"github.com/peyuaa/segmentify/metrics"
 	"github.com/peyuaa/segmentify/models"
 
 	"github.com/charmbracelet/log"
+	"github.com/lib/pq"
 )
 
+// userLockClass is the first key of the advisory locks taken on users
+const userLockClass = 1
+
+// ErrAlreadyExists is an error returned when the inserted row already exists in the database
+var ErrAlreadyExists = errors.New("already exists")
+
 // PostgresWrapper is a wrapper for the database
 type PostgresWrapper struct {
 	l  *log.Logger
 	db *sql.DB
+	m  *metrics.DB
+
+	// the last number of segments and users' segments, nil if the metrics aren't registered
+	stats *statsCollector
+
+	// maximum duration of every call, 0 means no limit
+	queryTimeout time.Duration
 }
 
-// New returns a new PostgresWrapper
-func New(l *log.Logger, db *sql.DB) *PostgresWrapper {
+// New returns a new PostgresWrapper, every call of its methods must finish within queryTimeout
+func New(l *log.Logger, db *sql.DB, queryTimeout time.Duration) *PostgresWrapper {
 	return &PostgresWrapper{
-		l:  l,
-		db: db,
+		l:            l,
+		db:           db,
+		queryTimeout: queryTimeout,
 	}
 }
 
+// logger returns the logger of the request stored in ctx, it adds the request id to every log line
+func (p *PostgresWrapper) logger(ctx context.Context) *log.Logger {
+	return logging.FromContext(ctx, p.l)
+}
+
 // SelectSegments returns a list of all segments from the database
-func (p *PostgresWrapper) SelectSegments(ctx context.Context) (models.SegmentsDB, error) {
-	rows, err := p.db.QueryContext(ctx, "SELECT id, slug, is_deleted FROM segments")
+func (p *PostgresWrapper) SelectSegments(ctx context.Context) (_ models.SegmentsDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectSegments")
+	defer end(&err)
+	rows, err := p.db.QueryContext(ctx, "SELECT id, slug, is_deleted, created_by, created_reason, deleted_by, deleted_reason FROM segments")
 	if err != nil {
 		return nil, fmt.Errorf("unable to execute query: %w", err)
 	}
 	defer func() {
 		err := rows.Close()
 		if err != nil {
-			p.l.Error("Unable to close rows", "error", err)
+			p.logger(ctx).Error("Unable to close rows", "error", err)
 		}
 	}()
 
 	var segments models.SegmentsDB
 	for rows.Next() {
 		var segment models.SegmentDB
-		if err := rows.Scan(&segment.ID, &segment.Slug, &segment.IsDeleted); err != nil {
+		if err := rows.Scan(&segment.ID, &segment.Slug, &segment.IsDeleted,
+			&segment.CreatedBy, &segment.CreatedReason, &segment.DeletedBy, &segment.DeletedReason); err != nil {
 			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
 		segments = append(segments, segment)
@@ -55,19 +81,22 @@ func (p *PostgresWrapper) SelectSegments(ctx context.Context) (models.SegmentsDB
 }
 
 // SelectSegmentBySlug returns a segment with given slug from the database
-func (p *PostgresWrapper) SelectSegmentBySlug(ctx context.Context, slug string) (models.SegmentDB, error) {
+func (p *PostgresWrapper) SelectSegmentBySlug(ctx context.Context, slug string) (_ models.SegmentDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectSegmentBySlug")
+	defer end(&err)
 	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return models.SegmentDB{}, fmt.Errorf("unable to begin transaction: %w", err)
 	}
 
 	var segment models.SegmentDB
-	err = tx.QueryRowContext(ctx, "SELECT id, slug, is_deleted FROM segments WHERE slug = $1", slug).
-		Scan(&segment.ID, &segment.Slug, &segment.IsDeleted)
+	err = tx.QueryRowContext(ctx, "SELECT id, slug, is_deleted, created_by, created_reason, deleted_by, deleted_reason FROM segments WHERE slug = $1", slug).
+		Scan(&segment.ID, &segment.Slug, &segment.IsDeleted,
+			&segment.CreatedBy, &segment.CreatedReason, &segment.DeletedBy, &segment.DeletedReason)
 	if err != nil {
 		rollErr := tx.Rollback()
 		if rollErr != nil {
-			p.l.Error("Unable to rollback transaction", "error", rollErr)
+			p.logger(ctx).Error("Unable to rollback transaction", "error", rollErr)
 		}
 		return models.SegmentDB{}, fmt.Errorf("unable to execute query: %w", err)
 	}
@@ -79,78 +108,72 @@ func (p *PostgresWrapper) SelectSegmentBySlug(ctx context.Context, slug string)
 	return segment, nil
 }
 
-// InsertSegment inserts segment with given slug into the database
-func (p *PostgresWrapper) InsertSegment(ctx context.Context, slug string) error {
-	tx, err := p.db.BeginTx(ctx, nil)
+// InsertSegment inserts segment with given slug into the database, meta describes who creates the segment and why
+// Returns ErrAlreadyExists if the segment with given slug already exists
+func (p *PostgresWrapper) InsertSegment(ctx context.Context, slug string, meta models.ChangeMeta) (err error) {
+	ctx, end := p.instrument(ctx, "InsertSegment")
+	defer end(&err)
+	res, err := p.db.ExecContext(ctx,
+		"INSERT INTO segments (slug, created_by, created_reason) VALUES ($1, $2, $3) ON CONFLICT (slug) DO NOTHING",
+		slug, meta.Actor, meta.Reason)
 	if err != nil {
-		return fmt.Errorf("unable to begin transaction: %w", err)
+		return fmt.Errorf("unable to execute query: %w", err)
 	}
 
-	_, err = tx.ExecContext(ctx, "INSERT INTO segments (slug) VALUES ($1)", slug)
+	inserted, err := res.RowsAffected()
 	if err != nil {
-		rollErr := tx.Rollback()
-		if rollErr != nil {
-			p.l.Error("Unable to rollback transaction", "error", rollErr)
-		}
-		return fmt.Errorf("unable to execute query: %w", err)
+		return fmt.Errorf("unable to get affected rows: %w", err)
 	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("unable to commit transaction: %w", err)
+	if inserted == 0 {
+		return ErrAlreadyExists
 	}
 
 	return nil
 }
 
-// IsSegmentExists checks if segment with given slug exists in the database
-// Returns true if segment exists, false otherwise
-func (p *PostgresWrapper) IsSegmentExists(ctx context.Context, slug string) (bool, error) {
-	var count int
-	err := p.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM segments WHERE slug = $1", slug).Scan(&count)
-	if err != nil {
-		return false, fmt.Errorf("unable to execute query: %w", err)
-	}
-
-	return count > 0, nil
-}
-
-// IsSegmentDeleted checks if segment with given slug is deleted
-func (p *PostgresWrapper) IsSegmentDeleted(ctx context.Context, slug string) (bool, error) {
-	var isDeleted bool
-	err := p.db.QueryRowContext(ctx, "SELECT is_deleted FROM segments WHERE slug = $1", slug).Scan(&isDeleted)
+// SelectSegmentBySlugForUpdate returns a segment with given slug using transaction tx
+// The segment is locked until the end of the transaction, so it can't be deleted by the other transactions
+func (p *PostgresWrapper) SelectSegmentBySlugForUpdate(ctx context.Context, tx *sql.Tx, slug string) (_ models.SegmentDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectSegmentBySlugForUpdate")
+	defer end(&err)
+	var segment models.SegmentDB
+	err = tx.QueryRowContext(ctx, "SELECT id, slug, is_deleted, created_by, created_reason, deleted_by, deleted_reason FROM segments WHERE slug = $1 FOR UPDATE", slug).
+		Scan(&segment.ID, &segment.Slug, &segment.IsDeleted,
+			&segment.CreatedBy, &segment.CreatedReason, &segment.DeletedBy, &segment.DeletedReason)
 	if err != nil {
-		return false, fmt.Errorf("unable to execute query: %w", err)
+		return models.SegmentDB{}, fmt.Errorf("unable to execute query: %w", err)
 	}
 
-	return isDeleted, nil
+	return segment, nil
 }
 
-// DeleteSegment deletes segment with given slug from the database
-func (p *PostgresWrapper) DeleteSegment(ctx context.Context, slug string) error {
-	tx, err := p.db.BeginTx(ctx, nil)
+// DeleteSegment marks segment with given slug as deleted using transaction tx, meta describes who deletes the segment and why
+// The segment disappears from the users' segments, so their versions are incremented.
+// Returns sql.ErrNoRows if there is no segment with given slug or it's already deleted
+func (p *PostgresWrapper) DeleteSegment(ctx context.Context, tx *sql.Tx, slug string, meta models.ChangeMeta) (err error) {
+	ctx, end := p.instrument(ctx, "DeleteSegment")
+	defer end(&err)
+	res, err := tx.ExecContext(ctx,
+		"UPDATE segments SET is_deleted = true, deleted_by = $2, deleted_reason = $3 WHERE slug = $1 AND is_deleted = false",
+		slug, meta.Actor, meta.Reason)
 	if err != nil {
-		return fmt.Errorf("unable to begin transaction: %w", err)
+		return fmt.Errorf("unable to execute query: %w", err)
 	}
 
-	_, err = tx.ExecContext(ctx, "UPDATE segments SET is_deleted = true WHERE slug = $1", slug)
+	deleted, err := res.RowsAffected()
 	if err != nil {
-		rollErr := tx.Rollback()
-		if rollErr != nil {
-			p.l.Error("Unable to rollback transaction", "error", rollErr)
-		}
-		return fmt.Errorf("unable to execute query: %w", err)
+		return fmt.Errorf("unable to get affected rows: %w", err)
 	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("unable to commit transaction: %w", err)
+	if deleted == 0 {
+		return sql.ErrNoRows
 	}
 
-	return nil
+	return p.IncrementSegmentMembersVersions(ctx, tx, slug)
 }
 
-// ChangeUsersSegments changes the segments of a user
-// It calls addSegmentsToUser and deleteUserSegments and stores the segments addition and deletion history in one transaction
-func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, us models.UserSegmentsDB) error {
+// WithTx runs fn in a transaction
+// The transaction is committed if fn returns nil, otherwise it's rolled back and the error of fn is returned
+func (p *PostgresWrapper) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
 	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("unable to begin transaction: %w", err)
@@ -159,7 +182,7 @@ func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, us models.Use
 		if err != nil {
 			rollErr := tx.Rollback()
 			if rollErr != nil {
-				p.l.Error("Unable to rollback transaction", "error", rollErr)
+				p.logger(ctx).Error("Unable to rollback transaction", "error", rollErr)
 			}
 			return
 		}
@@ -169,9 +192,73 @@ func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, us models.Use
 		}
 	}()
 
+	return fn(tx)
+}
+
+// LockUser locks the segments of a user until the end of transaction tx
+// Every transaction changing user's segments must call it first, so the changes of the same user are serialized
+func (p *PostgresWrapper) LockUser(ctx context.Context, tx *sql.Tx, userID int) (err error) {
+	ctx, end := p.instrument(ctx, "LockUser")
+	defer end(&err)
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)", userLockClass, userID)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// SelectSegmentsBySlugsForShare returns segments with given slugs using transaction tx
+// The segments can't be deleted by other transactions until the end of transaction tx.
+// Slugs that don't exist in the database are skipped
+func (p *PostgresWrapper) SelectSegmentsBySlugsForShare(ctx context.Context, tx *sql.Tx, slugs []string) (_ models.SegmentsDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectSegmentsBySlugsForShare")
+	defer end(&err)
+	if len(slugs) == 0 {
+		return models.SegmentsDB{}, nil
+	}
+
+	// rows are locked in the same order by all transactions to avoid deadlocks
+	rows, err := tx.QueryContext(ctx, "SELECT id, slug, is_deleted FROM segments WHERE slug = ANY($1) ORDER BY id FOR SHARE", pq.Array(slugs))
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query: %w", err)
+	}
+	defer func() {
+		err := rows.Close()
+		if err != nil {
+			p.logger(ctx).Error("Unable to close rows", "error", err)
+		}
+	}()
+
+	segments := models.SegmentsDB{}
+	for rows.Next() {
+		var segment models.SegmentDB
+		if err := rows.Scan(&segment.ID, &segment.Slug, &segment.IsDeleted); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		segments = append(segments, segment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+
+	return segments, nil
+}
+
+// ChangeUsersSegments changes the segments of a user
+// It calls addSegmentsToUser and deleteUserSegments and stores the segments addition and deletion history using transaction tx
+func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, tx *sql.Tx, us models.UserSegmentsDB) (err error) {
+	ctx, end := p.instrument(ctx, "ChangeUsersSegments")
+	defer end(&err)
 	// time of change
 	t := time.Now()
 
+	// the expired memberships replaced by the added segments are removed from history on their expiration date
+	err = p.CloseExpiredSegmentsInUserHistory(ctx, tx, us.ID, us.AddSegments)
+	if err != nil {
+		return fmt.Errorf("unable to remove expired segments from user history: %w", err)
+	}
+
 	// add the segments to the user
 	err = p.AddSegmentsToUser(ctx, tx, us.ID, us.AddSegments)
 	if err != nil {
@@ -179,7 +266,7 @@ func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, us models.Use
 	}
 
 	// add the segments to the user history
-	err = p.AddSegmentInUsersHistory(ctx, tx, us.ID, us.AddSegments, t)
+	err = p.AddSegmentInUsersHistory(ctx, tx, us.ID, us.AddSegments, t, us.Meta)
 	if err != nil {
 		return fmt.Errorf("unable to add segments to user history: %w", err)
 	}
@@ -191,7 +278,7 @@ func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, us models.Use
 	}
 
 	// add the deleted segments to the user history
-	err = p.AddSegmentsRemoveDateInUserHistory(ctx, tx, us.ID, us.RemoveSegments, t)
+	err = p.AddSegmentsRemoveDateInUserHistory(ctx, tx, us.ID, us.RemoveSegments, t, us.Meta)
 	if err != nil {
 		return fmt.Errorf("unable to add deleted segments to user history: %w", err)
 	}
@@ -199,119 +286,316 @@ func (p *PostgresWrapper) ChangeUsersSegments(ctx context.Context, us models.Use
 	return nil
 }
 
-// AddSegmentsToUser add segments to user using transaction tx
-func (p *PostgresWrapper) AddSegmentsToUser(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB) (err error) {
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO users_segments (user_id, slug, expiration_date) VALUES ($1, $2, $3)")
+// SetUsersSegments replaces the segments of a user with the given segments
+// It computes the difference between the current and the desired segments of the user,
+// applies it and stores the history using transaction tx, meta describes who makes the change and why.
+// Returns the applied difference
+// If dryRun is true, the difference is only computed and nothing is written to the database
+func (p *PostgresWrapper) SetUsersSegments(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB, dryRun bool, meta models.ChangeMeta) (_ models.UserSegmentsDiffDB, err error) {
+	ctx, end := p.instrument(ctx, "SetUsersSegments")
+	defer end(&err)
+	current, err := p.SelectUserSegmentsForUpdate(ctx, tx, userID)
 	if err != nil {
-		return fmt.Errorf("unable to prepare statement: %w", err)
+		return models.UserSegmentsDiffDB{}, fmt.Errorf("unable to get user's segments: %w", err)
+	}
+
+	diff := diffUserSegments(current, segments)
+	if dryRun {
+		return diff, nil
+	}
+
+	err = p.ChangeUsersSegments(ctx, tx, models.UserSegmentsDB{
+		ID:             userID,
+		AddSegments:    diff.AddSegments,
+		RemoveSegments: diff.RemoveSegments,
+		Meta:           meta,
+	})
+	if err != nil {
+		return models.UserSegmentsDiffDB{}, err
 	}
-	defer func() {
-		stmtErr := stmt.Close()
-		if stmtErr != nil {
-			p.l.Error("Unable to close statement", "error", stmtErr)
-		}
-	}()
 
-	for _, segment := range segments {
-		_, err := stmt.ExecContext(ctx, userID, segment.Slug, segment.Expired)
+	err = p.UpdateUserSegmentsExpiration(ctx, tx, userID, diff.UpdateSegments)
+	if err != nil {
+		return models.UserSegmentsDiffDB{}, fmt.Errorf("unable to update user segments expiration: %w", err)
+	}
+
+	if len(diff.AddSegments)+len(diff.RemoveSegments)+len(diff.UpdateSegments) != 0 {
+		err = p.IncrementUserVersion(ctx, tx, userID)
 		if err != nil {
-			return fmt.Errorf("unable to execute query: %w", err)
+			return models.UserSegmentsDiffDB{}, fmt.Errorf("unable to increment user version: %w", err)
 		}
 	}
 
-	return nil
+	return diff, nil
 }
 
-// AddSegmentInUsersHistory adds segments to user history using transaction tx
-func (p *PostgresWrapper) AddSegmentInUsersHistory(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB, time time.Time) error {
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO user_segment_history (user_id, segment_slug, date_added) VALUES ($1, $2, $3)")
-	if err != nil {
-		return fmt.Errorf("unable to prepare statement: %w", err)
+// diffUserSegments returns the changes required to turn current user's segments into desired ones
+// Expiration dates are compared by date since the database stores them without time
+func diffUserSegments(current []models.UserSegmentDB, desired []models.SegmentAddDB) models.UserSegmentsDiffDB {
+	var diff models.UserSegmentsDiffDB
+
+	currentMap := make(map[string]models.UserSegmentDB, len(current))
+	for _, segment := range current {
+		currentMap[segment.Slug] = segment
 	}
-	defer func() {
-		stmtErr := stmt.Close()
-		if stmtErr != nil {
-			p.l.Error("Unable to close statement", "error", stmtErr)
+
+	desiredMap := make(map[string]struct{}, len(desired))
+	for _, segment := range desired {
+		desiredMap[segment.Slug] = struct{}{}
+
+		got, ok := currentMap[segment.Slug]
+		if !ok {
+			diff.AddSegments = append(diff.AddSegments, segment)
+			continue
 		}
-	}()
 
-	for _, segment := range segments {
-		_, err := stmt.ExecContext(ctx, userID, segment.Slug, time)
-		if err != nil {
-			return fmt.Errorf("unable to execute query: %w", err)
+		if expirationDate(got.Expired) != expirationDateString(segment.Expired) {
+			diff.UpdateSegments = append(diff.UpdateSegments, segment)
 		}
 	}
 
-	return nil
+	for _, segment := range current {
+		if _, ok := desiredMap[segment.Slug]; !ok {
+			diff.RemoveSegments = append(diff.RemoveSegments, models.SegmentDeleteDB{Slug: segment.Slug})
+		}
+	}
+
+	return diff
+}
+
+// expirationDate formats the expiration date stored in the database, returns empty string if there is no date
+func expirationDate(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+
+	return t.Time.Format(time.DateOnly)
 }
 
-// AddSegmentsRemoveDateInUserHistory sets date_removed to time for segments in user history using transaction tx
-func (p *PostgresWrapper) AddSegmentsRemoveDateInUserHistory(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentDeleteDB, time time.Time) error {
-	stmt, err := tx.PrepareContext(ctx, "UPDATE user_segment_history SET date_removed = $1 WHERE user_id = $2 AND segment_slug = $3 AND date_removed IS NULL")
+// expirationDateString formats the expiration date received from the API, returns empty string if there is no date
+func expirationDateString(s sql.NullString) string {
+	if !s.Valid {
+		return ""
+	}
+
+	t, err := time.Parse(time.RFC3339, s.String)
 	if err != nil {
-		return fmt.Errorf("unable to prepare statement: %w", err)
+		return s.String
+	}
+
+	return t.Format(time.DateOnly)
+}
+
+// SelectUserSegmentsForUpdate returns the active segments of a user and locks them until the end of transaction tx
+// Expired memberships and memberships of deleted segments aren't returned, they're absent for the user
+func (p *PostgresWrapper) SelectUserSegmentsForUpdate(ctx context.Context, tx *sql.Tx, userID int) (_ []models.UserSegmentDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectUserSegmentsForUpdate")
+	defer end(&err)
+	rows, err := tx.QueryContext(ctx, `SELECT users_segments.slug, expiration_date FROM users_segments
+		JOIN segments ON segments.slug = users_segments.slug
+		WHERE user_id = $1 AND (expiration_date IS NULL OR expiration_date > NOW()) AND segments.is_deleted = false
+		FOR UPDATE OF users_segments`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query: %w", err)
 	}
 	defer func() {
-		stmtErr := stmt.Close()
-		if stmtErr != nil {
-			p.l.Error("Unable to close statement", "error", stmtErr)
+		err := rows.Close()
+		if err != nil {
+			p.logger(ctx).Error("Unable to close rows", "error", err)
 		}
 	}()
 
-	for _, segment := range segments {
-		_, err := stmt.ExecContext(ctx, time, userID, segment.Slug)
-		if err != nil {
-			return fmt.Errorf("unable to execute query: %w", err)
+	var segments []models.UserSegmentDB
+	for rows.Next() {
+		var segment models.UserSegmentDB
+		if err := rows.Scan(&segment.Slug, &segment.Expired); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
+		segments = append(segments, segment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while iterating over rows: %w", err)
+	}
+
+	return segments, nil
+}
+
+// UpdateUserSegmentsExpiration sets new expiration date for user's segments using transaction tx
+func (p *PostgresWrapper) UpdateUserSegmentsExpiration(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB) (err error) {
+	ctx, end := p.instrument(ctx, "UpdateUserSegmentsExpiration")
+	defer end(&err)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	slugs, expired := splitSegmentsAdd(segments)
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users_segments SET expiration_date = t.expiration_date FROM unnest($2::text[], $3::date[]) AS t(slug, expiration_date) WHERE users_segments.user_id = $1 AND users_segments.slug = t.slug",
+		userID, pq.Array(slugs), pq.Array(expired))
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
 	}
 
 	return nil
 }
 
-// DeleteUserSegments deletes segments from user using transaction tx
-func (p *PostgresWrapper) DeleteUserSegments(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentDeleteDB) error {
-	stmt, err := tx.PrepareContext(ctx, "DELETE FROM users_segments WHERE user_id = $1 AND slug = $2")
+// AddSegmentsToUser add segments to user using transaction tx
+// If the user has an expired segment, it's replaced with the new one
+func (p *PostgresWrapper) AddSegmentsToUser(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB) (err error) {
+	ctx, end := p.instrument(ctx, "AddSegmentsToUser")
+	defer end(&err)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	slugs, expired := splitSegmentsAdd(segments)
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO users_segments (user_id, slug, expiration_date) SELECT $1, t.slug, t.expiration_date FROM unnest($2::text[], $3::date[]) AS t(slug, expiration_date) ON CONFLICT (user_id, slug) DO UPDATE SET expiration_date = EXCLUDED.expiration_date",
+		userID, pq.Array(slugs), pq.Array(expired))
 	if err != nil {
-		return fmt.Errorf("unable to prepare statement: %w", err)
+		return fmt.Errorf("unable to execute query: %w", err)
 	}
-	defer func() {
-		stmtErr := stmt.Close()
-		if stmtErr != nil {
-			p.l.Error("Unable to close statement", "error", stmtErr)
-		}
-	}()
 
-	for _, segment := range segments {
-		_, err := stmt.ExecContext(ctx, userID, segment.Slug)
-		if err != nil {
-			return fmt.Errorf("unable to execute query: %w", err)
-		}
+	return nil
+}
+
+// CloseExpiredSegmentsInUserHistory sets date_removed to the expiration date in user history
+// for the expired memberships of the segments using transaction tx, they must be closed before the segments are added again
+func (p *PostgresWrapper) CloseExpiredSegmentsInUserHistory(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB) (err error) {
+	ctx, end := p.instrument(ctx, "CloseExpiredSegmentsInUserHistory")
+	defer end(&err)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	slugs, _ := splitSegmentsAdd(segments)
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE user_segment_history SET date_removed = users_segments.expiration_date, removed_by = $3, removed_reason = $4
+		FROM users_segments
+		WHERE user_segment_history.user_id = $1 AND user_segment_history.segment_slug = ANY($2) AND user_segment_history.date_removed IS NULL
+			AND users_segments.user_id = user_segment_history.user_id AND users_segments.slug = user_segment_history.segment_slug
+			AND users_segments.expiration_date <= NOW()`,
+		userID, pq.Array(slugs), models.ExpirationMeta.Actor, models.ExpirationMeta.Reason)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
 	}
 
 	return nil
 }
 
-// GetUsersSegments returns a list of all not expired segments of a user from the database
-func (p *PostgresWrapper) GetUsersSegments(ctx context.Context, userID int) (models.SegmentsDB, error) {
-	tx, err := p.db.BeginTx(ctx, nil)
+// AddSegmentInUsersHistory adds segments to user history using transaction tx
+func (p *PostgresWrapper) AddSegmentInUsersHistory(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentAddDB, date time.Time, meta models.ChangeMeta) (err error) {
+	ctx, end := p.instrument(ctx, "AddSegmentInUsersHistory")
+	defer end(&err)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	slugs, _ := splitSegmentsAdd(segments)
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_segment_history (user_id, segment_slug, date_added, added_by, added_reason) SELECT $1, unnest($2::text[]), $3, $4, $5",
+		userID, pq.Array(slugs), date, meta.Actor, meta.Reason)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// AddSegmentsRemoveDateInUserHistory sets date_removed to date for segments in user history using transaction tx
+func (p *PostgresWrapper) AddSegmentsRemoveDateInUserHistory(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentDeleteDB, date time.Time, meta models.ChangeMeta) (err error) {
+	ctx, end := p.instrument(ctx, "AddSegmentsRemoveDateInUserHistory")
+	defer end(&err)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE user_segment_history SET date_removed = $1, removed_by = $4, removed_reason = $5 WHERE user_id = $2 AND segment_slug = ANY($3) AND date_removed IS NULL",
+		date, userID, pq.Array(segmentsDeleteSlugs(segments)), meta.Actor, meta.Reason)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUserSegments deletes segments from user using transaction tx
+func (p *PostgresWrapper) DeleteUserSegments(ctx context.Context, tx *sql.Tx, userID int, segments []models.SegmentDeleteDB) (err error) {
+	ctx, end := p.instrument(ctx, "DeleteUserSegments")
+	defer end(&err)
+	if len(segments) == 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM users_segments WHERE user_id = $1 AND slug = ANY($2)",
+		userID, pq.Array(segmentsDeleteSlugs(segments)))
 	if err != nil {
-		return nil, fmt.Errorf("unable to begin transaction: %w", err)
+		return fmt.Errorf("unable to execute query: %w", err)
 	}
 
+	return nil
+}
+
+// splitSegmentsAdd returns slugs and expiration dates of the segments as separate slices,
+// so they can be passed to the database as arrays
+func splitSegmentsAdd(segments []models.SegmentAddDB) ([]string, []sql.NullString) {
+	slugs := make([]string, len(segments))
+	expired := make([]sql.NullString, len(segments))
+	for i, segment := range segments {
+		slugs[i] = segment.Slug
+		expired[i] = segment.Expired
+	}
+
+	return slugs, expired
+}
+
+// segmentsDeleteSlugs returns slugs of the segments
+func segmentsDeleteSlugs(segments []models.SegmentDeleteDB) []string {
+	slugs := make([]string, len(segments))
+	for i, segment := range segments {
+		slugs[i] = segment.Slug
+	}
+
+	return slugs
+}
+
+// GetUsersSegments returns a list of all not expired segments of a user and the version of them from the database
+func (p *PostgresWrapper) GetUsersSegments(ctx context.Context, userID int) (segments models.SegmentsDB, version models.UserVersionDB, err error) {
+	ctx, end := p.instrument(ctx, "GetUsersSegments")
+	defer end(&err)
+	err = p.WithTx(ctx, func(tx *sql.Tx) error {
+		segments, err = p.SelectActiveUserSegments(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		version, err = p.SelectUserVersion(ctx, tx, userID)
+		return err
+	})
+
+	return segments, version, err
+}
+
+// SelectActiveUserSegments returns a list of all not expired segments of a user using transaction tx
+func (p *PostgresWrapper) SelectActiveUserSegments(ctx context.Context, tx *sql.Tx, userID int) (_ models.SegmentsDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectActiveUserSegments")
+	defer end(&err)
 	rows, err := tx.QueryContext(ctx,
 		"SELECT users_segments.slug FROM users_segments LEFT JOIN segments ON segments.slug = users_segments.slug WHERE user_id = $1 AND (expiration_date IS NULL OR expiration_date > NOW()) AND segments.is_deleted = false",
 		userID)
 	if err != nil {
-		rollErr := tx.Rollback()
-		if rollErr != nil {
-			p.l.Error("Unable to rollback transaction", "error", rollErr)
-		}
 		return nil, fmt.Errorf("unable to execute query: %w", err)
 	}
 	defer func() {
 		err := rows.Close()
 		if err != nil {
-			p.l.Error("Unable to close rows", "error", err)
+			p.logger(ctx).Error("Unable to close rows", "error", err)
 		}
 	}()
 
@@ -327,30 +611,29 @@ func (p *PostgresWrapper) GetUsersSegments(ctx context.Context, userID int) (mod
 		return nil, fmt.Errorf("error while iterating over rows: %w", err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("unable to commit transaction: %w", err)
-	}
-
 	return segments, nil
 }
 
 // GetUsersHistory returns user history for given period
-func (p *PostgresWrapper) GetUsersHistory(ctx context.Context, userID int, from, to time.Time) (models.UserSegmentsHistoryDB, error) {
-	rows, err := p.db.QueryContext(ctx, "SELECT user_id, segment_slug, date_added, date_removed FROM user_segment_history WHERE user_id = $1 AND ((date_added >= $2 AND date_added <= $3) OR (date_removed >= $2 AND date_removed <= $3))", userID, from, to)
+func (p *PostgresWrapper) GetUsersHistory(ctx context.Context, userID int, from, to time.Time) (_ models.UserSegmentsHistoryDB, err error) {
+	ctx, end := p.instrument(ctx, "GetUsersHistory")
+	defer end(&err)
+	rows, err := p.db.QueryContext(ctx, "SELECT user_id, segment_slug, date_added, date_removed, added_by, added_reason, removed_by, removed_reason FROM user_segment_history WHERE user_id = $1 AND ((date_added >= $2 AND date_added <= $3) OR (date_removed >= $2 AND date_removed <= $3))", userID, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("unable to execute query: %w", err)
 	}
 	defer func() {
 		err := rows.Close()
 		if err != nil {
-			p.l.Error("Unable to close rows", "error", err)
+			p.logger(ctx).Error("Unable to close rows", "error", err)
 		}
 	}()
 
 	var history models.UserSegmentsHistoryDB
 	for rows.Next() {
 		var h models.UserSegmentHistoryDB
-		if err := rows.Scan(&h.ID, &h.Slug, &h.DateAdded, &h.DateRemoved); err != nil {
+		if err := rows.Scan(&h.ID, &h.Slug, &h.DateAdded, &h.DateRemoved,
+			&h.AddedBy, &h.AddedReason, &h.RemovedBy, &h.RemovedReason); err != nil {
 			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
 		history = append(history, h)
@@ -360,3 +643,31 @@ func (p *PostgresWrapper) GetUsersHistory(ctx context.Context, userID int, from,
 	}
 	return history, nil
 }
+
+// DeleteExpiredUserSegments deletes at most limit users' segments which expired and sets their removal
+// in user history to the expiration date, meta describes who removes the segments and why
+// Rows locked by other transactions are skipped, they are deleted by the next call. Returns the number of deleted rows
+func (p *PostgresWrapper) DeleteExpiredUserSegments(ctx context.Context, limit int, meta models.ChangeMeta) (_ int64, err error) {
+	ctx, end := p.instrument(ctx, "DeleteExpiredUserSegments")
+	defer end(&err)
+	var deleted int64
+	err = p.db.QueryRowContext(ctx, `WITH expired AS (
+			DELETE FROM users_segments WHERE ctid IN (
+				SELECT ctid FROM users_segments WHERE expiration_date <= NOW() LIMIT $1 FOR UPDATE SKIP LOCKED
+			)
+			RETURNING user_id, slug, expiration_date
+		), history AS (
+			UPDATE user_segment_history SET date_removed = expired.expiration_date, removed_by = $2, removed_reason = $3
+			FROM expired
+			WHERE user_segment_history.user_id = expired.user_id AND user_segment_history.segment_slug = expired.slug
+				AND user_segment_history.date_removed IS NULL
+		)
+		SELECT count(*) FROM expired`,
+		limit, meta.Actor, meta.Reason).
+		Scan(&deleted)
+	if err != nil {
+		return 0, fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return deleted, nil
+}
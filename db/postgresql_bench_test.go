@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/charmbracelet/log"
+	"github.com/lib/pq"
+)
+
+// errRollback is returned from the transactions of the benchmarks, so nothing is written to the database
+var errRollback = errors.New("rollback")
+
+// benchmarkSizes are the numbers of segments changed by one request
+var benchmarkSizes = []int{10, 100, 1000}
+
+var benchmarkMeta = models.ChangeMeta{Actor: "benchmark", Reason: "benchmark"}
+
+// newBenchmarkWrapper returns the wrapper of the database from DB_CONNECTION_STRING with the schema applied
+// and segmentsCount segments created for the benchmark, the benchmark is skipped if the variable isn't set
+func newBenchmarkWrapper(b *testing.B, segmentsCount int) (*PostgresWrapper, []models.SegmentAddDB) {
+	b.Helper()
+
+	connectionString := os.Getenv("DB_CONNECTION_STRING")
+	if connectionString == "" {
+		b.Skip("DB_CONNECTION_STRING isn't set, skipping benchmark")
+	}
+
+	l := log.New(io.Discard)
+	ctx := context.Background()
+	conn, err := Connect(ctx, l, connectionString, ConnectOptions{Timeout: 10 * time.Second})
+	if err != nil {
+		b.Fatalf("unable to connect to database: %v", err)
+	}
+	b.Cleanup(func() { _ = conn.Close() })
+
+	p := New(l, conn, time.Minute)
+	_, err = p.Migrate(ctx)
+	if err != nil {
+		b.Fatalf("unable to migrate database, db/init.sql must be applied: %v", err)
+	}
+	err = p.CheckSchema(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	segments := make([]models.SegmentAddDB, segmentsCount)
+	for i := range segments {
+		segments[i] = models.SegmentAddDB{Slug: fmt.Sprintf("BENCH_%v_%v", segmentsCount, i)}
+		err = p.InsertSegment(ctx, segments[i].Slug, benchmarkMeta)
+		if err != nil && !errors.Is(err, ErrAlreadyExists) {
+			b.Fatal(err)
+		}
+	}
+
+	return p, segments
+}
+
+// benchmarkWrite runs write in a transaction rolled back after every iteration, every iteration has a new user
+func benchmarkWrite(b *testing.B, p *PostgresWrapper, write func(ctx context.Context, tx *sql.Tx, userID int) error) {
+	b.Helper()
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		userID := 1_000_000_000 + rand.Intn(1_000_000_000)
+		err := p.WithTx(ctx, func(tx *sql.Tx) error {
+			err := write(ctx, tx, userID)
+			if err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAddSegmentsToUser compares adding the segments to the user and its history with one statement per table
+// and with one statement per segment
+func BenchmarkAddSegmentsToUser(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("set/%v", size), func(b *testing.B) {
+			p, segments := newBenchmarkWrapper(b, size)
+			benchmarkWrite(b, p, func(ctx context.Context, tx *sql.Tx, userID int) error {
+				err := p.AddSegmentsToUser(ctx, tx, userID, segments)
+				if err != nil {
+					return err
+				}
+				return p.AddSegmentInUsersHistory(ctx, tx, userID, segments, time.Now(), benchmarkMeta)
+			})
+		})
+
+		b.Run(fmt.Sprintf("row/%v", size), func(b *testing.B) {
+			p, segments := newBenchmarkWrapper(b, size)
+			benchmarkWrite(b, p, func(ctx context.Context, tx *sql.Tx, userID int) error {
+				now := time.Now()
+				for _, segment := range segments {
+					_, err := tx.ExecContext(ctx,
+						"INSERT INTO users_segments (user_id, slug, expiration_date) VALUES ($1, $2, $3) ON CONFLICT (user_id, slug) DO UPDATE SET expiration_date = EXCLUDED.expiration_date",
+						userID, segment.Slug, segment.Expired)
+					if err != nil {
+						return err
+					}
+					_, err = tx.ExecContext(ctx,
+						"INSERT INTO user_segment_history (user_id, segment_slug, date_added, added_by, added_reason) VALUES ($1, $2, $3, $4, $5)",
+						userID, segment.Slug, now, benchmarkMeta.Actor, benchmarkMeta.Reason)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// BenchmarkRemoveSegmentsFromUser compares removing the segments from the user and closing them in its history
+// with one statement per table and with one statement per segment
+func BenchmarkRemoveSegmentsFromUser(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		// the segments are added in the same transaction, the time of adding is the same for both variants
+		add := func(ctx context.Context, p *PostgresWrapper, tx *sql.Tx, userID int, segments []models.SegmentAddDB) error {
+			err := p.AddSegmentsToUser(ctx, tx, userID, segments)
+			if err != nil {
+				return err
+			}
+			return p.AddSegmentInUsersHistory(ctx, tx, userID, segments, time.Now(), benchmarkMeta)
+		}
+
+		b.Run(fmt.Sprintf("set/%v", size), func(b *testing.B) {
+			p, segments := newBenchmarkWrapper(b, size)
+			remove := make([]models.SegmentDeleteDB, len(segments))
+			for i, segment := range segments {
+				remove[i] = models.SegmentDeleteDB{Slug: segment.Slug}
+			}
+
+			benchmarkWrite(b, p, func(ctx context.Context, tx *sql.Tx, userID int) error {
+				err := add(ctx, p, tx, userID, segments)
+				if err != nil {
+					return err
+				}
+				err = p.DeleteUserSegments(ctx, tx, userID, remove)
+				if err != nil {
+					return err
+				}
+				return p.AddSegmentsRemoveDateInUserHistory(ctx, tx, userID, remove, time.Now(), benchmarkMeta)
+			})
+		})
+
+		b.Run(fmt.Sprintf("row/%v", size), func(b *testing.B) {
+			p, segments := newBenchmarkWrapper(b, size)
+			benchmarkWrite(b, p, func(ctx context.Context, tx *sql.Tx, userID int) error {
+				err := add(ctx, p, tx, userID, segments)
+				if err != nil {
+					return err
+				}
+				now := time.Now()
+				for _, segment := range segments {
+					_, err = tx.ExecContext(ctx, "DELETE FROM users_segments WHERE user_id = $1 AND slug = $2", userID, segment.Slug)
+					if err != nil {
+						return err
+					}
+					_, err = tx.ExecContext(ctx,
+						"UPDATE user_segment_history SET date_removed = $1, removed_by = $4, removed_reason = $5 WHERE user_id = $2 AND segment_slug = $3 AND date_removed IS NULL",
+						now, userID, segment.Slug, benchmarkMeta.Actor, benchmarkMeta.Reason)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// BenchmarkSelectSegmentsBySlugs compares getting the segments of the request with one query and with one query per slug
+func BenchmarkSelectSegmentsBySlugs(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("set/%v", size), func(b *testing.B) {
+			p, segments := newBenchmarkWrapper(b, size)
+			slugs, _ := splitSegmentsAdd(segments)
+			benchmarkWrite(b, p, func(ctx context.Context, tx *sql.Tx, _ int) error {
+				rows, err := tx.QueryContext(ctx, "SELECT slug, is_deleted FROM segments WHERE slug = ANY($1) FOR SHARE", pq.Array(slugs))
+				if err != nil {
+					return err
+				}
+				return rows.Close()
+			})
+		})
+
+		b.Run(fmt.Sprintf("row/%v", size), func(b *testing.B) {
+			p, segments := newBenchmarkWrapper(b, size)
+			benchmarkWrite(b, p, func(ctx context.Context, tx *sql.Tx, _ int) error {
+				for _, segment := range segments {
+					var isDeleted bool
+					err := tx.QueryRowContext(ctx, "SELECT is_deleted FROM segments WHERE slug = $1 FOR SHARE", segment.Slug).Scan(&isDeleted)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
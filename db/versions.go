@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/peyuaa/segmentify/models"
+)
+
+// SelectUserVersion returns the version of user's segments and the current date of the database using transaction tx
+// Users without changes have version 0
+func (p *PostgresWrapper) SelectUserVersion(ctx context.Context, tx *sql.Tx, userID int) (_ models.UserVersionDB, err error) {
+	ctx, end := p.instrument(ctx, "SelectUserVersion")
+	defer end(&err)
+	var v models.UserVersionDB
+	err = tx.QueryRowContext(ctx,
+		"SELECT COALESCE((SELECT version FROM user_versions WHERE user_id = $1), 0), CURRENT_DATE",
+		userID).
+		Scan(&v.Version, &v.Date)
+	if err != nil {
+		return models.UserVersionDB{}, fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return v, nil
+}
+
+// IncrementUserVersion increments the version of user's segments using transaction tx
+func (p *PostgresWrapper) IncrementUserVersion(ctx context.Context, tx *sql.Tx, userID int) (err error) {
+	ctx, end := p.instrument(ctx, "IncrementUserVersion")
+	defer end(&err)
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_versions (user_id, version) VALUES ($1, 1) ON CONFLICT (user_id) DO UPDATE SET version = user_versions.version + 1",
+		userID)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
+
+// IncrementSegmentMembersVersions increments the versions of all users having the segment using transaction tx
+func (p *PostgresWrapper) IncrementSegmentMembersVersions(ctx context.Context, tx *sql.Tx, slug string) (err error) {
+	ctx, end := p.instrument(ctx, "IncrementSegmentMembersVersions")
+	defer end(&err)
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_versions (user_id, version) SELECT user_id, 1 FROM users_segments WHERE slug = $1 ON CONFLICT (user_id) DO UPDATE SET version = user_versions.version + 1",
+		slug)
+	if err != nil {
+		return fmt.Errorf("unable to execute query: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MiddlewareAccessLog returns a middleware which writes one entry to the access log al per request:
+// method, route template from MiddlewareRoute, path, status, size of the response body, duration and client address
+// It must be used after MiddlewareRequestID and MiddlewareTracing, so the entries have the request and trace ids
+func (s *Segments) MiddlewareAccessLog(al *log.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			sr := &statusRecorder{ResponseWriter: rw}
+			next.ServeHTTP(sr, r)
+			if sr.status == 0 {
+				sr.status = http.StatusOK
+			}
+
+			keyvals := []interface{}{"request_id", requestID(r)}
+			if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+				keyvals = append(keyvals, "trace_id", sc.TraceID().String())
+			}
+
+			al.Info("Request", append(keyvals,
+				"method", r.Method,
+				"route", routeTemplate(r),
+				"path", r.URL.Path,
+				"status", sr.status,
+				"bytes", sr.bytes,
+				"duration_seconds", time.Since(start).Seconds(),
+				"client", clientAddress(r),
+				"user_agent", r.UserAgent(),
+			)...)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/gorilla/mux"
+)
+
+// CreateAPIKey creates a new API key
+func (s *Segments) CreateAPIKey(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+	// the response contains the key, it mustn't be cached or stored for the retries with the idempotency key
+	rw.Header().Set("Cache-Control", "no-store")
+
+	// fetch the API key request from the context
+	request := r.Context().Value(KeyCreateAPIKey{}).(models.CreateAPIKeyRequest)
+
+	key, err := s.d.CreateAPIKey(r.Context(), request)
+	if err != nil {
+		s.writeError(rw, r, fmt.Errorf("unable to create API key: %w", err))
+		return
+	}
+
+	s.logger(r).Info("API key created", "id", key.ID, "name", key.Name, "role", key.Role)
+
+	rw.WriteHeader(http.StatusCreated)
+	err = data.ToJSON(key, rw)
+	if err != nil {
+		s.logger(r).Error("Unable to serialize API key", "error", err)
+	}
+}
+
+// GetAPIKeys returns all API keys
+func (s *Segments) GetAPIKeys(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+
+	keys, err := s.d.GetAPIKeys(r.Context())
+	if err != nil {
+		s.writeError(rw, r, fmt.Errorf("unable to get API keys: %w", err))
+		return
+	}
+
+	err = data.ToJSON(keys, rw)
+	if err != nil {
+		s.logger(r).Error("Unable to marshal json", "error", err)
+	}
+}
+
+// RevokeAPIKey revokes the API key, revoked keys are kept in the database
+func (s *Segments) RevokeAPIKey(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(rw, r, invalidParameter(fmt.Errorf("unable to convert API key id to int: %w", err)))
+		return
+	}
+
+	err = s.d.RevokeAPIKey(r.Context(), id)
+	if err != nil {
+		s.writeError(rw, r, fmt.Errorf("id=%v: %w", id, err))
+		return
+	}
+
+	s.logger(r).Info("API key revoked", "id", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/gorilla/mux"
+)
+
+// statusRecorder is a http.ResponseWriter that remembers the status and the size of the response body
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader remembers the status and writes it to the underlying writer
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the data to the underlying writer, the status is 200 if it wasn't written before
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// MiddlewareAudit records every mutating request to the audit log after it's handled
+// Requests with GET, HEAD and OPTIONS methods aren't recorded.
+// It must be used after MiddlewareAuthenticate
+func (s *Segments) MiddlewareAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, MaxBodySize))
+		if err != nil {
+			s.writeError(rw, r, decodeError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sr := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		actor, reason := actorAndReason(r)
+		// too long headers are rejected by MiddlewareChangeMeta, but the attempt is still recorded
+		if len(actor) > maxActorLength {
+			actor = actor[:maxActorLength]
+		}
+		if len(reason) > maxReasonLength {
+			reason = reason[:maxReasonLength]
+		}
+		meta := newChangeMeta(r, actor, reason)
+
+		entry := models.AuditEntry{
+			Actor:  meta.Actor,
+			Reason: meta.Reason,
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Status: sr.status,
+		}
+		if route := mux.CurrentRoute(r); route != nil {
+			template, err := route.GetPathTemplate()
+			if err == nil {
+				entry.Route = normalizeRoute(template)
+			}
+		}
+		if len(body) != 0 {
+			sum := sha256.Sum256(body)
+			entry.PayloadDigest = hex.EncodeToString(sum[:])
+		}
+
+		// the record must be stored even if the client has gone away
+		err = s.d.RecordAudit(context.WithoutCancel(r.Context()), entry)
+		if err != nil {
+			s.logger(r).Error("Unable to record audit entry", "error", err, "actor", entry.Actor, "method", entry.Method, "path", entry.Path, "status", entry.Status)
+		}
+	})
+}
+
+// GetAuditLog returns a page of the audit log
+func (s *Segments) GetAuditLog(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+
+	filter, err := s.getAuditFilter(r)
+	if err != nil {
+		s.writeError(rw, r, invalidParameter(err))
+		return
+	}
+
+	page, err := s.d.GetAuditLog(r.Context(), filter)
+	if err != nil {
+		s.writeError(rw, r, err)
+		return
+	}
+
+	err = data.ToJSON(page, rw)
+	if err != nil {
+		s.logger(r).Error("Unable to marshal json", "error", err)
+	}
+}
+
+// getAuditFilter returns the audit log filter from the query parameters
+func (s *Segments) getAuditFilter(r *http.Request) (models.AuditFilter, error) {
+	q := r.URL.Query()
+
+	filter := models.AuditFilter{
+		Actor:  q.Get("actor"),
+		Method: strings.ToUpper(q.Get("method")),
+		Route:  q.Get("route"),
+	}
+	if filter.Route != "" {
+		// the routes are stored normalized, e.g. /v1/segments/{slug} is /segments/{slug}
+		filter.Route = normalizeRoute(filter.Route)
+	}
+
+	var err error
+	if str := q.Get("status"); str != "" {
+		filter.Status, err = strconv.Atoi(str)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse status: %w", err)
+		}
+	}
+	if str := q.Get("from"); str != "" {
+		filter.From, err = time.Parse(time.RFC3339, str)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse from: %w", err)
+		}
+	}
+	if str := q.Get("to"); str != "" {
+		filter.To, err = time.Parse(time.RFC3339, str)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse to: %w", err)
+		}
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && filter.From.After(filter.To) {
+		return filter, fmt.Errorf("from is after to")
+	}
+	if str := q.Get("before_id"); str != "" {
+		filter.BeforeID, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse before_id: %w", err)
+		}
+	}
+	if str := q.Get("limit"); str != "" {
+		filter.Limit, err = strconv.Atoi(str)
+		if err != nil {
+			return filter, fmt.Errorf("unable to parse limit: %w", err)
+		}
+		if filter.Limit == 0 {
+			return filter, data.ErrInvalidAuditLimit
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/peyuaa/segmentify/auth"
+	"github.com/peyuaa/segmentify/certs"
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// HeaderAPIKey is a header that can be used to pass the API key instead of Authorization
+	HeaderAPIKey = "X-API-Key"
+
+	// HeaderActor is a header that contains the person or system on whose behalf the caller makes the change
+	HeaderActor = "X-Actor"
+
+	// HeaderReason is a header that contains free-text reason of the change
+	HeaderReason = "X-Reason"
+
+	maxActorLength  = 200
+	maxReasonLength = 1000
+
+	bearerPrefix = "Bearer "
+)
+
+var (
+	// errNoAPIKey is an error returned when the request doesn't contain an API key
+	errNoAPIKey = errors.New("API key or bearer token is required")
+
+	// errForbidden is an error returned when the caller's role doesn't allow the request
+	errForbidden = errors.New("caller's role doesn't allow this operation")
+
+	// errSegmentForbidden is an error returned when the caller isn't allowed to change the segment
+	errSegmentForbidden = errors.New("caller isn't allowed to change segment")
+
+	// errSetSegmentsRestricted is an error returned when the caller allowed to change only some segments replaces all of them
+	errSetSegmentsRestricted = errors.New("caller allowed to change only segments with certain prefixes can't replace all user segments")
+)
+
+// MiddlewareAuthenticate authenticates the caller and calls next if the credentials are valid
+// The credentials are read from the Authorization header with Bearer scheme or from the X-API-Key header.
+// Bearer tokens that look like JWT are verified against the key set if it's configured,
+// everything else is treated as an API key
+func (s *Segments) MiddlewareAuthenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		credentials, isBearer := credentialsFromRequest(r)
+		if credentials == "" {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeError(rw, r, errNoAPIKey)
+			return
+		}
+
+		var principal models.Principal
+		var err error
+		if isBearer && s.tv != nil && auth.IsJWT(credentials) {
+			principal, err = s.tv.Verify(r.Context(), credentials)
+		} else {
+			principal, err = s.authenticateAPIKey(r.Context(), credentials)
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, data.ErrInvalidAPIKey), errors.Is(err, auth.ErrInvalidToken):
+			s.logger(r).Debug("Unable to authenticate", "error", err)
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeError(rw, r, err)
+			return
+		default:
+			s.writeError(rw, r, fmt.Errorf("unable to authenticate: %w", err))
+			return
+		}
+
+		// add the principal to the context
+		ctx := context.WithValue(r.Context(), KeyPrincipal{}, principal)
+		r = r.WithContext(ctx)
+
+		// Call the next handler, which can be another middleware in the chain, or the final handler.
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// MiddlewareRequireRole returns a middleware which calls next only if the caller has the role or a higher one
+// It must be used after MiddlewareAuthenticate
+func (s *Segments) MiddlewareRequireRole(role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			principal, ok := r.Context().Value(KeyPrincipal{}).(models.Principal)
+			if !ok {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				s.writeError(rw, r, errNoAPIKey)
+				return
+			}
+
+			if !data.RoleAllows(principal.Role, role) {
+				s.writeError(rw, r, fmt.Errorf("role %v is required: %w", role, errForbidden))
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// MiddlewareChangeMeta stores who makes the change and why in the context and calls next
+// The actor is the authenticated caller, followed by the subject of the verified client certificate
+// and the X-Actor header if they're set, e.g. "backoffice/backoffice.internal/alice".
+// It must be used after MiddlewareAuthenticate
+func (s *Segments) MiddlewareChangeMeta(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		actor, reason := actorAndReason(r)
+
+		if len(actor) > maxActorLength {
+			s.writeError(rw, r, invalidParameter(fmt.Errorf("header %v is longer than %v bytes", HeaderActor, maxActorLength)))
+			return
+		}
+		if len(reason) > maxReasonLength {
+			s.writeError(rw, r, invalidParameter(fmt.Errorf("header %v is longer than %v bytes", HeaderReason, maxReasonLength)))
+			return
+		}
+
+		// add the change meta to the context
+		ctx := context.WithValue(r.Context(), KeyChangeMeta{}, newChangeMeta(r, actor, reason))
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// changeMeta returns who makes the change and why from the context
+func changeMeta(r *http.Request) models.ChangeMeta {
+	meta, _ := r.Context().Value(KeyChangeMeta{}).(models.ChangeMeta)
+
+	return meta
+}
+
+// actorAndReason returns the X-Actor and X-Reason headers of the request
+func actorAndReason(r *http.Request) (actor, reason string) {
+	return strings.TrimSpace(r.Header.Get(HeaderActor)), strings.TrimSpace(r.Header.Get(HeaderReason))
+}
+
+// newChangeMeta returns the change meta of the authenticated caller acting on behalf of the actor
+// The subject of the verified client certificate is a part of the actor, so mTLS clients are audited
+func newChangeMeta(r *http.Request, actor, reason string) models.ChangeMeta {
+	principal, _ := r.Context().Value(KeyPrincipal{}).(models.Principal)
+
+	parts := []string{principal.Name}
+	for _, part := range []string{clientCertSubject(r), actor} {
+		if part != "" && part != parts[len(parts)-1] {
+			parts = append(parts, part)
+		}
+	}
+
+	return models.ChangeMeta{
+		Actor:  strings.Join(parts, "/"),
+		Reason: reason,
+	}
+}
+
+// clientCertSubject returns the subject of the client certificate verified against the client CA,
+// empty if the connection isn't TLS or the client doesn't have a certificate
+func clientCertSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return certs.Subject(r.TLS.VerifiedChains[0][0])
+}
+
+// authenticateAPIKey returns the principal of the API key
+func (s *Segments) authenticateAPIKey(ctx context.Context, key string) (models.Principal, error) {
+	apiKey, err := s.d.Authenticate(ctx, key)
+	if err != nil {
+		return models.Principal{}, err
+	}
+
+	return models.Principal{
+		ID:   fmt.Sprintf("key:%v", apiKey.ID),
+		Name: apiKey.Name,
+		Role: apiKey.Role,
+	}, nil
+}
+
+// checkSegmentsAccess returns an error if the caller isn't allowed to change any of the segments
+// Callers without segment prefixes can change all segments
+func (s *Segments) checkSegmentsAccess(r *http.Request, slugs ...string) error {
+	principal, _ := r.Context().Value(KeyPrincipal{}).(models.Principal)
+	if len(principal.SegmentPrefixes) == 0 {
+		return nil
+	}
+
+	for _, slug := range slugs {
+		if !hasAnyPrefix(slug, principal.SegmentPrefixes) {
+			return fmt.Errorf("%w \"%v\"", errSegmentForbidden, slug)
+		}
+	}
+
+	return nil
+}
+
+// isRestricted returns true if the caller can change only the segments with certain prefixes
+func (s *Segments) isRestricted(r *http.Request) bool {
+	principal, _ := r.Context().Value(KeyPrincipal{}).(models.Principal)
+
+	return len(principal.SegmentPrefixes) != 0
+}
+
+// hasAnyPrefix returns true if s starts with any of the prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// credentialsFromRequest returns the credentials of the request or empty string if there are none
+// isBearer is true if the credentials were passed in the Authorization header
+func credentialsFromRequest(r *http.Request) (credentials string, isBearer bool) {
+	if key := r.Header.Get(HeaderAPIKey); key != "" {
+		return key, false
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) > len(bearerPrefix) && strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return strings.TrimSpace(header[len(bearerPrefix):]), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/peyuaa/segmentify/data"
+)
+
+// MaxBodySize is the maximum size of the request body in bytes
+const MaxBodySize = 1 << 20
+
+// validateBody returns a middleware which decodes the JSON request body into T, validates it
+// and calls next with the value stored in the context under the key
+// The body must have application/json content type, be smaller than MaxBodySize
+// and contain only the fields of T
+func validateBody[T any](s *Segments, key interface{}) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			err := checkContentType(r)
+			if err != nil {
+				s.writeError(rw, r, err)
+				return
+			}
+
+			var request T
+			err = data.FromJSONStrict(&request, http.MaxBytesReader(rw, r.Body, MaxBodySize))
+			if err != nil {
+				s.logger(r).Debug("Unable to deserialize request", "error", err, "path", r.URL.Path)
+
+				s.writeError(rw, r, decodeError(err))
+				return
+			}
+
+			errs := s.v.Validate(request)
+			if len(errs) != 0 {
+				// return the validation errors of every field
+				s.writeValidationError(rw, r, errs)
+				return
+			}
+
+			// add the request object to the context
+			ctx := context.WithValue(r.Context(), key, request)
+			r = r.WithContext(ctx)
+
+			// Call the next handler, which can be another middleware in the chain, or the final handler.
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// checkContentType returns an error if the request body isn't JSON encoded in UTF-8
+func checkContentType(r *http.Request) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return fmt.Errorf("%w: Content-Type header is required, expected application/json", errUnsupportedMediaType)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: unable to parse Content-Type: %v", errUnsupportedMediaType, err)
+	}
+	if mediaType != "application/json" {
+		return fmt.Errorf("%w: %v, expected application/json", errUnsupportedMediaType, mediaType)
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return fmt.Errorf("%w: charset %v, expected utf-8", errUnsupportedMediaType, charset)
+	}
+
+	return nil
+}
+
+// decodeError returns the error describing why the request body can't be decoded
+func decodeError(err error) error {
+	var (
+		maxBytesErr  *http.MaxBytesError
+		syntaxErr    *json.SyntaxError
+		typeErr      *json.UnmarshalTypeError
+		unknownField = "json: unknown field "
+	)
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return fmt.Errorf("%w: body must be at most %v bytes", errBodyTooLarge, maxBytesErr.Limit)
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%w: invalid JSON at position %v", errMalformedBody, syntaxErr.Offset)
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w: body is empty", errMalformedBody)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: body is truncated", errMalformedBody)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("%w: body must be %v", errMalformedBody, jsonType(typeErr.Type.Kind().String()))
+		}
+		return fmt.Errorf("%w: field %v must be %v, got %v", errMalformedBody, typeErr.Field, jsonType(typeErr.Type.Kind().String()), typeErr.Value)
+	case errors.Is(err, data.ErrTrailingData):
+		return fmt.Errorf("%w: body must contain a single JSON value", errMalformedBody)
+	case strings.HasPrefix(err.Error(), unknownField):
+		// encoding/json doesn't have a type for this error
+		return fmt.Errorf("%w: unknown field %v", errMalformedBody, strings.TrimPrefix(err.Error(), unknownField))
+	default:
+		return fmt.Errorf("%w: %v", errMalformedBody, err)
+	}
+}
+
+// jsonType returns the name of the JSON type the Go kind is decoded from
+func jsonType(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "an integer"
+	case strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "bool":
+		return "a boolean"
+	case kind == "string":
+		return "a string"
+	case kind == "slice", kind == "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
@@ -1,43 +1,202 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
+	"github.com/peyuaa/segmentify/auth"
 	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/lifecycle"
+	"github.com/peyuaa/segmentify/logging"
 )
 
+// ContentTypeProblem is a content type of the error responses, see RFC 7807
+const ContentTypeProblem = "application/problem+json"
+
+// problemTypePrefix is a prefix of the problem type URI, it's followed by the problem code
+const problemTypePrefix = "urn:segmentify:problem:"
+
 var (
-	// ErrInternalServer is an error message returned when something goes wrong
-	// that do not depend on the user input
-	// We don't want to expose the details of the error to the user, instead we log it
-	ErrInternalServer = &GenericError{Message: "Dont worry, we are working on it!"}
+	// errInvalidParameter is an error returned when a path, query or header parameter is incorrect
+	errInvalidParameter = errors.New("invalid parameter")
+
+	// errMalformedBody is an error returned when the request body can't be decoded
+	errMalformedBody = errors.New("malformed request body")
+
+	// errBodyTooLarge is an error returned when the request body is larger than MaxBodySize
+	errBodyTooLarge = errors.New("request body is too large")
+
+	// errUnsupportedMediaType is an error returned when the request body isn't JSON
+	errUnsupportedMediaType = errors.New("unsupported media type")
+
+	// errRouteNotFound is an error returned when there is no route for the request path
+	errRouteNotFound = errors.New("route not found")
+
+	// errMethodNotAllowed is an error returned when the route doesn't support the request method
+	errMethodNotAllowed = errors.New("method not allowed")
 )
 
-// GenericError is a generic error message returned by a server
-type GenericError struct {
+// Problem is an error returned by a server in application/problem+json format, see RFC 7807
+type Problem struct {
+	// URI identifying the problem type, e.g. urn:segmentify:problem:segment_not_found
+	Type string `json:"type"`
+
+	// short summary of the problem type
+	Title string `json:"title"`
+
+	// HTTP status of the response
+	Status int `json:"status"`
+
+	// explanation of this occurrence of the problem
+	Detail string `json:"detail,omitempty"`
+
+	// path of the request
+	Instance string `json:"instance,omitempty"`
+
+	// stable machine-readable code of the problem
+	Code string `json:"code"`
+
+	// id of the request, it's also returned in the X-Request-ID header
+	RequestID string `json:"request_id,omitempty"`
+
+	// validation errors of the request body fields or parameters
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a validation error of a request body field
+type FieldError struct {
+	// path to the field, e.g. add[0].slug
+	Field string `json:"field"`
+
+	// stable machine-readable code of the error, e.g. required
+	Code string `json:"code"`
+
+	// human-readable error message
 	Message string `json:"message"`
 }
 
-// ValidationError is a collection of validation error messages
-type ValidationError struct {
-	Messages []string `json:"messages"`
+// problemKind describes the problem type of the errors
+type problemKind struct {
+	err    error
+	status int
+	code   string
+	title  string
 }
 
-func (s *Segments) writeGenericError(rw http.ResponseWriter, status int, message string, err error) {
-	rw.WriteHeader(status)
-	err = fmt.Errorf("%v: %w", message, err)
-	err = data.ToJSON(&GenericError{Message: err.Error()}, rw)
-	if err != nil {
-		s.l.Error("Unable to serialize GenericError", "error", err)
+// problemKinds maps the errors to the problem types, the first matching kind is used
+var problemKinds = []problemKind{
+	{data.ErrSegmentNotFound, http.StatusNotFound, "segment_not_found", "Segment not found"},
+	{data.ErrSegmentDeleted, http.StatusBadRequest, "segment_deleted", "Segment is deleted"},
+	{data.ErrSegmentAlreadyExists, http.StatusConflict, "segment_already_exists", "Segment already exists"},
+	{data.ErrIncorrectChangeUserSegmentsRequest, http.StatusBadRequest, "invalid_user_segments_change", "Incorrect change of user segments"},
+	{data.ErrNoUserData, http.StatusNotFound, "user_not_found", "User has no segments"},
+	{data.ErrNoUserHistoryData, http.StatusNotFound, "user_history_not_found", "User has no history for the period"},
+	{data.ErrPreconditionFailed, http.StatusPreconditionFailed, "precondition_failed", "Resource was changed"},
+	{data.ErrAPIKeyNotFound, http.StatusNotFound, "api_key_not_found", "API key not found"},
+	{data.ErrInvalidAuditLimit, http.StatusBadRequest, "invalid_parameter", "Invalid parameter"},
+	{data.ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency key reused"},
+	{data.ErrIdempotencyKeyInProgress, http.StatusConflict, "idempotency_key_in_progress", "Request with the idempotency key is in progress"},
+	{data.ErrInvalidAPIKey, http.StatusUnauthorized, "invalid_credentials", "Invalid credentials"},
+	{auth.ErrInvalidToken, http.StatusUnauthorized, "invalid_credentials", "Invalid credentials"},
+	{errNoAPIKey, http.StatusUnauthorized, "unauthenticated", "Authentication required"},
+	{errForbidden, http.StatusForbidden, "forbidden", "Operation is forbidden"},
+	{errSegmentForbidden, http.StatusForbidden, "segment_forbidden", "Segment is forbidden"},
+	{errSetSegmentsRestricted, http.StatusForbidden, "segment_forbidden", "Segment is forbidden"},
+	{lifecycle.ErrUnknownWorker, http.StatusNotFound, "worker_not_found", "Worker not found"},
+	{lifecycle.ErrNotPeriodic, http.StatusConflict, "worker_not_periodic", "Worker isn't periodic"},
+	{logging.ErrUnknownLevel, http.StatusUnprocessableEntity, "invalid_log_level", "Unknown log level"},
+	{errTooManyRequests, http.StatusTooManyRequests, "rate_limited", "Too many requests"},
+	{errInvalidParameter, http.StatusBadRequest, "invalid_parameter", "Invalid parameter"},
+	{errMalformedBody, http.StatusBadRequest, "malformed_body", "Malformed request body"},
+	{errBodyTooLarge, http.StatusRequestEntityTooLarge, "body_too_large", "Request body is too large"},
+	{errUnsupportedMediaType, http.StatusUnsupportedMediaType, "unsupported_media_type", "Unsupported media type"},
+	{errRouteNotFound, http.StatusNotFound, "not_found", "Not found"},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed"},
+}
+
+// validationProblem is a problem type of the validation errors of the request body fields
+var validationProblem = problemKind{nil, http.StatusUnprocessableEntity, "validation_failed", "Request validation failed"}
+
+// internalProblem is a problem type of the errors unknown to problemKinds
+// The details of such errors are only logged, they may contain internal information
+var internalProblem = problemKind{nil, http.StatusInternalServerError, "internal_error", "Internal server error"}
+
+// NotFound writes the problem for the requests without a route
+func (s *Segments) NotFound(rw http.ResponseWriter, r *http.Request) {
+	s.writeError(rw, r, fmt.Errorf("%w: %v", errRouteNotFound, r.URL.Path))
+}
+
+// MethodNotAllowed writes the problem for the requests with a method the route doesn't support
+func (s *Segments) MethodNotAllowed(rw http.ResponseWriter, r *http.Request) {
+	s.writeError(rw, r, fmt.Errorf("%w: %v", errMethodNotAllowed, r.Method))
+}
+
+// writeError writes the problem describing the error
+// Unknown errors are logged and reported as internal server errors without details
+func (s *Segments) writeError(rw http.ResponseWriter, r *http.Request, err error) {
+	kind := problemKindOf(err)
+
+	p := s.newProblem(r, kind)
+	if kind.status == http.StatusInternalServerError {
+		s.logger(r).Error("Internal server error", "error", err, "path", r.URL.Path)
+	} else {
+		p.Detail = err.Error()
 	}
+
+	s.writeProblem(rw, r, p)
 }
 
-func (s *Segments) writeInternalServerError(rw http.ResponseWriter, logMessage string, err error) {
-	s.l.Error(logMessage, "error", err)
-	rw.WriteHeader(http.StatusInternalServerError)
-	err = data.ToJSON(ErrInternalServer, rw)
+// problemKindOf returns the first problem kind matching the error, internalProblem if there is no such kind
+func problemKindOf(err error) problemKind {
+	for _, k := range problemKinds {
+		if errors.Is(err, k.err) {
+			return k
+		}
+	}
+
+	return internalProblem
+}
+
+// writeValidationError writes the problem describing the validation errors of the request body fields
+func (s *Segments) writeValidationError(rw http.ResponseWriter, r *http.Request, errs data.ValidationErrors) {
+	p := s.newProblem(r, validationProblem)
+	p.Detail = "request body contains incorrect fields"
+	p.Errors = make([]FieldError, len(errs))
+	for i, err := range errs {
+		p.Errors[i] = FieldError{
+			Field:   err.Path(),
+			Code:    err.Tag(),
+			Message: err.Message(),
+		}
+	}
+
+	s.writeProblem(rw, r, p)
+}
+
+// newProblem returns the problem of the kind for the request
+func (s *Segments) newProblem(r *http.Request, kind problemKind) Problem {
+	return Problem{
+		Type:      problemTypePrefix + kind.code,
+		Title:     kind.title,
+		Status:    kind.status,
+		Instance:  r.URL.Path,
+		Code:      kind.code,
+		RequestID: requestID(r),
+	}
+}
+
+// writeProblem writes the problem to the response
+func (s *Segments) writeProblem(rw http.ResponseWriter, r *http.Request, p Problem) {
+	rw.Header().Set("Content-Type", ContentTypeProblem)
+	rw.WriteHeader(p.Status)
+	err := data.ToJSON(p, rw)
 	if err != nil {
-		s.l.Error("Unable to serialize GenericError", "error", err)
+		s.logger(r).Error("Unable to serialize Problem", "error", err)
 	}
 }
+
+// invalidParameter returns the error describing why the parameter is incorrect, it's reported with 400 status
+func invalidParameter(err error) error {
+	return fmt.Errorf("%w: %v", errInvalidParameter, err)
+}
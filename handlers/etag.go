@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/peyuaa/segmentify/data"
+)
+
+// ifMatch returns the entity tags of the If-Match header, nil if there is no header
+func ifMatch(r *http.Request) []string {
+	return etagList(r.Header.Values("If-Match"))
+}
+
+// notModified sets the ETag header and writes 304 Not Modified if the If-None-Match header matches etag
+// Returns true if the response is written
+func notModified(rw http.ResponseWriter, r *http.Request, etag string) bool {
+	rw.Header().Set("ETag", etag)
+
+	tags := etagList(r.Header.Values("If-None-Match"))
+	if tags == nil || !data.ETagMatches(etag, tags, true) {
+		return false
+	}
+
+	rw.Header().Del("Content-Type")
+	rw.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagList returns the entity tags of the headers, nil if there are no headers
+func etagList(headers []string) []string {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	tags := []string{}
+	for _, header := range headers {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
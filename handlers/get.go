@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -18,59 +17,31 @@ const (
 	MaxUserID = 2147483647
 )
 
-// swagger:route GET /segments segments listSegments
-// Returns a list of all segments from the database, deleted segments are included
-//
-// Produces:
-// - application/json
-//
-// Schemes: http
-//
-// Responses:
-// 	200: segmentsResponse
-// 	500: errorResponse
-
 // GetSegments returns the active segments from the database
 func (s *Segments) GetSegments(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Add("Content-Type", "application/json")
 
 	segments, err := s.d.GetSegments(r.Context())
 	if err != nil {
-		s.l.Error("Unable to get segments", "error", err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		err = data.ToJSON(&GenericError{Message: err.Error()}, rw)
-		if err != nil {
-			s.l.Error("Unable to marshal json", "error", err)
-		}
+		s.writeError(rw, r, err)
+		return
+	}
+
+	etag, err := data.ETag(segments)
+	if err != nil {
+		s.writeError(rw, r, err)
+		return
+	}
+	if notModified(rw, r, etag) {
 		return
 	}
 
 	err = data.ToJSON(segments, rw)
 	if err != nil {
-		s.l.Error("Unable to marshal json", "error", err)
+		s.logger(r).Error("Unable to marshal json", "error", err)
 	}
 }
 
-// swagger:route GET /segments/{Slug} segments getSegmentBySlug
-// Returns a segment from the database by slug
-//
-// Produces:
-// - application/json
-//
-// Schemes: http
-//
-// Parameters:
-// 	+ name: Slug
-// 	  in: path
-// 	  description: slug of the segment
-// 	  required: true
-// 	  type: string
-//
-// Responses:
-// 	200: segmentResponse
-// 	404: errorResponse
-// 	500: errorResponse
-
 // GetBySlug returns a segment from the database by slug
 func (s *Segments) GetBySlug(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Add("Content-Type", "application/json")
@@ -78,138 +49,77 @@ func (s *Segments) GetBySlug(rw http.ResponseWriter, r *http.Request) {
 	slug := s.getSlug(r)
 
 	segment, err := s.d.GetSegmentBySlug(r.Context(), slug)
+	if err != nil {
+		s.writeError(rw, r, err)
+		return
+	}
 
-	switch {
-	case err == nil:
-	case errors.Is(err, data.ErrSegmentNotFound):
-		rw.WriteHeader(http.StatusNotFound)
-		err = data.ToJSON(&GenericError{Message: err.Error()}, rw)
-		if err != nil {
-			s.l.Error("Unable to marshal json", "error", err)
-		}
+	etag, err := data.ETag(segment)
+	if err != nil {
+		s.writeError(rw, r, err)
 		return
-	default:
-		rw.WriteHeader(http.StatusInternalServerError)
-		err = data.ToJSON(&GenericError{Message: err.Error()}, rw)
-		if err != nil {
-			s.l.Error("Unable to marshal json", "error", err)
-		}
+	}
+	if notModified(rw, r, etag) {
 		return
 	}
 
 	err = data.ToJSON(segment, rw)
 	if err != nil {
-		s.l.Error("Unable to marshal json", "error", err)
+		s.logger(r).Error("Unable to marshal json", "error", err)
 	}
 }
 
-// swagger:route GET /segments/users/{id} segments getActiveSegmentsForUser
-// Returns a list of active segments for the user
-//
-// Produces:
-// - application/json
-//
-// Schemes: http
-//
-// Parameters:
-// 	+ name: id
-// 	  in: path
-// 	  description: user id
-// 	  required: true
-// 	  type: integer
-//
-// Responses:
-// 	200: segmentsResponse
-//	400: errorResponse
-// 	404: errorResponse
-// 	500: errorResponse
-
 // GetActiveSegments returns the active segments for the user
 func (s *Segments) GetActiveSegments(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Add("Content-Type", "application/json")
 
 	id, err := s.getUserId(r)
 	if err != nil {
-		s.writeGenericError(rw, http.StatusBadRequest, "", err)
+		s.writeError(rw, r, invalidParameter(err))
 		return
 	}
 
-	segments, err := s.d.GetUsersSegments(r.Context(), id)
+	segments, etag, err := s.d.GetUsersSegments(r.Context(), id)
 	if err != nil {
-		if errors.Is(err, data.ErrNoUserData) {
-			s.writeGenericError(rw, http.StatusNotFound, "userID="+strconv.Itoa(id), err)
-			return
-		}
-		s.writeInternalServerError(rw, "unable to get user's segments", err)
+		s.writeError(rw, r, fmt.Errorf("userID=%v: %w", id, err))
+		return
+	}
+
+	if notModified(rw, r, etag) {
 		return
 	}
 
 	err = data.ToJSON(segments, rw)
 	if err != nil {
-		s.writeInternalServerError(rw, "unable to marshal json", err)
+		s.logger(r).Error("Unable to marshal json", "error", err)
 	}
 }
 
-// swagger:route GET /segments/users/{id}/history segments getUserHistory
-// Returns a link to the user's segments history for the specified period
-//
-// Produces:
-// - application/json
-//
-// Schemes: http
-//
-// Parameters:
-// 	+ name: id
-// 	  in: path
-// 	  description: user id
-// 	  required: true
-// 	  type: integer
-// 	+ name: from
-// 	  in: query
-// 	  description: start of the period. Format: YYYY-MM-DD
-//	  required: true
-// 	  type: string
-// 	+ name: to
-// 	  in: query
-// 	  description: end of the period. Format: YYYY-MM-DD
-// 	  required: true
-// 	  type: string
-//
-// Responses:
-// 	200: userHistoryResponse
-// 	400: errorResponse
-//	404: errorResponse
-// 	500: errorResponse
-
 // UserHistory returns the user's segments history for the specified period
 func (s *Segments) UserHistory(rw http.ResponseWriter, r *http.Request) {
 	userID, err := s.getUserId(r)
 	if err != nil {
-		s.writeGenericError(rw, http.StatusBadRequest, "", err)
+		s.writeError(rw, r, invalidParameter(err))
 		return
 	}
 
 	from, to, err := s.getFromTo(r)
 	if err != nil {
-		s.writeGenericError(rw, http.StatusBadRequest, "unable to parse time", err)
+		s.writeError(rw, r, invalidParameter(err))
 		return
 	}
 
 	file, err := s.d.GetUserHistory(r.Context(), userID, from, to)
 	if err != nil {
-		if errors.Is(err, data.ErrNoUserHistoryData) {
-			s.writeGenericError(rw, http.StatusNotFound, "userID="+strconv.Itoa(userID), err)
-			return
-		}
-		s.writeInternalServerError(rw, "unable to get user's segments history", err)
+		s.writeError(rw, r, fmt.Errorf("userID=%v: %w", userID, err))
 		return
 	}
 
 	// create url for the link
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: requestScheme(r),
 		Host:   r.Host,
-		Path:   file,
+		Path:   APIPrefix + "/history/" + file,
 	}
 
 	history := models.UserHistoryResponse{
@@ -218,7 +128,7 @@ func (s *Segments) UserHistory(rw http.ResponseWriter, r *http.Request) {
 
 	err = data.ToJSON(history, rw)
 	if err != nil {
-		s.writeInternalServerError(rw, "unable to marshal json", err)
+		s.logger(r).Error("Unable to marshal json", "error", err)
 	}
 }
 
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/health"
+)
+
+// Healthz returns a handler which reports that the process is alive, it's used by liveness probes
+func (s *Segments) Healthz(h *health.Health) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		s.writeHealth(rw, r, h.Live())
+	}
+}
+
+// Readyz returns a handler which reports the status of the components needed to handle the requests:
+// database, its schema and background workers, it's used by readiness probes
+// The status is 503 if any of the components is down or the service is shutting down
+func (s *Segments) Readyz(h *health.Health) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		report := h.Ready(r.Context())
+		// the probes get the fixed messages, the errors of the checks may reveal the internals
+		for name, c := range report.Components {
+			if c.Status != health.StatusUp {
+				s.logger(r).Warn("Component isn't ready", "component", name, "error", c.Cause)
+			}
+		}
+
+		s.writeHealth(rw, r, report)
+	}
+}
+
+// writeHealth writes the report, the status is 503 if the report isn't up
+func (s *Segments) writeHealth(rw http.ResponseWriter, r *http.Request, report health.Report) {
+	status := http.StatusOK
+	if report.Status != health.StatusUp {
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	err := data.ToJSON(report, rw)
+	if err != nil {
+		s.logger(r).Error("Unable to marshal json", "error", err)
+	}
+}
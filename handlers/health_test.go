@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/peyuaa/segmentify/health"
+)
+
+func TestReadyzHidesCheckErrors(t *testing.T) {
+	var logs bytes.Buffer
+	s := NewSegments(log.New(&logs), nil, nil, nil)
+
+	h := health.New(time.Second)
+	h.Add("database", func(context.Context) error {
+		return errors.New("dial tcp 10.1.2.3:5432: connection refused")
+	})
+
+	rw := httptest.NewRecorder()
+	s.Readyz(h).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %v, want %v", rw.Code, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(rw.Body.String(), "10.1.2.3") || !strings.Contains(rw.Body.String(), health.MessageCheckFailed) {
+		t.Errorf("body = %v, want fixed message without the error", rw.Body.String())
+	}
+	if !strings.Contains(logs.String(), "10.1.2.3") {
+		t.Errorf("logs = %v, want the error of the check", logs.String())
+	}
+}
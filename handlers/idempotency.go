@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// HeaderIdempotencyKey is a header with the key identifying the request, retries must have the same key
+	HeaderIdempotencyKey = "Idempotency-Key"
+
+	// HeaderIdempotentReplayed is a header set to true when the stored response to the first request is returned
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// responseRecorder is a http.ResponseWriter that remembers the status and the body of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader remembers the status and writes it to the underlying writer
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// Write remembers the data and writes it to the underlying writer
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// MiddlewareIdempotency returns a middleware which makes POST and DELETE requests with the Idempotency-Key header idempotent
+// The response to the first request is stored for ttl and returned for the retries with the same key,
+// method, route, path variables and body. Reuse of the key for a different request is rejected with 422.
+// Responses with 5xx statuses aren't stored, so the request can be retried. Responses with Cache-Control: no-store
+// contain secrets, e.g. created API keys, they aren't stored either and the retry is handled as a new request.
+// It must be used after MiddlewareAuthenticate, the keys of different callers don't collide
+func (s *Segments) MiddlewareIdempotency(ttl time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(HeaderIdempotencyKey)
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			if len(key) > maxIdempotencyKeyLength {
+				s.writeError(rw, r, invalidParameter(fmt.Errorf("header %v is longer than %v bytes", HeaderIdempotencyKey, maxIdempotencyKeyLength)))
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, MaxBodySize))
+			if err != nil {
+				s.writeError(rw, r, decodeError(err))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// the keys are scoped by the identity of the caller, the names of the API keys and the subjects of the tokens
+			// of different issuers may be the same
+			principal, _ := r.Context().Value(KeyPrincipal{}).(models.Principal)
+			scope := principal.ID
+			digest := requestDigest(r, body)
+
+			stored, err := s.d.ClaimIdempotencyKey(r.Context(), scope, key, digest, ttl)
+			if err != nil {
+				s.writeError(rw, r, err)
+				return
+			}
+
+			if stored != nil {
+				s.logger(r).Debug("Replaying stored response", "principal", scope, "key", key, "status", stored.Status)
+				for name, values := range stored.Header {
+					rw.Header()[name] = values
+				}
+				// the replay is a different request, its id is used to find its logs
+				rw.Header().Set(HeaderRequestID, requestID(r))
+				rw.Header().Set(HeaderIdempotentReplayed, "true")
+				rw.WriteHeader(stored.Status)
+				_, err = rw.Write(stored.Body)
+				if err != nil {
+					s.logger(r).Error("Unable to write stored response", "error", err)
+				}
+				return
+			}
+
+			rr := &responseRecorder{ResponseWriter: rw}
+			next.ServeHTTP(rr, r)
+			if rr.status == 0 {
+				rr.status = http.StatusOK
+			}
+
+			// the result must be stored even if the client has gone away, it's going to retry
+			ctx := context.WithoutCancel(r.Context())
+			if !storableResponse(rr.status, rw.Header()) {
+				err = s.d.ReleaseIdempotencyKey(ctx, scope, key)
+				if err != nil {
+					s.logger(r).Error("Unable to release idempotency key", "error", err)
+				}
+				return
+			}
+
+			err = s.d.SaveIdempotentResponse(ctx, scope, key, models.IdempotentResponse{
+				Status: rr.status,
+				Header: rw.Header().Clone(),
+				Body:   rr.body.Bytes(),
+			})
+			if err != nil {
+				s.logger(r).Error("Unable to save idempotent response", "error", err)
+			}
+		})
+	}
+}
+
+// storableResponse reports whether the response can be stored for the retries
+// The failed requests must be retried and the secrets mustn't be written to the database
+func storableResponse(status int, header http.Header) bool {
+	if status >= http.StatusInternalServerError {
+		return false
+	}
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestDigest returns hex-encoded SHA-256 hash of the request method, route, path variables and body
+// The route template is normalized, so the retry of the request to the deprecated alias of the route matches it
+func requestDigest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + currentRoute(r) + "\n"))
+
+	vars := mux.Vars(r)
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name + "=" + vars[name] + "\n"))
+	}
+
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// currentRoute returns the normalized template of the route matched by the router, or the path if it's unknown
+func currentRoute(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.Path
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return r.URL.Path
+	}
+
+	return normalizeRoute(template)
+}
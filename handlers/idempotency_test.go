@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/db"
+	"github.com/peyuaa/segmentify/models"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+func TestStorableResponse(t *testing.T) {
+	tests := []struct {
+		status       int
+		cacheControl string
+		want         bool
+	}{
+		{http.StatusCreated, "", true},
+		{http.StatusNotFound, "", true},
+		{http.StatusOK, "private, max-age=60", true},
+		{http.StatusInternalServerError, "", false},
+		{http.StatusServiceUnavailable, "", false},
+		{http.StatusCreated, "no-store", false},
+		{http.StatusCreated, "private, No-Store", false},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.cacheControl != "" {
+			header.Set("Cache-Control", tt.cacheControl)
+		}
+		if got := storableResponse(tt.status, header); got != tt.want {
+			t.Errorf("storableResponse(%v, %q) = %v, want %v", tt.status, tt.cacheControl, got, tt.want)
+		}
+	}
+}
+
+// TestIdempotencyDoesNotStoreAPIKeys checks that the created API key isn't written to the stored responses,
+// it uses the database from DB_CONNECTION_STRING and is skipped if the variable isn't set
+func TestIdempotencyDoesNotStoreAPIKeys(t *testing.T) {
+	connectionString := os.Getenv("DB_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("DB_CONNECTION_STRING isn't set, skipping integration test")
+	}
+
+	l := log.New(io.Discard)
+	ctx := context.Background()
+	conn, err := db.Connect(ctx, l, connectionString, db.ConnectOptions{Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("unable to connect to database: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	p := db.New(l, conn, 30*time.Second)
+	_, err = p.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("unable to migrate database, db/init.sql must be applied: %v", err)
+	}
+
+	s := NewSegments(l, data.NewValidation(), data.New(l, p, t.TempDir()), nil)
+	h := s.MiddlewareIdempotency(time.Hour)(http.HandlerFunc(s.CreateAPIKey))
+
+	principal := models.Principal{ID: fmt.Sprintf("key:IT_%d", rand.Int63()), Name: "integration-test", Role: data.RoleAdmin}
+	key := fmt.Sprintf("IT_%d", rand.Int63())
+	create := func() (int, models.CreateAPIKeyResponse) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/admin/api-keys", nil)
+		r.Header.Set(HeaderIdempotencyKey, key)
+		r = r.WithContext(context.WithValue(r.Context(), KeyPrincipal{}, principal))
+		r = r.WithContext(context.WithValue(r.Context(), KeyCreateAPIKey{}, models.CreateAPIKeyRequest{Name: key, Role: data.RoleReader}))
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+
+		var response models.CreateAPIKeyResponse
+		err := json.Unmarshal(rw.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("unable to unmarshal response %q: %v", rw.Body.String(), err)
+		}
+		if rw.Header().Get(HeaderIdempotentReplayed) != "" {
+			t.Errorf("response with the API key is replayed")
+		}
+		return rw.Code, response
+	}
+
+	for i := 0; i < 2; i++ {
+		status, response := create()
+		if status != http.StatusCreated {
+			t.Fatalf("request %v: status = %v, want %v", i, status, http.StatusCreated)
+		}
+		t.Cleanup(func() { _ = s.d.RevokeAPIKey(ctx, response.ID) })
+
+		var stored int
+		err = conn.QueryRowContext(ctx,
+			"SELECT count(*) FROM idempotency_keys WHERE principal = $1 AND position(convert_to($2, 'UTF8') IN response_body) > 0",
+			principal.ID, response.Key).Scan(&stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != 0 {
+			t.Errorf("request %v: plaintext API key is stored in %v responses", i, stored)
+		}
+	}
+}
+
+func TestRequestDigestOfVersionedAndLegacyRoutes(t *testing.T) {
+	digests := map[string]string{}
+	router := mux.NewRouter()
+	handler := func(rw http.ResponseWriter, r *http.Request) {
+		digests[r.URL.Path] = requestDigest(r, []byte(`{"slug":"TEST"}`))
+	}
+	router.HandleFunc(APIPrefix+"/segments/{slug:[a-zA-Z_0-9]+}", handler)
+	router.HandleFunc("/segments/{slug:[a-zA-Z_0-9]+}", handler)
+
+	for _, path := range []string{"/v1/segments/A", "/segments/A", "/v1/segments/B"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, path, nil))
+	}
+
+	// the retry to the deprecated alias is the same request, the other segment isn't
+	if digests["/v1/segments/A"] != digests["/segments/A"] {
+		t.Errorf("digests of versioned and legacy routes differ")
+	}
+	if digests["/v1/segments/A"] == digests["/v1/segments/B"] {
+		t.Errorf("digests of requests with different path variables are the same")
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/peyuaa/segmentify/metrics"
+	"github.com/peyuaa/segmentify/openapi"
+
+	"github.com/gorilla/mux"
+)
+
+// routeUnmatched is a route label of the requests without a route
+const routeUnmatched = "unmatched"
+
+// KeyRoute is a key used for the normalized route template of the request in the context
+type KeyRoute struct{}
+
+// MiddlewareRoute returns a middleware which matches the request against the router once and stores
+// the normalized route template in the context for the metrics, the access log and the tracing
+// It must be used in front of them
+func (s *Segments) MiddlewareRoute(router *mux.Router) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			route := matchRoute(router, r)
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), KeyRoute{}, route)))
+		})
+	}
+}
+
+// MiddlewareMetrics returns a middleware which records the number and the duration of the requests
+// by method, route template from MiddlewareRoute and status
+// It's used in front of the router, so the requests rejected before routing are recorded too
+func (s *Segments) MiddlewareMetrics(m *metrics.HTTP) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			sr := &statusRecorder{ResponseWriter: rw}
+			next.ServeHTTP(sr, r)
+			if sr.status == 0 {
+				sr.status = http.StatusOK
+			}
+
+			m.Observe(r.Method, routeTemplate(r), sr.status, time.Since(start))
+		})
+	}
+}
+
+// routeTemplate returns the normalized route template of the request stored by MiddlewareRoute
+func routeTemplate(r *http.Request) string {
+	if route, ok := r.Context().Value(KeyRoute{}).(string); ok {
+		return route
+	}
+
+	return routeUnmatched
+}
+
+// matchRoute returns the normalized path template of the route of the router matching the request
+// The label must have a bounded number of values, so the paths themselves are never returned
+func matchRoute(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.MatchErr != nil || match.Route == nil {
+		return routeUnmatched
+	}
+
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return routeUnmatched
+	}
+
+	return normalizeRoute(template)
+}
+
+// normalizeRoute returns the path template without the patterns of the variables and the version prefix,
+// so the versioned routes and their deprecated aliases are the same, e.g. /v1/segments/{slug:[a-z]+} is /segments/{slug}
+func normalizeRoute(template string) string {
+	template = openapi.PathTemplate(template)
+
+	unversioned := strings.TrimPrefix(template, APIPrefix)
+	if unversioned != template && strings.HasPrefix(unversioned, "/") {
+		return unversioned
+	}
+
+	return template
+}
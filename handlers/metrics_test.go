@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNormalizeRoute(t *testing.T) {
+	for template, want := range map[string]string{
+		"/v1/segments/{slug:[a-zA-Z_0-9]+}":              "/segments/{slug}",
+		"/segments/{slug:[a-zA-Z_0-9]+}":                 "/segments/{slug}",
+		"/v1/segments/users/{id:[0-9]+}":                 "/segments/users/{id}",
+		"/v1/segments":                                   "/segments",
+		"/v1/openapi.yaml":                               "/openapi.yaml",
+		"/segments/{slug}":                               "/segments/{slug}",
+		"/v10/segments":                                  "/v10/segments",
+		"/workers/{name:[a-z_]+}/pause":                  "/workers/{name}/pause",
+		"/v1/admin/api-keys/{id:[0-9]+}/{action:[a-z]+}": "/admin/api-keys/{id}/{action}",
+	} {
+		got := normalizeRoute(template)
+		if got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+func TestRouteTemplate(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc(APIPrefix+"/segments/{slug:[a-zA-Z_0-9]+}", func(http.ResponseWriter, *http.Request) {})
+	router.HandleFunc("/segments/{slug:[a-zA-Z_0-9]+}", func(http.ResponseWriter, *http.Request) {})
+
+	var got string
+	h := newTestSegments().MiddlewareRoute(router)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = routeTemplate(r)
+	}))
+
+	for path, want := range map[string]string{
+		"/v1/segments/AVITO_VOICE_MESSAGES": "/segments/{slug}",
+		"/segments/AVITO_VOICE_MESSAGES":    "/segments/{slug}",
+		"/v1/unknown":                       routeUnmatched,
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if got != want {
+			t.Errorf("route of %v = %q, want %q", path, got, want)
+		}
+	}
+
+	// the requests which haven't passed MiddlewareRoute have no route
+	if got := routeTemplate(httptest.NewRequest(http.MethodGet, "/v1/segments/A", nil)); got != routeUnmatched {
+		t.Errorf("route without middleware = %q, want %q", got, routeUnmatched)
+	}
+}
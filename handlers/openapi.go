@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/peyuaa/segmentify/openapi"
+
+	"github.com/gorilla/mux"
+)
+
+// MiddlewareOpenAPI returns a middleware which validates the requests against the OpenAPI document and calls next if ok
+// Requests with incorrect parameters are rejected with 400, requests with incorrect body with 422.
+// If validateResponses is set, the responses are validated too and their violations are logged,
+// it's meant for tests: the responses are written to the client as they are and a copy of the body is validated
+// after the handler returns, so the violations are only logged and never change the response
+func (s *Segments) MiddlewareOpenAPI(v *openapi.Validator, validateResponses bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			template, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			op := v.Operation(r.Method, template)
+			if op == nil {
+				// e.g. the files of the history, they aren't validated
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			violations := op.ValidateParams(r, mux.Vars(r))
+			if len(violations) != 0 {
+				s.writeViolations(rw, r, errInvalidParameter, violations)
+				return
+			}
+
+			if r.Body != nil && r.Body != http.NoBody {
+				body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, MaxBodySize))
+				if err != nil {
+					s.writeError(rw, r, decodeError(err))
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+
+				violations = op.ValidateBody(r.Header.Get("Content-Type"), body)
+				if len(violations) != 0 {
+					s.writeViolations(rw, r, nil, violations)
+					return
+				}
+			}
+
+			if !validateResponses {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			rr := &responseRecorder{ResponseWriter: rw}
+			next.ServeHTTP(rr, r)
+			if rr.status == 0 {
+				rr.status = http.StatusOK
+			}
+
+			for _, violation := range op.ValidateResponse(rr.status, rw.Header().Get("Content-Type"), rr.body.Bytes()) {
+				s.logger(r).Error("Response violates OpenAPI document",
+					"operation", op.ID,
+					"status", rr.status,
+					"field", violation.Field,
+					"code", violation.Code,
+					"violation", violation.Message,
+					"request_id", requestID(r),
+				)
+			}
+		})
+	}
+}
+
+// writeViolations writes the problem describing the violations of the OpenAPI document
+// The problem is of the kind of err, the violations of the body are reported as validation errors if err is nil
+func (s *Segments) writeViolations(rw http.ResponseWriter, r *http.Request, err error, violations []openapi.Violation) {
+	kind := validationProblem
+	detail := "request body contains incorrect fields"
+	if err != nil {
+		kind = problemKindOf(err)
+		messages := make([]string, len(violations))
+		for i, v := range violations {
+			messages[i] = v.Message
+		}
+		detail = fmt.Sprintf("%v: %v", err, strings.Join(messages, "; "))
+	}
+
+	p := s.newProblem(r, kind)
+	p.Detail = detail
+	p.Errors = make([]FieldError, len(violations))
+	for i, v := range violations {
+		p.Errors[i] = FieldError{
+			Field:   v.Field,
+			Code:    v.Code,
+			Message: v.Message,
+		}
+	}
+
+	s.writeProblem(rw, r, p)
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/models"
+)
+
+// SetUsersSegments replaces the segments of a user
+// The difference between the current and the desired segments is computed by the server,
+// so the caller doesn't need to know which segments the user already has
+// If dry_run is set, the changes are only computed and returned
+func (s *Segments) SetUsersSegments(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+
+	userID, err := s.getUserId(r)
+	if err != nil {
+		s.writeError(rw, r, invalidParameter(err))
+		return
+	}
+
+	// the request removes all the segments which are not listed, including the ones the caller isn't allowed to change
+	if s.isRestricted(r) {
+		s.writeError(rw, r, errSetSegmentsRestricted)
+		return
+	}
+
+	// fetch the desired user segments from the context
+	userSegments := r.Context().Value(KeySetUserSegments{}).(models.SetUserSegmentsRequest)
+
+	change, err := s.d.SetUserSegments(r.Context(), userID, userSegments.Segments, userSegments.DryRun, changeMeta(r), ifMatch(r))
+	if err != nil {
+		s.writeError(rw, r, err)
+		return
+	}
+
+	rw.Header().Set("ETag", change.ETag)
+	err = data.ToJSON(change, rw)
+	if err != nil {
+		s.logger(r).Error("Unable to serialize models.UserSegmentsChange", "error", err)
+	}
+}
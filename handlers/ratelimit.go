@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/ratelimit"
+
+	"github.com/gorilla/mux"
+)
+
+// errTooManyRequests is an error returned when the client exceeded its rate limit
+var errTooManyRequests = errors.New("rate limit exceeded, retry later")
+
+// operationalPaths are the paths of the metrics and the probes, they're requested often by Prometheus
+// and the orchestrators from the same addresses and aren't limited
+var operationalPaths = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// MiddlewareRateLimitAnonymous returns a middleware which limits the requests of the clients which aren't authenticated
+// by their IP address, it's used in front of the router.
+// The requests without credentials take a token from the bucket of the IP address, the requests with credentials
+// are limited by MiddlewareRateLimit after the authentication, but the failed authentications take a token too.
+// So the requests with made-up credentials are rejected before they reach the database once the address exhausts its limit.
+// The metrics and the probes aren't limited
+func (s *Segments) MiddlewareRateLimitAnonymous(rl *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if operationalPaths[r.URL.Path] {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			group := rateLimitGroup(r)
+			client := "ip:" + clientAddress(r)
+
+			if credentials, _ := credentialsFromRequest(r); credentials == "" {
+				if ok, wait := rl.Allow(group, client); !ok {
+					s.writeRateLimited(rw, r, group, client, wait)
+					return
+				}
+
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			if limited, wait := rl.Limited(group, client); limited {
+				s.writeRateLimited(rw, r, group, client, wait)
+				return
+			}
+
+			sr := &statusRecorder{ResponseWriter: rw}
+			next.ServeHTTP(sr, r)
+			if sr.status == http.StatusUnauthorized {
+				rl.Allow(group, client)
+			}
+		})
+	}
+}
+
+// MiddlewareRateLimit returns a middleware which calls next only if the authenticated caller hasn't exceeded its rate limit
+// The callers are identified by the id of the API key or the issuer and the subject of the token,
+// so the callers behind the same address don't share the limit. It must be used after MiddlewareAuthenticate
+func (s *Segments) MiddlewareRateLimit(rl *ratelimit.Limiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			principal, ok := r.Context().Value(KeyPrincipal{}).(models.Principal)
+			if !ok {
+				rw.Header().Set("WWW-Authenticate", "Bearer")
+				s.writeError(rw, r, errNoAPIKey)
+				return
+			}
+
+			group := rateLimitGroup(r)
+			client := "principal:" + principal.ID
+			if ok, wait := rl.Allow(group, client); !ok {
+				s.writeRateLimited(rw, r, group, client, wait)
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// rateLimitGroup returns the group of the request: GET, HEAD and OPTIONS requests are reads, the others are writes
+func rateLimitGroup(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ratelimit.GroupRead
+	default:
+		return ratelimit.GroupWrite
+	}
+}
+
+// writeRateLimited writes 429 response with Retry-After header
+func (s *Segments) writeRateLimited(rw http.ResponseWriter, r *http.Request, group, client string, wait time.Duration) {
+	s.logger(r).Warn("Rate limit exceeded", "client", client, "group", group, "path", r.URL.Path)
+
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	s.writeError(rw, r, fmt.Errorf("%v requests: %w", group, errTooManyRequests))
+}
+
+// GetRateLimits returns a handler which shows the rate limits and the state of the clients
+func (s *Segments) GetRateLimits(rl *ratelimit.Limiter) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("Content-Type", "application/json")
+
+		err := data.ToJSON(rl.Status(), rw)
+		if err != nil {
+			s.logger(r).Error("Unable to marshal json", "error", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/peyuaa/segmentify/models"
+	"github.com/peyuaa/segmentify/ratelimit"
+
+	"github.com/charmbracelet/log"
+)
+
+func newTestSegments() *Segments {
+	return NewSegments(log.New(io.Discard), nil, nil, nil)
+}
+
+// newTestLimiter allows burst requests of every group and then nothing for a long time
+func newTestLimiter(burst int) *ratelimit.Limiter {
+	limit := ratelimit.Limit{Rate: 0.001, Burst: burst}
+	return ratelimit.New(map[string]ratelimit.Limit{ratelimit.GroupRead: limit, ratelimit.GroupWrite: limit})
+}
+
+func newRequest(remoteAddr string, apiKey string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/segments", nil)
+	r.RemoteAddr = remoteAddr
+	if apiKey != "" {
+		r.Header.Set(HeaderAPIKey, apiKey)
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) int {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw.Code
+}
+
+func TestRateLimitAnonymousByAddress(t *testing.T) {
+	h := newTestSegments().MiddlewareRateLimitAnonymous(newTestLimiter(2))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := serve(h, newRequest("10.0.0.1:1000", "")); got != want {
+			t.Errorf("request %v: status = %v, want %v", i, got, want)
+		}
+	}
+
+	// the other port of the same address shares the limit, the other address doesn't
+	if got := serve(h, newRequest("10.0.0.1:2000", "")); got != http.StatusTooManyRequests {
+		t.Errorf("same address: status = %v, want %v", got, http.StatusTooManyRequests)
+	}
+	if got := serve(h, newRequest("10.0.0.2:1000", "")); got != http.StatusOK {
+		t.Errorf("other address: status = %v, want %v", got, http.StatusOK)
+	}
+}
+
+func TestRateLimitAnonymousSkipsOperationalEndpoints(t *testing.T) {
+	h := newTestSegments().MiddlewareRateLimitAnonymous(newTestLimiter(1))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for _, path := range []string{"/metrics", "/healthz", "/readyz"} {
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.RemoteAddr = "10.0.0.1:1000"
+			if got := serve(h, r); got != http.StatusOK {
+				t.Errorf("%v request %v: status = %v, want %v", path, i, got, http.StatusOK)
+			}
+		}
+	}
+
+	// the probes don't take from the limit of the address
+	if got := serve(h, newRequest("10.0.0.1:1000", "")); got != http.StatusOK {
+		t.Errorf("API request: status = %v, want %v", got, http.StatusOK)
+	}
+}
+
+func TestRateLimitAnonymousCountsFailedAuthentication(t *testing.T) {
+	calls := 0
+	h := newTestSegments().MiddlewareRateLimitAnonymous(newTestLimiter(2))(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get(HeaderAPIKey) != "valid" {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	// the valid credentials don't take from the limit of the address
+	for i := 0; i < 5; i++ {
+		if got := serve(h, newRequest("10.0.0.1:1000", "valid")); got != http.StatusOK {
+			t.Fatalf("valid credentials: status = %v, want %v", got, http.StatusOK)
+		}
+	}
+
+	// the made-up credentials are different every time, but they exhaust the limit of the address
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		if got := serve(h, newRequest("10.0.0.1:1000", "made-up-"+string(rune('a'+i)))); got != want {
+			t.Errorf("made-up credentials %v: status = %v, want %v", i, got, want)
+		}
+	}
+	if calls != 7 {
+		t.Errorf("next called %v times, want 7: the rejected requests must not be authenticated", calls)
+	}
+}
+
+func TestRateLimitByPrincipal(t *testing.T) {
+	h := newTestSegments().MiddlewareRateLimit(newTestLimiter(1))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	withPrincipal := func(id string) *http.Request {
+		r := newRequest("10.0.0.1:1000", "key")
+		return r.WithContext(context.WithValue(r.Context(), KeyPrincipal{}, models.Principal{ID: id, Name: "backoffice"}))
+	}
+
+	// the callers behind the same address with the same name have separate limits
+	if got := serve(h, withPrincipal("key:1")); got != http.StatusOK {
+		t.Errorf("first caller: status = %v, want %v", got, http.StatusOK)
+	}
+	if got := serve(h, withPrincipal("key:2")); got != http.StatusOK {
+		t.Errorf("second caller: status = %v, want %v", got, http.StatusOK)
+	}
+	if got := serve(h, withPrincipal("key:1")); got != http.StatusTooManyRequests {
+		t.Errorf("first caller again: status = %v, want %v", got, http.StatusTooManyRequests)
+	}
+
+	if got := serve(h, newRequest("10.0.0.1:1000", "")); got != http.StatusUnauthorized {
+		t.Errorf("without principal: status = %v, want %v", got, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/peyuaa/segmentify/logging"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// HeaderRequestID is a header with the id of the request, it's generated if the client doesn't send it
+	HeaderRequestID = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+// KeyRequestID is a key used for the request id in the context
+type KeyRequestID struct{}
+
+// MiddlewareRequestID stores the id of the request in the context and the response header and calls next
+// The id is taken from the X-Request-ID header if it's correct, otherwise a new one is generated
+func (s *Segments) MiddlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+
+		rw.Header().Set(HeaderRequestID, id)
+
+		// add the request id and the logger of the request to the context
+		ctx := context.WithValue(r.Context(), KeyRequestID{}, id)
+		ctx = logging.WithContext(ctx, s.l.With("request_id", id))
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// logger returns the logger of the request, it adds the request id to every log line
+func (s *Segments) logger(r *http.Request) *log.Logger {
+	return logging.FromContext(r.Context(), s.l)
+}
+
+// requestID returns the id of the request from the context
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(KeyRequestID{}).(string)
+
+	return id
+}
+
+// newRequestID returns a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID returns true if the id sent by the client can be used, so it's safe to log and return
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+
+	return true
+}
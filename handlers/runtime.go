@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/lifecycle"
+	"github.com/peyuaa/segmentify/logging"
+
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/mux"
+)
+
+// The handlers of the runtime controls are served only by the admin listener, they aren't part of the API
+
+// LogLevel is the minimal level of the logs
+type LogLevel struct {
+	// debug, info, warn, error or fatal
+	Level string `json:"level"`
+}
+
+// WorkerRun is the result of the run of the worker task on demand
+type WorkerRun struct {
+	Worker lifecycle.WorkerStatus `json:"worker"`
+
+	// how long the task was running
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// GetLogLevel returns a handler which shows the level of the logger
+func (s *Segments) GetLogLevel(l *log.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		s.writeJSON(rw, r, LogLevel{Level: l.GetLevel().String()})
+	}
+}
+
+// SetLogLevel returns a handler which changes the level of the logger, it applies to the next log lines
+func (s *Segments) SetLogLevel(l *log.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		err := checkContentType(r)
+		if err != nil {
+			s.writeError(rw, r, err)
+			return
+		}
+
+		var request LogLevel
+		err = data.FromJSONStrict(&request, http.MaxBytesReader(rw, r.Body, MaxBodySize))
+		if err != nil {
+			s.writeError(rw, r, decodeError(err))
+			return
+		}
+
+		level, err := logging.ParseLevel(request.Level)
+		if err != nil {
+			s.writeError(rw, r, err)
+			return
+		}
+
+		previous := l.GetLevel()
+		l.SetLevel(level)
+		// the change is logged at any level
+		l.Print("Log level changed", "from", previous, "to", level)
+
+		s.writeJSON(rw, r, LogLevel{Level: level.String()})
+	}
+}
+
+// GetWorkers returns a handler which shows the status of the background workers
+func (s *Segments) GetWorkers(lm *lifecycle.Manager) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		s.writeJSON(rw, r, lm.Workers())
+	}
+}
+
+// PauseWorker returns a handler which pauses the periodic worker from the path
+// The worker keeps running, but its task isn't run until the worker is resumed
+func (s *Segments) PauseWorker(lm *lifecycle.Manager) http.HandlerFunc {
+	return s.changeWorker(lm.Pause, lm)
+}
+
+// ResumeWorker returns a handler which resumes the paused periodic worker from the path
+func (s *Segments) ResumeWorker(lm *lifecycle.Manager) http.HandlerFunc {
+	return s.changeWorker(lm.Resume, lm)
+}
+
+// RunWorker returns a handler which runs the task of the periodic worker from the path once,
+// e.g. a sweep of the expired users' segments. The response is written after the task is finished
+func (s *Segments) RunWorker(lm *lifecycle.Manager) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		start := time.Now()
+		err := lm.RunNow(r.Context(), name)
+		if err != nil {
+			s.writeError(rw, r, fmt.Errorf("unable to run worker: %w", err))
+			return
+		}
+		duration := time.Since(start)
+
+		status, err := lm.Worker(name)
+		if err != nil {
+			s.writeError(rw, r, err)
+			return
+		}
+
+		s.writeJSON(rw, r, WorkerRun{Worker: status, DurationSeconds: duration.Seconds()})
+	}
+}
+
+// changeWorker returns a handler which applies change to the worker from the path and writes its status
+func (s *Segments) changeWorker(change func(name string) error, lm *lifecycle.Manager) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		err := change(name)
+		if err != nil {
+			s.writeError(rw, r, err)
+			return
+		}
+
+		status, err := lm.Worker(name)
+		if err != nil {
+			s.writeError(rw, r, err)
+			return
+		}
+
+		s.writeJSON(rw, r, status)
+	}
+}
+
+// writeJSON writes v as JSON response with 200 status
+func (s *Segments) writeJSON(rw http.ResponseWriter, r *http.Request, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	err := data.ToJSON(v, rw)
+	if err != nil {
+		s.logger(r).Error("Unable to marshal json", "error", err)
+	}
+}
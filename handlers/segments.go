@@ -1,6 +1,9 @@
+// Package handlers provides the HTTP handlers and middlewares of Segmentify API
+// The API is described by the OpenAPI document in openapi package
 package handlers
 
 import (
+	"github.com/peyuaa/segmentify/auth"
 	"github.com/peyuaa/segmentify/data"
 
 	"github.com/charmbracelet/log"
@@ -8,17 +11,20 @@ import (
 
 // Segments is a struct that defines the handlers for the segments
 type Segments struct {
-	l *log.Logger
-	v *data.Validation
-	d *data.SegmentifyDB
+	l  *log.Logger
+	v  *data.Validation
+	d  *data.SegmentifyDB
+	tv *auth.Verifier
 }
 
 // NewSegments returns a new Segments struct
-func NewSegments(l *log.Logger, v *data.Validation, d *data.SegmentifyDB) *Segments {
+// tv verifies JWT bearer tokens, if it's nil only API keys are accepted
+func NewSegments(l *log.Logger, v *data.Validation, d *data.SegmentifyDB, tv *auth.Verifier) *Segments {
 	return &Segments{
-		l: l,
-		v: v,
-		d: d,
+		l:  l,
+		v:  v,
+		d:  d,
+		tv: tv,
 	}
 }
 
@@ -27,3 +33,15 @@ type KeySegment struct{}
 
 // KeyUserSegments is a key used for UserSegments object in the context
 type KeyUserSegments struct{}
+
+// KeySetUserSegments is a key used for SetUserSegments object in the context
+type KeySetUserSegments struct{}
+
+// KeyPrincipal is a key used for the authenticated Principal object in the context
+type KeyPrincipal struct{}
+
+// KeyCreateAPIKey is a key used for CreateAPIKeyRequest object in the context
+type KeyCreateAPIKey struct{}
+
+// KeyChangeMeta is a key used for ChangeMeta object in the context
+type KeyChangeMeta struct{}
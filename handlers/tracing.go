@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/peyuaa/segmentify/logging"
+	"github.com/peyuaa/segmentify/tracing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MiddlewareTracing returns a middleware which starts the server span of every request named by its method
+// and the route template from MiddlewareRoute
+// The span continues the trace of the client if the request has W3C traceparent header
+func (s *Segments) MiddlewareTracing() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			route := routeTemplate(r)
+			name := r.Method
+			if route != routeUnmatched {
+				name = fmt.Sprintf("%v %v", r.Method, route)
+			}
+
+			ctx, span := tracing.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", route),
+					attribute.String("url.path", r.URL.Path),
+					attribute.String("client.address", clientAddress(r)),
+					attribute.String("request.id", requestID(r)),
+				),
+			)
+			defer span.End()
+
+			// the logs of the request can be found by the trace id
+			if sc := span.SpanContext(); sc.HasTraceID() {
+				ctx = logging.WithContext(ctx, s.logger(r).With("trace_id", sc.TraceID().String()))
+			}
+
+			sr := &statusRecorder{ResponseWriter: rw}
+			next.ServeHTTP(sr, r.WithContext(ctx))
+			if sr.status == 0 {
+				sr.status = http.StatusOK
+			}
+
+			span.SetAttributes(attribute.Int("http.response.status_code", sr.status))
+			// 4xx statuses are client errors, they don't mark server spans as failed by OpenTelemetry semantic conventions
+			if sr.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(sr.status))
+			}
+		})
+	}
+}
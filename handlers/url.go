@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// HeaderForwardedProto is a header set by the reverse proxies terminating TLS to the scheme of the client request
+	HeaderForwardedProto = "X-Forwarded-Proto"
+
+	// HeaderForwardedFor is a header the reverse proxies append the address of their peer to
+	HeaderForwardedFor = "X-Forwarded-For"
+)
+
+// KeyForwardedProto is a key used for the scheme forwarded by the trusted proxy in the context
+type KeyForwardedProto struct{}
+
+// KeyClientAddress is a key used for the address of the client forwarded by the trusted proxies in the context
+type KeyClientAddress struct{}
+
+// MiddlewareClientAddress stores the address of the client from X-Forwarded-For header in the context
+// if the request is made by one of the trusted proxies, the header sent by the other clients is ignored.
+// The addresses of the header are checked from the last one, the first address which isn't a trusted proxy is the client.
+// It must be used in front of the middlewares identifying the clients by their address
+func (s *Segments) MiddlewareClientAddress(trustedProxies []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(HeaderForwardedFor) == "" || !isTrustedProxy(r, trustedProxies) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			client := ""
+			addresses := strings.Split(strings.Join(r.Header.Values(HeaderForwardedFor), ","), ",")
+			for i := len(addresses) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+				if ip == nil {
+					// the addresses before the malformed one can't be trusted
+					break
+				}
+
+				client = ip.String()
+				if !containsIP(trustedProxies, ip) {
+					break
+				}
+			}
+
+			if client != "" {
+				r = r.WithContext(context.WithValue(r.Context(), KeyClientAddress{}, client))
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// MiddlewareForwardedProto stores the scheme from X-Forwarded-Proto header in the context
+// if the request is made by one of the trusted proxies, the header sent by the other clients is ignored
+func (s *Segments) MiddlewareForwardedProto(trustedProxies []*net.IPNet) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(HeaderForwardedProto) == "" || !isTrustedProxy(r, trustedProxies) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			// the first proxy is the closest one to the client
+			proto, _, _ := strings.Cut(r.Header.Get(HeaderForwardedProto), ",")
+			switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+			case "http", "https":
+				r = r.WithContext(context.WithValue(r.Context(), KeyForwardedProto{}, proto))
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// requestScheme returns the scheme the client used for the request, it's used in the URLs returned to the client
+// TLS connection to the server is always https, otherwise the scheme forwarded by the trusted proxy is used
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if proto, ok := r.Context().Value(KeyForwardedProto{}).(string); ok {
+		return proto
+	}
+
+	return "http"
+}
+
+// isTrustedProxy returns true if the peer of the connection is in one of the networks
+func isTrustedProxy(r *http.Request, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(peerAddress(r))
+	if ip == nil {
+		return false
+	}
+
+	return containsIP(trustedProxies, ip)
+}
+
+// containsIP returns true if the ip is in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientAddress returns the IP address of the client forwarded by the trusted proxies or the address of the peer
+func clientAddress(r *http.Request) string {
+	if client, ok := r.Context().Value(KeyClientAddress{}).(string); ok {
+		return client
+	}
+
+	return peerAddress(r)
+}
+
+// peerAddress returns the IP address of the peer of the connection without the port
+func peerAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
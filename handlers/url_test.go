@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestScheme(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		want       string
+	}{
+		{"plain request", "192.168.1.1:1000", false, "", "http"},
+		{"TLS request", "192.168.1.1:1000", true, "", "https"},
+		{"trusted proxy", "10.1.2.3:1000", false, "https", "https"},
+		{"first proxy of the chain", "10.1.2.3:1000", false, "HTTPS, http", "https"},
+		{"unknown scheme of trusted proxy", "10.1.2.3:1000", false, "ftp", "http"},
+		{"untrusted client", "192.168.1.1:1000", false, "https", "http"},
+		{"TLS request with forwarded http", "10.1.2.3:1000", true, "http", "https"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/segments/users/1/history", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tc.proto != "" {
+				r.Header.Set(HeaderForwardedProto, tc.proto)
+			}
+
+			var got string
+			h := newTestSegments().MiddlewareForwardedProto([]*net.IPNet{proxies})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = requestScheme(r)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tc.want {
+				t.Errorf("scheme = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct request", "192.168.1.1:1000", nil, "192.168.1.1"},
+		{"untrusted client", "192.168.1.1:1000", []string{"1.2.3.4"}, "192.168.1.1"},
+		{"trusted proxy", "10.1.2.3:1000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"chain of trusted proxies", "10.1.2.3:1000", []string{"1.2.3.4, 10.4.5.6"}, "1.2.3.4"},
+		{"spoofed address before the client", "10.1.2.3:1000", []string{"5.6.7.8, 1.2.3.4"}, "1.2.3.4"},
+		{"several headers", "10.1.2.3:1000", []string{"5.6.7.8", "1.2.3.4, 10.4.5.6"}, "1.2.3.4"},
+		{"only trusted proxies", "10.1.2.3:1000", []string{"10.4.5.6"}, "10.4.5.6"},
+		{"malformed address", "10.1.2.3:1000", []string{"unknown, 10.4.5.6"}, "10.4.5.6"},
+		{"malformed last address", "10.1.2.3:1000", []string{"1.2.3.4, unknown"}, "10.1.2.3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/segments", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				r.Header.Add(HeaderForwardedFor, value)
+			}
+
+			var got string
+			h := newTestSegments().MiddlewareClientAddress([]*net.IPNet{proxies})(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = clientAddress(r)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tc.want {
+				t.Errorf("client address = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
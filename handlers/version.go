@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// APIPrefix is a path prefix of the current version of the API
+	APIPrefix = "/v1"
+
+	// HeaderDeprecation is a header marking the responses to the deprecated paths
+	HeaderDeprecation = "Deprecation"
+)
+
+// MiddlewareDeprecated marks the responses to the unversioned paths as deprecated and calls next
+// The Link header points to the same path of the current version of the API
+func (s *Segments) MiddlewareDeprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(HeaderDeprecation, "true")
+		rw.Header().Add("Link", fmt.Sprintf(`<%v>; rel="successor-version"`, APIPrefix+r.URL.EscapedPath()))
+
+		next.ServeHTTP(rw, r)
+	})
+}
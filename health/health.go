@@ -0,0 +1,168 @@
+// Package health reports whether the service is alive and ready to handle the requests
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of the service and its components
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Messages of the down components reported to the probes, the errors of the checks aren't exposed
+const (
+	MessageCheckFailed   = "check failed"
+	MessageCheckTimedOut = "check timed out"
+)
+
+var (
+	// ErrShuttingDown is an error reported when the service is shutting down and doesn't accept new requests
+	ErrShuttingDown = errors.New("service is shutting down")
+
+	// ErrWorkerStopped is an error reported when the background worker isn't running
+	ErrWorkerStopped = errors.New("worker isn't running")
+)
+
+// Check returns an error if the component isn't ready
+type Check func(ctx context.Context) error
+
+// Report is a status of the service and its components
+type Report struct {
+	// up if all the components are up, down otherwise
+	Status string `json:"status"`
+
+	// statuses of the components by name
+	Components map[string]Component `json:"components,omitempty"`
+}
+
+// Component is a status of the component of the service
+type Component struct {
+	// up or down
+	Status string `json:"status"`
+
+	// why the component is down: a fixed message, the details are in Cause
+	Error string `json:"error,omitempty"`
+
+	// error returned by the check, it's logged and never sent to the clients
+	Cause error `json:"-"`
+}
+
+// Health keeps the checks of the components needed to handle the requests
+type Health struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]Check
+
+	shuttingDown atomic.Bool
+}
+
+// New returns Health without components, every check must finish within timeout
+func New(timeout time.Duration) *Health {
+	return &Health{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add adds the component with the check, the check of the component with the same name is replaced
+func (h *Health) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// ShutDown makes the service not ready, so the load balancers stop sending new requests to it
+func (h *Health) ShutDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Live returns the report of the process, it's up while the process can handle the requests at all
+func (h *Health) Live() Report {
+	return Report{Status: StatusUp}
+}
+
+// Ready runs the checks of all the components concurrently and returns the report
+// The down components have a fixed message, the errors of the checks are kept in their Cause
+// The service is down if any of the components is down or the service is shutting down
+func (h *Health) Ready(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	h.mu.RLock()
+	names := append([]string(nil), h.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.RUnlock()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{
+		Status:     StatusUp,
+		Components: make(map[string]Component, len(names)),
+	}
+	for i, name := range names {
+		c := Component{Status: StatusUp}
+		if errs[i] != nil {
+			c = Component{Status: StatusDown, Error: MessageCheckFailed, Cause: errs[i]}
+			if errors.Is(errs[i], context.DeadlineExceeded) {
+				c.Error = MessageCheckTimedOut
+			}
+			report.Status = StatusDown
+		}
+		report.Components[name] = c
+	}
+
+	if h.shuttingDown.Load() {
+		report.Status = StatusDown
+		report.Components["server"] = Component{Status: StatusDown, Error: ErrShuttingDown.Error(), Cause: ErrShuttingDown}
+	} else {
+		report.Components["server"] = Component{Status: StatusUp}
+	}
+
+	return report
+}
+
+// Worker tracks whether the background worker is running
+type Worker struct {
+	running atomic.Bool
+}
+
+// Run runs the worker f and reports it as running until f returns
+func (w *Worker) Run(f func()) {
+	w.running.Store(true)
+	defer w.running.Store(false)
+
+	f()
+}
+
+// Check returns ErrWorkerStopped if the worker isn't running
+func (w *Worker) Check(context.Context) error {
+	if !w.running.Load() {
+		return ErrWorkerStopped
+	}
+
+	return nil
+}
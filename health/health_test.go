@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	errDatabase := errors.New("connection refused")
+
+	h := New(time.Second)
+	h.Add("database", func(context.Context) error { return nil })
+	report := h.Ready(context.Background())
+	if report.Status != StatusUp {
+		t.Fatalf("status = %v, want %v", report.Status, StatusUp)
+	}
+	for _, name := range []string{"database", "server"} {
+		if c := report.Components[name]; c.Status != StatusUp {
+			t.Errorf("%v = %+v, want up", name, c)
+		}
+	}
+
+	// the check of the component with the same name is replaced
+	h.Add("database", func(context.Context) error { return errDatabase })
+	report = h.Ready(context.Background())
+	if report.Status != StatusDown {
+		t.Errorf("status = %v, want %v", report.Status, StatusDown)
+	}
+	// the error of the check isn't reported to the probes
+	if c := report.Components["database"]; c.Status != StatusDown || c.Error != MessageCheckFailed || !errors.Is(c.Cause, errDatabase) {
+		t.Errorf("database = %+v, want down with fixed message and its error as the cause", c)
+	}
+	if len(report.Components) != 2 {
+		t.Errorf("components = %v, want database and server", report.Components)
+	}
+}
+
+func TestReadyTimeout(t *testing.T) {
+	h := New(10 * time.Millisecond)
+	h.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	report := h.Ready(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("checks took %v, want the timeout", elapsed)
+	}
+	if c := report.Components["slow"]; c.Status != StatusDown || c.Error != MessageCheckTimedOut {
+		t.Errorf("slow = %+v, want down with timeout message", c)
+	}
+}
+
+func TestShutDown(t *testing.T) {
+	h := New(time.Second)
+	h.ShutDown()
+
+	report := h.Ready(context.Background())
+	if report.Status != StatusDown {
+		t.Errorf("status = %v, want %v", report.Status, StatusDown)
+	}
+	if c := report.Components["server"]; c.Status != StatusDown || c.Error != ErrShuttingDown.Error() {
+		t.Errorf("server = %+v, want down while shutting down", c)
+	}
+	if live := h.Live(); live.Status != StatusUp {
+		t.Errorf("liveness = %v, want %v", live.Status, StatusUp)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	var w Worker
+	if err := w.Check(context.Background()); !errors.Is(err, ErrWorkerStopped) {
+		t.Errorf("error before run = %v, want %v", err, ErrWorkerStopped)
+	}
+
+	w.Run(func() {
+		if err := w.Check(context.Background()); err != nil {
+			t.Errorf("error while running = %v", err)
+		}
+	})
+
+	if err := w.Check(context.Background()); !errors.Is(err, ErrWorkerStopped) {
+		t.Errorf("error after run = %v, want %v", err, ErrWorkerStopped)
+	}
+}
@@ -0,0 +1,365 @@
+// Package lifecycle runs the HTTP server and the background workers and shuts them down on SIGINT or SIGTERM
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/peyuaa/segmentify/health"
+)
+
+var (
+	// ErrWorkerTimeout is returned if the worker doesn't stop before the shutdown deadline
+	ErrWorkerTimeout = errors.New("worker didn't stop in time")
+
+	// ErrUnknownWorker is returned if there is no worker with the name
+	ErrUnknownWorker = errors.New("unknown worker")
+
+	// ErrNotPeriodic is returned when the worker registered by Go is paused, resumed or run
+	ErrNotPeriodic = errors.New("worker isn't periodic")
+)
+
+// Options defines the shutdown sequence
+type Options struct {
+	// how long readiness fails before the server stops accepting connections
+	DrainDelay time.Duration
+
+	// deadline of draining the requests, stopping the workers and running the stop hooks
+	Timeout time.Duration
+}
+
+// Manager starts the server and the workers and stops them in the reverse order
+type Manager struct {
+	l       *log.Logger
+	h       *health.Health
+	opts    Options
+	servers []server
+	workers []*worker
+	hooks   []hook
+}
+
+// server is an HTTP server started by Run
+type server struct {
+	name string
+	s    *http.Server
+}
+
+// worker is a background goroutine running until its context is cancelled
+type worker struct {
+	name   string
+	run    func(ctx context.Context) error
+	status *health.Worker
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// task of the periodic worker, nil for the workers registered by Go
+	task     func(ctx context.Context) error
+	interval time.Duration
+	paused   atomic.Bool
+	// the task isn't run concurrently by the ticker and RunNow
+	taskMu sync.Mutex
+}
+
+// WorkerStatus describes the state of the worker
+type WorkerStatus struct {
+	Name string `json:"name"`
+
+	// the worker is started and hasn't returned
+	Running bool `json:"running"`
+
+	// the worker runs its task periodically, only such workers can be paused
+	Periodic bool `json:"periodic"`
+
+	// interval between the runs of the task, zero if the worker isn't periodic
+	IntervalSeconds float64 `json:"interval_seconds,omitempty"`
+
+	// the task isn't run by the ticker
+	Paused bool `json:"paused"`
+}
+
+// hook is a function run after the workers are stopped, e.g. closing the database
+type hook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// New creates a Manager, readiness of h fails when the shutdown starts and every worker has its check in h
+func New(l *log.Logger, h *health.Health, opts Options) *Manager {
+	return &Manager{l: l, h: h, opts: opts}
+}
+
+// Go registers the worker started by Run in the order of registration, run must return when ctx is cancelled
+// The service isn't ready while the worker isn't running
+func (m *Manager) Go(name string, run func(ctx context.Context) error) {
+	m.add(&worker{name: name, run: run})
+}
+
+// Every registers the worker calling task every interval, the errors of the task are logged and don't stop the worker
+// The periodic workers can be paused, resumed and run on demand
+func (m *Manager) Every(name string, interval time.Duration, task func(ctx context.Context) error) {
+	w := &worker{name: name, task: task, interval: interval}
+	w.run = func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if w.paused.Load() {
+					continue
+				}
+
+				err := w.runTask(ctx)
+				if err != nil && ctx.Err() == nil {
+					m.l.Error("Worker task failed", "worker", name, "error", err)
+				}
+			}
+		}
+	}
+	m.add(w)
+}
+
+// add registers the worker and its readiness check
+func (m *Manager) add(w *worker) {
+	w.status = &health.Worker{}
+	m.workers = append(m.workers, w)
+	m.h.Add(w.name, w.status.Check)
+}
+
+// Serve registers the server started by Run, the servers are shut down in the reverse order
+// The server with TLSConfig serves HTTPS
+func (m *Manager) Serve(name string, s *http.Server) {
+	m.servers = append(m.servers, server{name: name, s: s})
+}
+
+// OnStop registers the hook run after the workers are stopped, the hooks are run in the reverse order
+func (m *Manager) OnStop(name string, stop func(ctx context.Context) error) {
+	m.hooks = append(m.hooks, hook{name: name, stop: stop})
+}
+
+// Run starts the workers and the servers and blocks until SIGINT, SIGTERM or any server fails
+// Then readiness fails for the drain delay, the servers drain the in-flight requests,
+// the workers are stopped in the reverse order and the stop hooks are run, all within the timeout
+func (m *Manager) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for _, w := range m.workers {
+		m.start(w)
+	}
+
+	serverErr := make(chan error, len(m.servers))
+	for _, srv := range m.servers {
+		go func(srv server) {
+			m.l.Info("Starting server", "server", srv.name, "address", srv.s.Addr, "tls", srv.s.TLSConfig != nil)
+
+			var err error
+			if srv.s.TLSConfig != nil {
+				// the certificates are provided by the configuration
+				err = srv.s.ListenAndServeTLS("", "")
+			} else {
+				err = srv.s.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- fmt.Errorf("%v: %w", srv.name, err)
+			}
+		}(srv)
+	}
+
+	var errs []error
+	select {
+	case sig := <-signals:
+		m.l.Info("Shutting down", "signal", sig)
+
+		// readiness fails, so the load balancers drain the traffic before the server stops accepting connections
+		m.h.ShutDown()
+		m.l.Info("Draining traffic", "delay", m.opts.DrainDelay)
+		time.Sleep(m.opts.DrainDelay)
+	case err := <-serverErr:
+		m.l.Error("Server failed, shutting down", "error", err)
+		m.h.ShutDown()
+		errs = append(errs, fmt.Errorf("unable to serve: %w", err))
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+
+	// the second signal doesn't wait for the shutdown
+	signal.Stop(signals)
+
+	for i := len(m.servers) - 1; i >= 0; i-- {
+		srv := m.servers[i]
+		m.l.Info("Stopping server", "server", srv.name, "timeout", m.opts.Timeout)
+		err := srv.s.Shutdown(ctx)
+		if err != nil {
+			m.l.Error("Unable to drain in-flight requests", "server", srv.name, "error", err)
+			errs = append(errs, fmt.Errorf("unable to shut down %v server: %w", srv.name, err))
+			continue
+		}
+		m.l.Info("Server stopped", "server", srv.name)
+	}
+
+	for i := len(m.workers) - 1; i >= 0; i-- {
+		err := m.stop(ctx, m.workers[i])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i := len(m.hooks) - 1; i >= 0; i-- {
+		h := m.hooks[i]
+		err := h.stop(ctx)
+		if err != nil {
+			m.l.Error("Stop hook failed", "hook", h.name, "error", err)
+			errs = append(errs, fmt.Errorf("unable to stop %v: %w", h.name, err))
+			continue
+		}
+		m.l.Info("Stop hook finished", "hook", h.name)
+	}
+
+	m.l.Info("Shutdown complete", "duration", time.Since(start).Round(time.Millisecond), "errors", len(errs))
+
+	return errors.Join(errs...)
+}
+
+// start runs the worker in a goroutine with its own context
+func (m *Manager) start(w *worker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done = make(chan struct{})
+
+	m.l.Info("Starting worker", "worker", w.name)
+	go func() {
+		defer close(w.done)
+		w.status.Run(func() {
+			err := w.run(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				m.l.Error("Worker failed", "worker", w.name, "error", err)
+			}
+		})
+	}()
+}
+
+// stop cancels the context of the worker and waits until it returns or ctx is done
+func (m *Manager) stop(ctx context.Context, w *worker) error {
+	m.l.Info("Stopping worker", "worker", w.name)
+	w.cancel()
+
+	select {
+	case <-w.done:
+		m.l.Info("Worker stopped", "worker", w.name)
+		return nil
+	case <-ctx.Done():
+		m.l.Error("Worker didn't stop in time", "worker", w.name)
+		return fmt.Errorf("unable to stop %v: %w", w.name, ErrWorkerTimeout)
+	}
+}
+
+// Workers returns the status of the workers in the order of registration
+func (m *Manager) Workers() []WorkerStatus {
+	statuses := make([]WorkerStatus, len(m.workers))
+	for i, w := range m.workers {
+		statuses[i] = w.statusOf()
+	}
+
+	return statuses
+}
+
+// Worker returns the status of the worker with the name
+func (m *Manager) Worker(name string) (WorkerStatus, error) {
+	for _, w := range m.workers {
+		if w.name == name {
+			return w.statusOf(), nil
+		}
+	}
+
+	return WorkerStatus{}, fmt.Errorf("%w: %v", ErrUnknownWorker, name)
+}
+
+// Pause stops running the task of the periodic worker until it's resumed, the running task isn't interrupted
+func (m *Manager) Pause(name string) error {
+	w, err := m.periodic(name)
+	if err != nil {
+		return err
+	}
+
+	if !w.paused.Swap(true) {
+		m.l.Info("Worker paused", "worker", name)
+	}
+
+	return nil
+}
+
+// Resume starts running the task of the paused periodic worker again
+func (m *Manager) Resume(name string) error {
+	w, err := m.periodic(name)
+	if err != nil {
+		return err
+	}
+
+	if w.paused.Swap(false) {
+		m.l.Info("Worker resumed", "worker", name)
+	}
+
+	return nil
+}
+
+// RunNow runs the task of the periodic worker once and waits until it's finished, even if the worker is paused
+// It waits for the run of the task by the ticker if there is one
+func (m *Manager) RunNow(ctx context.Context, name string) error {
+	w, err := m.periodic(name)
+	if err != nil {
+		return err
+	}
+
+	m.l.Info("Running worker task on demand", "worker", name)
+
+	return w.runTask(ctx)
+}
+
+// periodic returns the periodic worker with the name
+func (m *Manager) periodic(name string) (*worker, error) {
+	for _, w := range m.workers {
+		if w.name != name {
+			continue
+		}
+		if w.task == nil {
+			return nil, fmt.Errorf("%w: %v", ErrNotPeriodic, name)
+		}
+		return w, nil
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrUnknownWorker, name)
+}
+
+// runTask runs the task of the periodic worker, the runs don't overlap
+func (w *worker) runTask(ctx context.Context) error {
+	w.taskMu.Lock()
+	defer w.taskMu.Unlock()
+
+	return w.task(ctx)
+}
+
+// statusOf returns the status of the worker
+func (w *worker) statusOf() WorkerStatus {
+	return WorkerStatus{
+		Name:            w.name,
+		Running:         w.status.Check(context.Background()) == nil,
+		Periodic:        w.task != nil,
+		IntervalSeconds: w.interval.Seconds(),
+		Paused:          w.paused.Load(),
+	}
+}
@@ -0,0 +1,179 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/peyuaa/segmentify/health"
+)
+
+func newTestManager(opts Options) (*Manager, *health.Health) {
+	h := health.New(time.Second)
+	return New(log.New(io.Discard), h, opts), h
+}
+
+// waitRunning waits until the worker with the name is running
+func waitRunning(t *testing.T, m *Manager, name string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, err := m.Worker(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Running {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("worker %v isn't running", name)
+}
+
+func TestRunStopsInReverseOrder(t *testing.T) {
+	m, h := newTestManager(Options{Timeout: 5 * time.Second})
+
+	var mu sync.Mutex
+	var stopped []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = append(stopped, name)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		name := name
+		m.Go(name, func(ctx context.Context) error {
+			<-ctx.Done()
+			record(name)
+			return ctx.Err()
+		})
+	}
+	m.OnStop("database", func(context.Context) error {
+		record("database")
+		return nil
+	})
+	m.OnStop("cache", func(context.Context) error {
+		record("cache")
+		return nil
+	})
+
+	// the server fails to listen, so the shutdown starts without a signal
+	m.Serve("public", &http.Server{Addr: "127.0.0.1:-1", ReadHeaderTimeout: time.Second})
+
+	err := m.Run()
+	if err == nil {
+		t.Fatal("failed server isn't reported")
+	}
+
+	want := []string{"second", "first", "cache", "database"}
+	if len(stopped) != len(want) {
+		t.Fatalf("stopped = %v, want %v", stopped, want)
+	}
+	for i := range want {
+		if stopped[i] != want[i] {
+			t.Fatalf("stopped = %v, want %v", stopped, want)
+		}
+	}
+
+	if report := h.Ready(context.Background()); report.Status != health.StatusDown {
+		t.Errorf("readiness after shutdown = %v, want %v", report.Status, health.StatusDown)
+	}
+}
+
+func TestRunReportsStuckWorkersAndHooks(t *testing.T) {
+	m, _ := newTestManager(Options{Timeout: 10 * time.Millisecond})
+
+	release := make(chan struct{})
+	defer close(release)
+	m.Go("stuck", func(context.Context) error {
+		<-release
+		return nil
+	})
+	errHook := errors.New("unable to close")
+	m.OnStop("database", func(context.Context) error { return errHook })
+	m.Serve("public", &http.Server{Addr: "127.0.0.1:-1", ReadHeaderTimeout: time.Second})
+
+	err := m.Run()
+	if !errors.Is(err, ErrWorkerTimeout) {
+		t.Errorf("error = %v, want %v", err, ErrWorkerTimeout)
+	}
+	if !errors.Is(err, errHook) {
+		t.Errorf("error = %v, want %v", err, errHook)
+	}
+}
+
+func TestPeriodicWorker(t *testing.T) {
+	m, _ := newTestManager(Options{Timeout: 5 * time.Second})
+
+	var runs atomic.Int32
+	m.Every("cleanup", time.Hour, func(context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+	m.Go("listener", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	for _, w := range m.workers {
+		m.start(w)
+	}
+	defer func() {
+		for _, w := range m.workers {
+			_ = m.stop(context.Background(), w)
+		}
+	}()
+	waitRunning(t, m, "cleanup")
+
+	err := m.Pause("cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Worker("cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Periodic || !status.Paused || status.IntervalSeconds != time.Hour.Seconds() {
+		t.Errorf("status = %+v, want paused periodic worker", status)
+	}
+
+	// the paused worker can be run on demand
+	err = m.RunNow(context.Background(), "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("runs = %v, want 1", runs.Load())
+	}
+
+	err = m.Resume("cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = m.Worker("cleanup"); status.Paused {
+		t.Error("worker is paused after resume")
+	}
+
+	if err = m.Pause("listener"); !errors.Is(err, ErrNotPeriodic) {
+		t.Errorf("pause of the worker registered by Go: error = %v, want %v", err, ErrNotPeriodic)
+	}
+	if err = m.RunNow(context.Background(), "unknown"); !errors.Is(err, ErrUnknownWorker) {
+		t.Errorf("run of the unknown worker: error = %v, want %v", err, ErrUnknownWorker)
+	}
+	if _, err = m.Worker("unknown"); !errors.Is(err, ErrUnknownWorker) {
+		t.Errorf("status of the unknown worker: error = %v, want %v", err, ErrUnknownWorker)
+	}
+
+	statuses := m.Workers()
+	if len(statuses) != 2 || statuses[0].Name != "cleanup" || statuses[1].Name != "listener" || statuses[1].Periodic {
+		t.Errorf("workers = %+v, want cleanup and listener in the order of registration", statuses)
+	}
+}
@@ -0,0 +1,69 @@
+// Package logging provides the loggers of the requests and the formats of the logs
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+)
+
+// Formats of the logs
+const (
+	// FormatText is a human-readable format for terminals
+	FormatText = "text"
+
+	// FormatJSON writes every entry as a JSON object on a separate line
+	FormatJSON = "json"
+
+	// FormatLogfmt writes every entry as key=value pairs on a separate line
+	FormatLogfmt = "logfmt"
+)
+
+var (
+	// ErrUnknownFormat is an error returned when the format isn't one of FormatText, FormatJSON and FormatLogfmt
+	ErrUnknownFormat = errors.New("unknown log format")
+
+	// ErrUnknownLevel is an error returned when the level isn't one of debug, info, warn, error and fatal
+	ErrUnknownLevel = errors.New("unknown log level")
+)
+
+// ParseFormat returns the formatter of the format
+func ParseFormat(format string) (log.Formatter, error) {
+	switch format {
+	case FormatText:
+		return log.TextFormatter, nil
+	case FormatJSON:
+		return log.JSONFormatter, nil
+	case FormatLogfmt:
+		return log.LogfmtFormatter, nil
+	default:
+		return log.TextFormatter, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+}
+
+// ParseLevel returns the level with the name, unlike log.ParseLevel unknown names are errors
+func ParseLevel(level string) (log.Level, error) {
+	l := log.ParseLevel(level)
+	if l.String() != level {
+		return log.InfoLevel, fmt.Errorf("%w: %q", ErrUnknownLevel, level)
+	}
+
+	return l, nil
+}
+
+// WithContext returns a copy of ctx with the logger of the request
+func WithContext(ctx context.Context, l *log.Logger) context.Context {
+	return log.WithContext(ctx, l)
+}
+
+// FromContext returns the logger of the request stored in ctx, fallback is returned if there is no such logger
+// The logger of the request adds the request id to every log line
+func FromContext(ctx context.Context, fallback *log.Logger) *log.Logger {
+	if l, ok := ctx.Value(log.ContextKey).(*log.Logger); ok {
+		return l
+	}
+
+	return fallback
+}
@@ -2,146 +2,384 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
 	"time"
 
+	"github.com/peyuaa/segmentify/auth"
+	"github.com/peyuaa/segmentify/certs"
+	"github.com/peyuaa/segmentify/config"
 	"github.com/peyuaa/segmentify/data"
 	"github.com/peyuaa/segmentify/db"
 	"github.com/peyuaa/segmentify/handlers"
+	"github.com/peyuaa/segmentify/health"
+	"github.com/peyuaa/segmentify/lifecycle"
+	"github.com/peyuaa/segmentify/logging"
+	"github.com/peyuaa/segmentify/metrics"
+	"github.com/peyuaa/segmentify/openapi"
+	"github.com/peyuaa/segmentify/ratelimit"
+	"github.com/peyuaa/segmentify/tracing"
 
 	"github.com/charmbracelet/log"
-	"github.com/go-openapi/runtime/middleware"
 	gohandlers "github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 )
 
 const (
-	// DBConnectionString is a name of the environment variable
-	//that contains the connection string to the database
-	DBConnectionString = "DB_CONNECTION_STRING"
-)
+	// name is a name of the binary used in the usage of the flags
+	name = "segmentify"
 
-var bindAddress = ":9090"
+	// healthCheckTimeout is the maximum duration of the readiness checks
+	healthCheckTimeout = 2 * time.Second
+)
 
 func main() {
+	// segmentify config print [flags] prints the effective configuration
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+
 	l := log.NewWithOptions(os.Stderr, log.Options{
 		ReportCaller:    true,
 		ReportTimestamp: true,
-		Prefix:          "segmentify",
+		Prefix:          name,
 	})
-	v := data.NewValidation()
 
-	// get the environment variables
-	dbConnectionString := os.Getenv(DBConnectionString)
-	if dbConnectionString == "" {
-		l.Fatal("DB_CONNECTION_STRING isn't set")
+	cfg, err := config.Load(name, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		l.Fatal("Unable to load configuration", "error", err)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		l.Fatal("Configuration is incorrect", "error", err)
 	}
 
-	l.Info("Connecting to postgresql database")
-
-	l.Info("Waiting for postgresql database to start")
-	time.Sleep(10 * time.Second)
-
-	// set up the database connection
-	dbConn, err := sql.Open("postgres", dbConnectionString)
+	level, err := logging.ParseLevel(cfg.Log.Level)
 	if err != nil {
-		l.Fatal("Unable to connect to database", "error", err)
+		l.Fatal("Unable to set log level", "error", err)
 	}
-	defer func() {
-		err := dbConn.Close()
+	l.SetLevel(level)
+	formatter, err := logging.ParseFormat(cfg.Log.Format)
+	if err != nil {
+		l.Fatal("Unable to set log format", "error", err)
+	}
+	l.SetFormatter(formatter)
+
+	// set up the access log, one entry is written per request
+	var accessLog *log.Logger
+	if cfg.Log.AccessFormat != "none" {
+		formatter, err := logging.ParseFormat(cfg.Log.AccessFormat)
 		if err != nil {
-			l.Error("Unable to close database connection", "error", err)
+			l.Fatal("Unable to set access log format", "error", err)
 		}
-	}()
+		accessLog = log.NewWithOptions(os.Stdout, log.Options{
+			ReportTimestamp: true,
+			Formatter:       formatter,
+		})
+	}
+
+	v := data.NewValidation()
 
-	// establish connection to the database
-	err = dbConn.Ping()
+	// the manager runs the server and the workers, and stops them with the database on SIGINT or SIGTERM
+	hc := health.New(healthCheckTimeout)
+	lm := lifecycle.New(l, hc, lifecycle.Options{
+		DrainDelay: cfg.Server.ShutdownDrainDelay,
+		Timeout:    cfg.Server.ShutdownGrace,
+	})
+
+	// set up tracing, trace context of the clients is propagated even if the spans aren't exported
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter)
 	if err != nil {
-		l.Fatal("Unable to ping database", "error", err)
+		l.Fatal("Unable to set up tracing", "error", err)
 	}
+	// the spans are flushed last, so the shutdown of the other components is traced too
+	lm.OnStop("tracing", shutdownTracing)
+
+	// connect to the database, it may start at the same time as the service
+	l.Info("Connecting to postgresql database", "timeout", cfg.Database.ConnectTimeout)
+	dbConn, err := db.Connect(context.Background(), l, cfg.Database.ConnectionString, db.ConnectOptions{
+		Timeout:         cfg.Database.ConnectTimeout,
+		MaxOpenConns:    cfg.Database.MaxOpenConns,
+		MaxIdleConns:    cfg.Database.MaxIdleConns,
+		ConnMaxLifetime: cfg.Database.ConnMaxLifetime,
+	})
+	if err != nil {
+		l.Fatal("Unable to connect to database", "error", err)
+	}
+	lm.OnStop("database", func(context.Context) error { return dbConn.Close() })
 
 	l.Info("Connected to postgresql database")
 
 	// create postgresql wrapper
-	dbWrap := db.New(l, dbConn)
+	dbWrap := db.New(l, dbConn, cfg.Database.QueryTimeout)
+
+	// bring the schema created by db/init.sql up to date
+	migrations, err := dbWrap.Migrate(context.Background())
+	if err != nil {
+		l.Fatal("Unable to migrate database", "error", err)
+	}
+	l.Info("Database schema is up to date", "applied_migrations", migrations)
+
+	// set up the metrics, the database records its own ones
+	reg := metrics.New()
+	err = dbWrap.RegisterMetrics(reg)
+	if err != nil {
+		l.Fatal("Unable to register database metrics", "error", err)
+	}
+	httpMetrics, err := metrics.NewHTTP(reg)
+	if err != nil {
+		l.Fatal("Unable to register HTTP metrics", "error", err)
+	}
+	workerMetrics, err := metrics.NewWorkers(reg)
+	if err != nil {
+		l.Fatal("Unable to register worker metrics", "error", err)
+	}
 
 	// create new database struct
-	segmentifyDB := data.New(l, dbWrap)
+	segmentifyDB := data.New(l, dbWrap, cfg.History.Dir)
+
+	// set up verification of JWT bearer tokens
+	var tv *auth.Verifier
+	if cfg.Auth.JWKSSource != "" {
+		keys := auth.NewKeySet(l, cfg.Auth.JWKSSource, cfg.Auth.JWKSCacheTTL)
+		err = keys.Load(context.Background())
+		if err != nil {
+			// the keys will be loaded on the first request with a token
+			l.Error("Unable to load JWKS", "error", err)
+		}
+
+		tv = auth.NewVerifier(keys, auth.VerifierOptions{
+			Issuer:        cfg.Auth.JWTIssuer,
+			Audience:      cfg.Auth.JWTAudience,
+			RoleClaim:     cfg.Auth.JWTRoleClaim,
+			PrefixesClaim: cfg.Auth.JWTPrefixesClaim,
+		})
+	}
+
+	// set up rate limiting of the clients
+	rl := ratelimit.New(map[string]ratelimit.Limit{
+		ratelimit.GroupRead:  {Rate: cfg.RateLimit.Read.Rate, Burst: cfg.RateLimit.Read.Burst},
+		ratelimit.GroupWrite: {Rate: cfg.RateLimit.Write.Rate, Burst: cfg.RateLimit.Write.Burst},
+	})
+
+	// the service is ready when the database with the schema is reachable and the workers are running
+	hc.Add("database", dbWrap.Ping)
+	hc.Add("schema", dbWrap.CheckSchema)
+
+	// the metrics of segments are counted before the first scrape and then periodically, not on every scrape
+	err = dbWrap.CollectStats(context.Background())
+	if err != nil {
+		l.Error("Unable to count segments for metrics", "error", err)
+	}
+
+	// register the background workers, they're stopped in the reverse order
+	lm.Every("segments_stats", cfg.Database.StatsInterval, dbWrap.CollectStats)
+	lm.Every("idempotency_purge", cfg.Idempotency.PurgeInterval, func(ctx context.Context) error {
+		return purgeIdempotencyKeys(ctx, l, segmentifyDB, workerMetrics, cfg.Idempotency.KeyTTL)
+	})
+	lm.Every("expiration_reaper", cfg.Expiration.Interval, func(ctx context.Context) error {
+		return reapExpiredSegments(ctx, l, segmentifyDB, workerMetrics, cfg.Expiration.BatchSize)
+	})
 
 	// create the handlers
-	sh := handlers.NewSegments(l, v, segmentifyDB)
+	sh := handlers.NewSegments(l, v, segmentifyDB, tv)
+
+	// store the bootstrap admin API key, so the other keys can be created using the API
+	if cfg.Auth.AdminAPIKey != "" {
+		err = segmentifyDB.EnsureAPIKey(context.Background(), "bootstrap", cfg.Auth.AdminAPIKey, data.RoleAdmin)
+		if err != nil {
+			l.Fatal("Unable to store admin API key", "error", err)
+		}
+	}
+
+	opts := routerOptions{
+		metricsHandler:    reg.Handler(),
+		health:            hc,
+		idempotencyKeyTTL: cfg.Idempotency.KeyTTL,
+		historyDir:        cfg.History.Dir,
+		adminListener:     cfg.Admin.BindAddress != "",
+	}
+
+	// set up validation of the requests against the OpenAPI document
+	if cfg.OpenAPI.Validation != "off" {
+		opts.openAPIValidator, err = openapi.NewValidator()
+		if err != nil {
+			l.Fatal("Unable to set up OpenAPI validation", "error", err)
+		}
+		opts.validateResponses = cfg.OpenAPI.Validation == "test"
+		l.Info("Validating requests against OpenAPI document", "responses", opts.validateResponses)
+	}
 
 	// create a new serve mux and register the handlers
-	sm := mux.NewRouter()
+	sm := newRouter(sh, rl, opts)
 
-	// handlers for API
-	postR := sm.Methods(http.MethodPost).Subrouter()
-	segR := postR.Path("/segments").Subrouter()
-	segR.HandleFunc("", sh.CreateSegment)
-	segR.Use(sh.MiddlewareValidateSegment)
+	// serve HTTPS if there is a certificate, the certificates replaced on disk are used for the new connections
+	// of both listeners. The admin listener doesn't require client certificates, the probes and Prometheus
+	// don't have them, but the ones sent are verified
+	var tlsConfig, adminTLSConfig *tls.Config
+	if cfg.Server.TLS.CertFile != "" {
+		reloader, err := certs.New(l, certs.Files{
+			CertFile:     cfg.Server.TLS.CertFile,
+			KeyFile:      cfg.Server.TLS.KeyFile,
+			ClientCAFile: cfg.Server.TLS.ClientCAFile,
+		})
+		if err != nil {
+			l.Fatal("Unable to load TLS certificate", "error", err)
+		}
+		tlsConfig, err = reloader.TLSConfig(cfg.Server.TLS.ClientAuth)
+		if err != nil {
+			l.Fatal("Unable to set up TLS", "error", err)
+		}
+		adminClientAuth := certs.ClientAuthNone
+		if cfg.Server.TLS.ClientAuth != certs.ClientAuthNone {
+			adminClientAuth = certs.ClientAuthOptional
+		}
+		adminTLSConfig, err = reloader.TLSConfig(adminClientAuth)
+		if err != nil {
+			l.Fatal("Unable to set up TLS of admin listener", "error", err)
+		}
+		lm.Every("tls_reload", cfg.Server.TLS.ReloadInterval, reloader.Reload)
+	}
 
-	userR := postR.Path("/segments/users").Subrouter()
-	userR.HandleFunc("", sh.ChangeUsersSegments)
-	userR.Use(sh.MiddlewareValidateUser)
+	// the admin listener serves the operational endpoints, so they aren't exposed publicly
+	var adminServer *http.Server
+	if opts.adminListener {
+		ar, _ := newAdminRouter(sh, l, lm, opts)
 
-	getR := sm.Methods(http.MethodGet).Subrouter()
-	// serve directory with user history files
-	getR.PathPrefix("/history/").Handler(http.StripPrefix("/history/", http.FileServer(http.Dir("history"))))
+		var ah http.Handler = ar
+		if accessLog != nil {
+			ah = sh.MiddlewareAccessLog(accessLog)(ah)
+		}
+		ah = sh.MiddlewareRequestID(ah)
+		ah = sh.MiddlewareRoute(ar)(ah)
 
-	getR.HandleFunc("/segments", sh.GetSegments)
-	getR.HandleFunc("/segments/{slug:[a-zA-Z_0-9]+}", sh.GetBySlug)
-	getR.HandleFunc("/segments/users/{id:[0-9]+}", sh.GetActiveSegments)
-	getR.HandleFunc("/segments/users/{id:[0-9]+}/history", sh.UserHistory)
+		adminServer = &http.Server{
+			Addr:        cfg.Admin.BindAddress,
+			Handler:     ah,
+			ErrorLog:    l.StandardLog(),
+			ReadTimeout: cfg.Server.ReadTimeout,
+			// CPU profiles and traces are written for as long as requested, 30 seconds by default
+			IdleTimeout: cfg.Server.IdleTimeout,
+			// the credentials of the admins aren't sent in plain text if the server has a certificate
+			TLSConfig: adminTLSConfig,
+		}
+	}
 
-	// handlers for documentation
-	opts := middleware.RedocOpts{
-		SpecURL: "/swagger.yaml",
+	// X-Forwarded-Proto and X-Forwarded-For headers are used only in the requests of the trusted proxies
+	trustedProxies, err := cfg.Server.TrustedProxyNetworks()
+	if err != nil {
+		l.Fatal("Unable to parse trusted proxies", "error", err)
 	}
-	dh := middleware.Redoc(opts, nil)
-	getR.Handle("/docs", dh)
-	getR.Handle("/swagger.yaml", http.FileServer(http.Dir("./")))
 
-	deleteR := sm.Methods(http.MethodDelete).Subrouter()
-	deleteR.HandleFunc("/segments/{slug:[a-zA-Z_0-9]+}", sh.Delete)
+	// the clients which aren't authenticated are limited in front of the router, every request gets an id, a span,
+	// is measured and logged with the address of the client behind the trusted proxies
+	var rh http.Handler = sm
+	rh = sh.MiddlewareForwardedProto(trustedProxies)(rh)
+	rh = sh.MiddlewareRateLimitAnonymous(rl)(rh)
+	rh = sh.MiddlewareMetrics(httpMetrics)(rh)
+	if accessLog != nil {
+		rh = sh.MiddlewareAccessLog(accessLog)(rh)
+	}
+	rh = sh.MiddlewareTracing()(rh)
+	rh = sh.MiddlewareRequestID(rh)
+	rh = sh.MiddlewareRoute(sm)(rh)
+	rh = sh.MiddlewareClientAddress(trustedProxies)(rh)
 
 	// CORS
-	ch := gohandlers.CORS(gohandlers.AllowedOrigins([]string{"*"}))
+	ch := gohandlers.CORS(
+		gohandlers.AllowedOrigins(cfg.Server.CORS.AllowedOrigins),
+		gohandlers.AllowedHeaders([]string{"Content-Type", "Authorization", handlers.HeaderAPIKey, handlers.HeaderActor, handlers.HeaderReason, handlers.HeaderIdempotencyKey, "If-Match", "If-None-Match", handlers.HeaderRequestID, "traceparent", "tracestate", "baggage"}),
+		gohandlers.ExposedHeaders([]string{"Retry-After", handlers.HeaderIdempotentReplayed, "ETag", handlers.HeaderRequestID, handlers.HeaderDeprecation, "Link"}),
+	)
 
 	// create a new server
 	s := http.Server{
-		Addr:         bindAddress, // configure the bind address
-		Handler:      ch(sm),      // set the default handler
+		Addr:         cfg.Server.BindAddress, // configure the bind address
+		Handler:      ch(rh),                 // set the default handler
 		ErrorLog:     l.StandardLog(),
-		ReadTimeout:  5 * time.Second,   // max time to read request from the client
-		WriteTimeout: 10 * time.Second,  // max time to write response to the client
-		IdleTimeout:  120 * time.Second, // max time for connections using TCP Keep-Alive
+		ReadTimeout:  cfg.Server.ReadTimeout,  // max time to read request from the client
+		WriteTimeout: cfg.Server.WriteTimeout, // max time to write response to the client
+		IdleTimeout:  cfg.Server.IdleTimeout,  // max time for connections using TCP Keep-Alive
+		TLSConfig:    tlsConfig,
 	}
 
-	// start the server
-	go func() {
-		l.Info("Starting server", "port", bindAddress)
+	// the admin listener is shut down after the public one, so the probes and the metrics are available while draining
+	if adminServer != nil {
+		lm.Serve("admin", adminServer)
+	}
+	lm.Serve("public", &s)
 
-		l.Fatal("Error form server", "error", s.ListenAndServe())
-	}()
+	// serve until SIGINT or SIGTERM, then drain the requests and stop the workers and the database
+	err = lm.Run()
+	if err != nil {
+		l.Error("Shutdown failed", "error", err)
+		os.Exit(1)
+	}
+}
 
-	// trap interrupt and gracefully shutdown the server
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+// configCommand runs config subcommand with the args and returns the exit code
+// config print writes the effective configuration with redacted secrets to the standard output
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintf(os.Stderr, "Usage: %v config print [flags]\n\nFlags:\n", name)
+		config.Usage(name, os.Stderr)
+		return 2
+	}
 
-	// Block until a signal is received.
-	sig := <-c
-	l.Info("Shutting down server", "signal", sig)
+	cfg, err := config.Load(name+" config print", args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
 
-	// gracefully shutdown the server, waiting max 30 seconds for current operations to complete
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	err = cfg.Redacted().WriteYAML(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 
-	err = s.Shutdown(ctx)
+	// the configuration is printed even if it's incorrect, so it's easier to find the problem
+	err = cfg.Validate()
 	if err != nil {
-		l.Fatal("Error shutting down server", "error", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+
+	return 0
+}
+
+// purgeIdempotencyKeys deletes the idempotency keys older than ttl
+func purgeIdempotencyKeys(ctx context.Context, l *log.Logger, d *data.SegmentifyDB, m *metrics.Workers, ttl time.Duration) error {
+	deleted, err := d.PurgeIdempotencyKeys(ctx, ttl)
+	if err != nil {
+		return fmt.Errorf("unable to purge idempotency keys: %w", err)
+	}
+	m.AddPurgedIdempotencyKeys(deleted)
+	l.Debug("Purged idempotency keys", "deleted", deleted)
+
+	return nil
+}
+
+// reapExpiredSegments removes the users' segments after their expiration date
+func reapExpiredSegments(ctx context.Context, l *log.Logger, d *data.SegmentifyDB, m *metrics.Workers, batchSize int) error {
+	removed, err := d.ReapExpiredSegments(ctx, batchSize)
+	// the segments removed before the error are counted too
+	m.AddExpirations(removed)
+	if err != nil {
+		return fmt.Errorf("unable to remove expired segments: %w", err)
+	}
+	if removed != 0 {
+		l.Info("Removed expired users' segments", "removed", removed)
+	}
+
+	return nil
 }
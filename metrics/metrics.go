@@ -0,0 +1,192 @@
+// Package metrics provides Prometheus metrics of the service
+// The components create their metrics with the constructors of this package or register their own collectors,
+// so all of them are exposed by the same handler
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace is a prefix of the names of all metrics of the service
+const Namespace = "segmentify"
+
+// Registry is a registry of the metrics exposed by the service
+type Registry struct {
+	reg *prometheus.Registry
+}
+
+// New returns a new Registry with the metrics of the Go runtime and the process
+func New() *Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return &Registry{
+		reg: reg,
+	}
+}
+
+// Register registers the collectors, e.g. the metrics of a storage backend
+// Registering the same collector twice isn't an error
+func (r *Registry) Register(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		err := r.reg.Register(c)
+		var already prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &already) {
+			return fmt.Errorf("unable to register collector: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Handler returns a handler exposing the metrics in Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.reg, promhttp.HandlerOpts{
+		Registry: r.reg,
+	})
+}
+
+// HTTP defines the metrics of the HTTP requests
+type HTTP struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewHTTP returns the metrics of the HTTP requests registered in r
+func NewHTTP(r *Registry) (*HTTP, error) {
+	h := &HTTP{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests by method, route template and status.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests by method and route template.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+
+	err := r.Register(h.requests, h.duration)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Observe records the request handled by the route, it does nothing if h is nil
+func (h *HTTP) Observe(method, route string, status int, duration time.Duration) {
+	if h == nil {
+		return
+	}
+
+	h.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	h.duration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// DB defines the metrics of the calls to a storage backend
+type DB struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+// NewDB returns the metrics of the calls to the storage backend registered in r
+func NewDB(r *Registry) (*DB, error) {
+	d := &DB{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: "db",
+			Name:      "query_duration_seconds",
+			Help:      "Duration of the calls to the database by method of the storage backend.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "db",
+			Name:      "query_errors_total",
+			Help:      "Number of the failed calls to the database by method of the storage backend.",
+		}, []string{"method"}),
+	}
+
+	err := r.Register(d.duration, d.errors)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Observe records the call of the method, failed is true if it returned an error
+// It does nothing if d is nil
+func (d *DB) Observe(method string, duration time.Duration, failed bool) {
+	if d == nil {
+		return
+	}
+
+	d.duration.WithLabelValues(method).Observe(duration.Seconds())
+	if failed {
+		d.errors.WithLabelValues(method).Inc()
+	}
+}
+
+// Workers defines the metrics of the background workers
+type Workers struct {
+	expirations prometheus.Counter
+	purgedKeys  prometheus.Counter
+}
+
+// NewWorkers returns the metrics of the background workers registered in r
+func NewWorkers(r *Registry) (*Workers, error) {
+	w := &Workers{
+		expirations: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "expirations_processed_total",
+			Help:      "Number of expired users' segments removed by the expiration reaper.",
+		}),
+		purgedKeys: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "idempotency_keys_purged_total",
+			Help:      "Number of expired idempotency keys deleted by the purge worker.",
+		}),
+	}
+
+	err := r.Register(w.expirations, w.purgedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// AddExpirations records n removed expired users' segments, it does nothing if w is nil
+func (w *Workers) AddExpirations(n int64) {
+	if w == nil {
+		return
+	}
+
+	w.expirations.Add(float64(n))
+}
+
+// AddPurgedIdempotencyKeys records n deleted idempotency keys, it does nothing if w is nil
+func (w *Workers) AddPurgedIdempotencyKeys(n int64) {
+	if w == nil {
+		return
+	}
+
+	w.purgedKeys.Add(float64(n))
+}
@@ -8,22 +8,40 @@ type Segment struct {
 	ID int `json:"id"` // Unique identifier for the segment
 
 	// the segment's slug
-	Slug string `json:"slug" validate:"required,min=5,max=50"`
+	Slug string `json:"slug" validate:"required,min=5,max=50,slug"`
 
 	// is the segment deleted
 	IsDeleted bool `json:"is_deleted"`
+
+	// who created the segment
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// why the segment was created
+	CreatedReason string `json:"created_reason,omitempty"`
+
+	// who deleted the segment
+	DeletedBy string `json:"deleted_by,omitempty"`
+
+	// why the segment was deleted
+	DeletedReason string `json:"deleted_reason,omitempty"`
+}
+
+// ChangeMeta defines who makes the change and why
+type ChangeMeta struct {
+	// who makes the change: the authenticated caller and the X-Actor header if it's set
+	Actor string `json:"actor"`
+
+	// why the change is made, taken from the X-Reason header
+	Reason string `json:"reason,omitempty"`
 }
 
+// ExpirationMeta describes the removals of the users' segments after their expiration date
+var ExpirationMeta = ChangeMeta{Actor: "segmentify", Reason: "expired"}
+
 // CreateSegmentRequest defines the structure for an API request for adding segments
-// swagger:model createSegmentRequest
 type CreateSegmentRequest struct {
 	// the segment's slug
-	//
-	// required: true
-	// min length: 5
-	// max length: 50
-	// example: AVITO_DISCOUNT_30
-	Slug string `json:"slug" validate:"required,min=5,max=50"`
+	Slug string `json:"slug" validate:"required,min=5,max=50,slug"`
 }
 
 // ActiveSegment defines the structure of Segment for an API response for active user's segments
@@ -35,59 +53,97 @@ type ActiveSegment struct {
 // ActiveSegments defines the structure of response for active user's segments
 type ActiveSegments []ActiveSegment
 
-type ActiveSegmentsResponse struct {
-	ActiveSegments ActiveSegments `json:"segments"`
-}
-
 // Segments defines a slice of Segment
 type Segments []Segment
 
 // SegmentAdd defines the structure for an API for adding segments
-// swagger:model segmentAdd
 type SegmentAdd struct {
 	// the segment's slug
-	//
-	// required: true
-	// min length: 5
-	// max length: 50
-	// example: AVITO_DISCOUNT_50
-	Slug string `json:"slug" validate:"required,min=5,max=50"`
+	Slug string `json:"slug" validate:"required,min=5,max=50,slug"`
 
 	// expiration date
-	//
-	// required: false
-	// example: 2025-01-02T15:04:06Z
 	Expired string `json:"expired,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05Z"`
 }
 
 // SegmentDelete defines the structure for an API for deleting segments
-// swagger:model segmentDelete
 type SegmentDelete struct {
 	// the segment's slug
-	//
-	// required: true
-	// min length: 5
-	// max length: 50
-	// example: AVITO_PERFORMANCE_VAS
-	Slug string `json:"slug" validate:"required,min=5,max=50"`
+	Slug string `json:"slug" validate:"required,min=5,max=50,slug"`
 }
 
 // UserSegmentsRequest defines the structure for an API for adding segments to user
-// swagger:model userSegmentsRequest
 type UserSegmentsRequest struct {
 	// user's id
-	//
-	// required: true
-	// min: 1
-	// max: 2147483647
-	// example: 42
-	ID int `json:"id" validate:"required,gt=0,number"`
+	ID int `json:"id" validate:"required,gt=0,max=2147483647"`
 
 	// add the segments to the user
 	AddSegments []SegmentAdd `json:"add" validate:"dive"`
 
 	// remove the segments from the user
 	RemoveSegments []SegmentDelete `json:"remove" validate:"dive"`
+
+	// only check the request and compute the changes without writing them
+	DryRun bool `json:"dry_run"`
+
+	// apply the correct items of the request even if some of them are incorrect
+	Partial bool `json:"partial"`
+}
+
+// SetUserSegmentsRequest defines the structure for an API request for replacing user's segments
+type SetUserSegmentsRequest struct {
+	// the full set of segments the user should have after the request
+	Segments []SegmentAdd `json:"segments" validate:"required,dive"`
+
+	// only check the request and compute the changes without writing them
+	DryRun bool `json:"dry_run"`
+}
+
+// UserSegmentsChange defines the structure for an API response for changing user's segments
+type UserSegmentsChange struct {
+	// user's id
+	ID int `json:"id"`
+
+	// who changed the segments and why
+	ChangeMeta
+
+	// true if the changes were only computed and not written
+	DryRun bool `json:"dry_run"`
+
+	// user's active segments after the change
+	ActiveSegments ActiveSegments `json:"segments"`
+
+	// segments added to the user
+	Added []SegmentAdd `json:"added"`
+
+	// segments removed from the user
+	Removed []SegmentDelete `json:"removed"`
+
+	// segments which expiration date was changed
+	Updated []SegmentAdd `json:"updated"`
+
+	// the result of every item of the request
+	Results []UserSegmentResult `json:"results,omitempty"`
+
+	// entity tag of user's segments after the change, it's sent in the ETag header
+	ETag string `json:"-"`
+}
+
+// UserSegmentResult defines the result of a single item of the request for changing user's segments
+type UserSegmentResult struct {
+	// the segment's slug
+	Slug string `json:"slug"`
+
+	// the action requested for the segment: add or remove
+	Action string `json:"action"`
+
+	// the status of the item: ok or rejected
+	Status string `json:"status"`
+
+	// machine-readable code of the error if the item was rejected
+	Code string `json:"code,omitempty"`
+
+	// the error message if the item was rejected
+	Error string `json:"error,omitempty"`
 }
 
 // UserHistoryResponse defines the structure for an API response for getting user's segments history
@@ -109,6 +165,12 @@ type UserHistoryEntry struct {
 
 	// date
 	Date time.Time
+
+	// who made the operation
+	Actor string
+
+	// why the operation was made
+	Reason string
 }
 
 // UserHistory defines a slice of UserHistoryEntry
@@ -129,3 +191,126 @@ func (u UserHistory) Less(i, j int) bool {
 func (u UserHistory) Swap(i, j int) {
 	u[i], u[j] = u[j], u[i]
 }
+
+// Principal defines the authenticated caller of the API
+type Principal struct {
+	// the stable unique identity of the caller: key:<id of API key> or jwt:<issuer>/<subject>
+	ID string
+
+	// the name of the caller: the name of API key owner or the subject of the token
+	Name string
+
+	// the role of the caller: reader, writer or admin
+	Role string
+
+	// prefixes of the segments the caller can change, the caller can change all segments if it's empty
+	SegmentPrefixes []string
+}
+
+// APIKey defines the structure for an API key, the key itself is never returned except on creation
+type APIKey struct {
+	// the id for the API key
+	ID int `json:"id"`
+
+	// the name of the API key owner
+	Name string `json:"name"`
+
+	// the role of the API key: reader, writer or admin
+	Role string `json:"role"`
+
+	// creation date
+	CreatedAt time.Time `json:"created_at"`
+
+	// revocation date, empty if the key is active
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// APIKeys defines a slice of APIKey
+type APIKeys []APIKey
+
+// CreateAPIKeyRequest defines the structure for an API request for creating API keys
+type CreateAPIKeyRequest struct {
+	// the name of the API key owner
+	Name string `json:"name" validate:"required,max=100"`
+
+	// the role of the API key
+	Role string `json:"role" validate:"required,oneof=reader writer admin"`
+}
+
+// CreateAPIKeyResponse defines the structure for an API response for creating API keys
+type CreateAPIKeyResponse struct {
+	APIKey
+
+	// the API key, it's shown only once
+	Key string `json:"key"`
+}
+
+// AuditEntry defines the structure for a record of the audit log
+type AuditEntry struct {
+	// the id for the record
+	ID int64 `json:"id"`
+
+	// when the call was made
+	CreatedAt time.Time `json:"created_at"`
+
+	// who made the call
+	Actor string `json:"actor"`
+
+	// why the call was made
+	Reason string `json:"reason,omitempty"`
+
+	// HTTP method of the call
+	Method string `json:"method"`
+
+	// route template of the call
+	// example: /segments/{slug}
+	Route string `json:"route"`
+
+	// requested path
+	// example: /segments/AVITO_RED_BUTTON
+	Path string `json:"path"`
+
+	// hex-encoded SHA-256 hash of the request body, empty if there is no body
+	PayloadDigest string `json:"payload_digest,omitempty"`
+
+	// HTTP status of the response
+	Status int `json:"status"`
+}
+
+// AuditPage defines the structure for a page of the audit log
+type AuditPage struct {
+	// records of the audit log, the newest first
+	Entries []AuditEntry `json:"entries"`
+
+	// value of before_id parameter to get the next page, empty if it's the last page
+	NextBeforeID *int64 `json:"next_before_id,omitempty"`
+}
+
+// AuditFilter defines the conditions for selecting records of the audit log
+// Zero fields are not used for filtering
+type AuditFilter struct {
+	Actor  string
+	Method string
+	Route  string
+	Status int
+	From   time.Time
+	To     time.Time
+
+	// only records with id less than BeforeID are selected
+	BeforeID int64
+
+	// maximum number of records
+	Limit int
+}
+
+// IdempotentResponse defines the structure for a stored response to the request with an idempotency key
+type IdempotentResponse struct {
+	// HTTP status of the response
+	Status int
+
+	// headers of the response
+	Header map[string][]string
+
+	// body of the response
+	Body []byte
+}
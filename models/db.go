@@ -15,6 +15,18 @@ type SegmentDB struct {
 
 	// is the segment deleted
 	IsDeleted bool
+
+	// who created the segment
+	CreatedBy string
+
+	// why the segment was created
+	CreatedReason string
+
+	// who deleted the segment
+	DeletedBy string
+
+	// why the segment was deleted
+	DeletedReason string
 }
 
 // SegmentsDB defines a slice of SegmentDB
@@ -45,6 +57,30 @@ type UserSegmentsDB struct {
 
 	// remove the segments from the user
 	RemoveSegments []SegmentDeleteDB
+
+	// who changes the segments and why
+	Meta ChangeMeta
+}
+
+// UserSegmentDB defines the structure for a user's segment stored in the database
+type UserSegmentDB struct {
+	// the segment's slug
+	Slug string
+
+	// expiration date
+	Expired sql.NullTime
+}
+
+// UserSegmentsDiffDB defines the structure for changes applied to user's segments in the database
+type UserSegmentsDiffDB struct {
+	// segments added to the user
+	AddSegments []SegmentAddDB
+
+	// segments removed from the user
+	RemoveSegments []SegmentDeleteDB
+
+	// segments which expiration date was changed
+	UpdateSegments []SegmentAddDB
 }
 
 // UserSegmentHistoryDB defines the structure for a segment in the database
@@ -60,7 +96,109 @@ type UserSegmentHistoryDB struct {
 
 	// date removed
 	DateRemoved sql.NullTime
+
+	// who added the segment
+	AddedBy string
+
+	// why the segment was added
+	AddedReason string
+
+	// who removed the segment
+	RemovedBy string
+
+	// why the segment was removed
+	RemovedReason string
 }
 
 // UserSegmentsHistoryDB defines a slice of UserSegmentHistoryDB
 type UserSegmentsHistoryDB []UserSegmentHistoryDB
+
+// APIKeyDB defines the structure for an API key in the database
+type APIKeyDB struct {
+	// API key's id
+	ID int
+
+	// the name of the API key owner
+	Name string
+
+	// SHA-256 hash of the API key
+	KeyHash string
+
+	// API key's role
+	Role string
+
+	// creation date
+	CreatedAt time.Time
+
+	// revocation date
+	RevokedAt sql.NullTime
+}
+
+// APIKeysDB defines a slice of APIKeyDB
+type APIKeysDB []APIKeyDB
+
+// AuditEntryDB defines the structure for a record of the audit log in the database
+type AuditEntryDB struct {
+	// record's id
+	ID int64
+
+	// when the call was made
+	CreatedAt time.Time
+
+	// who made the call
+	Actor string
+
+	// why the call was made
+	Reason string
+
+	// HTTP method of the call
+	Method string
+
+	// route template of the call, e.g. /segments/{slug}
+	Route string
+
+	// requested path
+	Path string
+
+	// hex-encoded SHA-256 hash of the request body, empty if there is no body
+	PayloadDigest string
+
+	// HTTP status of the response
+	Status int
+}
+
+// AuditEntriesDB defines a slice of AuditEntryDB
+type AuditEntriesDB []AuditEntryDB
+
+// IdempotencyKeyDB defines the structure for an idempotency key and the stored response in the database
+type IdempotencyKeyDB struct {
+	// the name of the caller who sent the key
+	Principal string
+
+	// the key sent by the caller
+	Key string
+
+	// hex-encoded SHA-256 hash of the request method, path and body
+	RequestDigest string
+
+	// HTTP status of the response, it isn't valid while the first request is handled
+	Status sql.NullInt32
+
+	// JSON-encoded headers of the response
+	ResponseHeaders []byte
+
+	// body of the response
+	ResponseBody []byte
+
+	// when the first request was received
+	CreatedAt time.Time
+}
+
+// UserVersionDB defines the version of user's segments in the database
+type UserVersionDB struct {
+	// the counter incremented on every change of user's segments
+	Version int64
+
+	// current date of the database, user's segments expire when it changes
+	Date time.Time
+}
@@ -0,0 +1,247 @@
+// Package openapi provides the OpenAPI 3 document of the API embedded into the binary
+// and checks that the routes of the router are described by it
+package openapi
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// ContentType is a content type of the document
+const ContentType = "application/yaml"
+
+//go:embed openapi.yaml
+var spec []byte
+
+// ErrUndocumentedRoutes is an error returned when the routes and the document don't match
+var ErrUndocumentedRoutes = errors.New("routes don't match OpenAPI document")
+
+// methods are the HTTP methods which can have an operation in the document
+var methods = []string{
+	http.MethodGet,
+	http.MethodPut,
+	http.MethodPost,
+	http.MethodDelete,
+	http.MethodOptions,
+	http.MethodHead,
+	http.MethodPatch,
+	http.MethodTrace,
+}
+
+// routeVariable matches the variables of gorilla/mux path templates with patterns, e.g. {slug:[a-z]+}
+var routeVariable = regexp.MustCompile(`\{([^:{}]+):[^{}]*\}`)
+
+// PathTemplate returns gorilla/mux path template without the patterns of the variables as in the document,
+// e.g. /segments/{slug:[a-z]+} is /segments/{slug}
+func PathTemplate(template string) string {
+	return routeVariable.ReplaceAllString(template, "{$1}")
+}
+
+// Document defines the parts of the OpenAPI document used by the service
+type Document struct {
+	// version of OpenAPI specification
+	OpenAPI string `yaml:"openapi"`
+
+	// servers of the API, the first one is a base path of the paths
+	Servers []Server `yaml:"servers"`
+
+	// paths of the API relative to the base path
+	Paths map[string]PathItem `yaml:"paths"`
+}
+
+// Server defines the server of the API
+type Server struct {
+	URL string `yaml:"url"`
+}
+
+// PathItem defines the operations of the path
+// The servers of the path replace the servers of the document
+type PathItem struct {
+	Servers []Server   `yaml:"servers"`
+	Get     *Operation `yaml:"get"`
+	Put     *Operation `yaml:"put"`
+	Post    *Operation `yaml:"post"`
+	Delete  *Operation `yaml:"delete"`
+	Options *Operation `yaml:"options"`
+	Head    *Operation `yaml:"head"`
+	Patch   *Operation `yaml:"patch"`
+	Trace   *Operation `yaml:"trace"`
+}
+
+// Operations returns the operations of the path by HTTP method
+func (p PathItem) Operations() map[string]*Operation {
+	ops := make(map[string]*Operation)
+	for method, op := range map[string]*Operation{
+		http.MethodGet:     p.Get,
+		http.MethodPut:     p.Put,
+		http.MethodPost:    p.Post,
+		http.MethodDelete:  p.Delete,
+		http.MethodOptions: p.Options,
+		http.MethodHead:    p.Head,
+		http.MethodPatch:   p.Patch,
+		http.MethodTrace:   p.Trace,
+	} {
+		if op != nil {
+			ops[method] = op
+		}
+	}
+
+	return ops
+}
+
+// Operation defines the operation of the path
+type Operation struct {
+	OperationID string `yaml:"operationId"`
+	Deprecated  bool   `yaml:"deprecated"`
+}
+
+// Spec returns the embedded OpenAPI document in YAML format
+func Spec() []byte {
+	return spec
+}
+
+// ServeSpec writes the embedded OpenAPI document to the response
+func ServeSpec(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", ContentType)
+	_, _ = rw.Write(spec)
+}
+
+// Load parses the embedded OpenAPI document
+func Load() (*Document, error) {
+	var doc Document
+	err := yaml.Unmarshal(spec, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse OpenAPI document: %w", err)
+	}
+
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", doc.OpenAPI)
+	}
+
+	return &doc, nil
+}
+
+// BasePath returns the base path of the path: the URL of its first server or the first server of the document
+func (d *Document) BasePath(path string) string {
+	servers := d.Servers
+	if item, ok := d.Paths[path]; ok && len(item.Servers) != 0 {
+		servers = item.Servers
+	}
+	if len(servers) == 0 {
+		return ""
+	}
+
+	return strings.TrimSuffix(servers[0].URL, "/")
+}
+
+// CheckRoutes returns an error listing the routes of the routers which aren't described by the document
+// and the operations of the document which don't have a route in any of the routers
+// Routes without base path are considered to be deprecated aliases of the same paths with base path.
+// Prefix routes, e.g. file servers, must have at least one path with the prefix in the document
+func (d *Document) CheckRoutes(routers ...*mux.Router) error {
+	type operation struct {
+		method string
+		path   string
+		alias  string
+		used   bool
+	}
+
+	var ops []*operation
+	for path, item := range d.Paths {
+		for method := range item.Operations() {
+			ops = append(ops, &operation{
+				method: method,
+				path:   d.BasePath(path) + path,
+				alias:  path,
+			})
+		}
+	}
+
+	var problems []string
+	walk := func(route *mux.Route, _ *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			// subrouters don't handle the requests themselves
+			return nil
+		}
+
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("route without path: %v", err))
+			return nil
+		}
+		template = PathTemplate(template)
+		isPrefix := isPrefixRoute(route)
+
+		for _, method := range routeMethods(route, ancestors) {
+			matched := false
+			for _, op := range ops {
+				if op.method != method {
+					continue
+				}
+
+				if op.path == template || op.alias == template ||
+					(isPrefix && (strings.HasPrefix(op.path, template) || strings.HasPrefix(op.alias, template))) {
+					op.used = true
+					matched = true
+				}
+			}
+			if !matched {
+				problems = append(problems, fmt.Sprintf("route %v %v isn't described", method, template))
+			}
+		}
+
+		return nil
+	}
+	for _, router := range routers {
+		err := router.Walk(walk)
+		if err != nil {
+			return fmt.Errorf("unable to walk routes: %w", err)
+		}
+	}
+
+	for _, op := range ops {
+		if !op.used {
+			problems = append(problems, fmt.Sprintf("operation %v %v has no route", op.method, op.path))
+		}
+	}
+
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %v", ErrUndocumentedRoutes, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// routeMethods returns the methods the route handles, the methods of the parent routes are taken into account
+// Routes without methods handle all of them
+func routeMethods(route *mux.Route, ancestors []*mux.Route) []string {
+	if m, err := route.GetMethods(); err == nil && len(m) != 0 {
+		return m
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if m, err := ancestors[i].GetMethods(); err == nil && len(m) != 0 {
+			return m
+		}
+	}
+
+	return methods
+}
+
+// isPrefixRoute returns true if the route matches all the paths with its path template as a prefix
+func isPrefixRoute(route *mux.Route) bool {
+	pathRegexp, err := route.GetPathRegexp()
+	if err != nil {
+		return false
+	}
+
+	return !strings.HasSuffix(pathRegexp, "$")
+}
@@ -0,0 +1,196 @@
+package openapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPathTemplate(t *testing.T) {
+	for template, want := range map[string]string{
+		"/v1/segments":                             "/v1/segments",
+		"/v1/segments/{slug:[a-zA-Z_0-9]+}":        "/v1/segments/{slug}",
+		"/segments/users/{id:[0-9]+}/history":      "/segments/users/{id}/history",
+		"/workers/{name:[a-z_]+}/{action}":         "/workers/{name}/{action}",
+		"/history/{userID:[0-9]+}/{from:[0-9-]+}/": "/history/{userID}/{from}/",
+	} {
+		if got := PathTemplate(template); got != want {
+			t.Errorf("PathTemplate(%v) = %v, want %v", template, got, want)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	doc, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"/segments": "/v1",
+		"/metrics":  "",
+		"/unknown":  "/v1",
+	} {
+		if got := doc.BasePath(path); got != want {
+			t.Errorf("base path of %v = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	handler := http.NotFoundHandler()
+	doc := &Document{
+		Servers: []Server{{URL: "/v1"}},
+		Paths: map[string]PathItem{
+			"/segments":        {Get: &Operation{}, Post: &Operation{}},
+			"/segments/{slug}": {Get: &Operation{}},
+			"/history/{id}.csv": {
+				Get: &Operation{},
+			},
+			"/metrics": {Servers: []Server{{URL: "/"}}, Get: &Operation{}},
+		},
+	}
+
+	newRouter := func() *mux.Router {
+		r := mux.NewRouter()
+		r.Methods(http.MethodGet).Path("/metrics").Handler(handler)
+		v1 := r.PathPrefix("/v1").Subrouter()
+		getR := v1.Methods(http.MethodGet).Subrouter()
+		getR.Handle("/segments", handler)
+		getR.Handle("/segments/{slug:[a-z]+}", handler)
+		getR.PathPrefix("/history/").Handler(handler)
+		return r
+	}
+
+	t.Run("documented routes", func(t *testing.T) {
+		r := newRouter()
+		r.Methods(http.MethodPost).Path("/v1/segments").Handler(handler)
+		// the route without base path is a deprecated alias
+		r.Methods(http.MethodGet).Path("/segments").Handler(handler)
+
+		err := doc.CheckRoutes(r)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("operation without route", func(t *testing.T) {
+		err := doc.CheckRoutes(newRouter())
+		if !errors.Is(err, ErrUndocumentedRoutes) {
+			t.Fatalf("error = %v, want %v", err, ErrUndocumentedRoutes)
+		}
+		if !strings.Contains(err.Error(), "operation POST /v1/segments has no route") {
+			t.Errorf("error %q doesn't mention POST /v1/segments", err)
+		}
+	})
+
+	t.Run("undescribed route", func(t *testing.T) {
+		r := newRouter()
+		r.Methods(http.MethodPost).Path("/v1/segments").Handler(handler)
+		r.Methods(http.MethodDelete).Path("/v1/segments/{slug:[a-z]+}").Handler(handler)
+		// the route of the other router is described by the document too
+		other := mux.NewRouter()
+		other.Path("/debug").Handler(handler)
+
+		err := doc.CheckRoutes(r, other)
+		if !errors.Is(err, ErrUndocumentedRoutes) {
+			t.Fatalf("error = %v, want %v", err, ErrUndocumentedRoutes)
+		}
+		for _, problem := range []string{"route DELETE /v1/segments/{slug} isn't described", "route GET /debug isn't described"} {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("error %q doesn't mention %q", err, problem)
+			}
+		}
+	})
+}
+
+func TestServeSpec(t *testing.T) {
+	rw := httptest.NewRecorder()
+	ServeSpec(rw, httptest.NewRequest(http.MethodGet, "/v1/openapi.yaml", nil))
+
+	if ct := rw.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("content type = %v, want %v", ct, ContentType)
+	}
+	if rw.Body.String() != string(Spec()) {
+		t.Error("served document differs from the embedded one")
+	}
+}
+
+func TestValidator(t *testing.T) {
+	v, err := NewValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if op := v.Operation(http.MethodPatch, "/v1/segments"); op != nil {
+		t.Errorf("operation of undescribed method = %v, want nil", op.ID)
+	}
+	create := v.Operation(http.MethodPost, "/v1/segments")
+	if create == nil || create.ID != "createSegment" {
+		t.Fatalf("operation = %v, want createSegment", create)
+	}
+	if alias := v.Operation(http.MethodPost, "/segments"); alias != create {
+		t.Error("deprecated alias has another operation")
+	}
+
+	t.Run("params", func(t *testing.T) {
+		get := v.Operation(http.MethodGet, "/v1/segments/{slug:[a-zA-Z_0-9]+}")
+		r := httptest.NewRequest(http.MethodGet, "/v1/segments/RED-BUTTON", nil)
+		violations := get.ValidateParams(r, map[string]string{"slug": "RED-BUTTON"})
+		if len(violations) != 1 || violations[0].In != "path" || violations[0].Field != "slug" || violations[0].Code != "pattern" {
+			t.Errorf("violations = %+v, want pattern of slug", violations)
+		}
+
+		violations = get.ValidateParams(r, nil)
+		if len(violations) != 1 || violations[0].Code != "required" {
+			t.Errorf("violations = %+v, want required slug", violations)
+		}
+
+		r.Header.Set("X-Actor", strings.Repeat("a", 201))
+		violations = create.ValidateParams(r, nil)
+		if len(violations) != 1 || violations[0].Field != "X-Actor" {
+			t.Errorf("violations = %+v, want too long X-Actor", violations)
+		}
+	})
+
+	t.Run("body", func(t *testing.T) {
+		if violations := create.ValidateBody("application/json", []byte(`{"slug": "AVITO_RED_BUTTON"}`)); len(violations) != 0 {
+			t.Errorf("violations of valid body = %+v", violations)
+		}
+		if violations := create.ValidateBody("application/json", nil); len(violations) != 1 || violations[0].Code != "required" {
+			t.Errorf("violations of empty body = %+v, want required", violations)
+		}
+
+		violations := create.ValidateBody("application/json; charset=utf-8", []byte(`{"slug": "RED", "name": "red"}`))
+		if len(violations) != 2 {
+			t.Errorf("violations = %+v, want short slug and unknown field", violations)
+		}
+		for _, violation := range violations {
+			if violation.In != "body" {
+				t.Errorf("violation %+v isn't in body", violation)
+			}
+		}
+
+		// malformed JSON is rejected when the body is decoded
+		if violations = create.ValidateBody("application/json", []byte(`{`)); len(violations) != 0 {
+			t.Errorf("violations of malformed body = %+v", violations)
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		valid := `{"id": 1, "slug": "AVITO_RED_BUTTON", "is_deleted": false}`
+		if violations := create.ValidateResponse(http.StatusCreated, "application/json", []byte(valid)); len(violations) != 0 {
+			t.Errorf("violations of valid response = %+v", violations)
+		}
+		if violations := create.ValidateResponse(http.StatusCreated, "application/json", []byte(`{"id": 1}`)); len(violations) == 0 {
+			t.Error("response without required fields is valid")
+		}
+		if violations := create.ValidateResponse(http.StatusCreated, "text/plain", []byte(valid)); len(violations) != 1 || violations[0].Code != "content_type" {
+			t.Errorf("violations = %+v, want content_type", violations)
+		}
+	})
+}
@@ -0,0 +1,501 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-openapi/errors"
+	openapispec "github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	"gopkg.in/yaml.v3"
+)
+
+// Violation describes how a request or a response doesn't conform to the document
+type Violation struct {
+	// where the violating value is: path, query, header or body
+	In string
+
+	// name of the parameter or path to the field of the body, e.g. add.slug
+	Field string
+
+	// stable machine-readable code of the violated rule, e.g. required
+	Code string
+
+	// human-readable description of the violation
+	Message string
+}
+
+// Error returns the violation message
+func (v Violation) Error() string {
+	return v.Message
+}
+
+// Validator validates the requests and the responses against the embedded OpenAPI document
+type Validator struct {
+	operations map[string]*OperationValidator
+}
+
+// OperationValidator validates the requests and the responses of an operation of the document
+type OperationValidator struct {
+	// id of the operation in the document
+	ID string
+
+	params       []paramValidator
+	body         map[string]*validate.SchemaValidator
+	bodyRequired bool
+	responses    map[string]map[string]*validate.SchemaValidator
+}
+
+// paramValidator validates a path, query or header parameter
+type paramValidator struct {
+	name       string
+	in         string
+	required   bool
+	schemaType string
+	schema     *validate.SchemaValidator
+}
+
+// NewValidator returns a validator of the operations of the embedded document
+func NewValidator() (*Validator, error) {
+	doc, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := loadRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Validator{
+		operations: make(map[string]*OperationValidator),
+	}
+
+	paths, _ := root["paths"].(map[string]interface{})
+	for path, rawItem := range paths {
+		item, _ := rawItem.(map[string]interface{})
+		for method := range doc.Paths[path].Operations() {
+			op, err := newOperationValidator(root, item, strings.ToLower(method))
+			if err != nil {
+				return nil, fmt.Errorf("unable to prepare validation of %v %v: %w", method, path, err)
+			}
+
+			v.operations[method+" "+doc.BasePath(path)+path] = op
+			// the paths without base path are deprecated aliases
+			v.operations[method+" "+path] = op
+		}
+	}
+
+	return v, nil
+}
+
+// Operation returns the validator of the operation handling the method and gorilla/mux path template
+// It returns nil if there is no such operation in the document
+func (v *Validator) Operation(method, template string) *OperationValidator {
+	template = PathTemplate(template)
+
+	return v.operations[method+" "+template]
+}
+
+// ValidateParams returns the violations of the path, query and header parameters of the request
+// vars are the path variables of the request
+func (o *OperationValidator) ValidateParams(r *http.Request, vars map[string]string) []Violation {
+	var violations []Violation
+	query := r.URL.Query()
+	for _, p := range o.params {
+		var (
+			value string
+			found bool
+		)
+		switch p.in {
+		case "path":
+			value, found = vars[p.name]
+		case "query":
+			found = query.Has(p.name)
+			value = query.Get(p.name)
+		case "header":
+			value = r.Header.Get(p.name)
+			found = value != ""
+		default:
+			continue
+		}
+
+		if !found {
+			if p.required {
+				violations = append(violations, Violation{
+					In:      p.in,
+					Field:   p.name,
+					Code:    "required",
+					Message: fmt.Sprintf("%v in %v is required", p.name, p.in),
+				})
+			}
+			continue
+		}
+
+		converted, err := convertParam(value, p.schemaType)
+		if err != nil {
+			violations = append(violations, Violation{
+				In:      p.in,
+				Field:   p.name,
+				Code:    "type",
+				Message: fmt.Sprintf("%v in %v must be of type %v", p.name, p.in, p.schemaType),
+			})
+			continue
+		}
+
+		violations = append(violations, violationsOf(p.schema.Validate(converted), p.in, p.name)...)
+	}
+
+	return violations
+}
+
+// ValidateBody returns the violations of the request body
+// Bodies of the content types unknown to the operation and malformed JSON aren't validated,
+// they are rejected when the body is decoded
+func (o *OperationValidator) ValidateBody(contentType string, body []byte) []Violation {
+	if len(body) == 0 {
+		if o.bodyRequired {
+			return []Violation{{In: "body", Code: "required", Message: "body is required"}}
+		}
+		return nil
+	}
+
+	schema, ok := o.body[mediaType(contentType)]
+	if !ok || schema == nil {
+		return nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		return nil
+	}
+
+	return violationsOf(schema.Validate(value), "body", "")
+}
+
+// ValidateResponse returns the violations of the response with the status, content type and body
+func (o *OperationValidator) ValidateResponse(status int, contentType string, body []byte) []Violation {
+	content, ok := o.responses[strconv.Itoa(status)]
+	if !ok {
+		content, ok = o.responses["default"]
+	}
+	if !ok {
+		return []Violation{{In: "response", Code: "status", Message: fmt.Sprintf("status %v isn't described", status)}}
+	}
+
+	if len(content) == 0 {
+		if len(body) != 0 {
+			return []Violation{{In: "response", Code: "body", Message: fmt.Sprintf("response with status %v must not have a body", status)}}
+		}
+		return nil
+	}
+
+	schema, ok := content[mediaType(contentType)]
+	if !ok {
+		return []Violation{{In: "response", Code: "content_type", Message: fmt.Sprintf("content type %q isn't described for status %v", contentType, status)}}
+	}
+	if schema == nil || !isJSON(mediaType(contentType)) {
+		return nil
+	}
+
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		return []Violation{{In: "response", Code: "body", Message: fmt.Sprintf("response body isn't valid JSON: %v", err)}}
+	}
+
+	return violationsOf(schema.Validate(value), "response", "")
+}
+
+// loadRoot parses the embedded document into JSON compatible values
+// OpenAPI 3.0 nullable schemas are converted to JSON Schema types with null, so they can be validated
+func loadRoot() (map[string]interface{}, error) {
+	var raw interface{}
+	err := yaml.Unmarshal(spec, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse OpenAPI document: %w", err)
+	}
+	convertNullable(raw)
+
+	// round trip makes the values the same as they are after decoding JSON
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert OpenAPI document to JSON: %w", err)
+	}
+
+	var root map[string]interface{}
+	err = json.Unmarshal(b, &root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert OpenAPI document to JSON: %w", err)
+	}
+
+	return root, nil
+}
+
+// convertNullable replaces nullable: true with null type in all schemas of the value
+func convertNullable(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if nullable, _ := v["nullable"].(bool); nullable {
+			if t, ok := v["type"].(string); ok {
+				v["type"] = []interface{}{t, "null"}
+			}
+			delete(v, "nullable")
+		}
+		for _, child := range v {
+			convertNullable(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			convertNullable(child)
+		}
+	}
+}
+
+// newOperationValidator returns the validator of the operation of the path item
+func newOperationValidator(root, item map[string]interface{}, method string) (*OperationValidator, error) {
+	op, _ := item[method].(map[string]interface{})
+
+	o := &OperationValidator{
+		body:      make(map[string]*validate.SchemaValidator),
+		responses: make(map[string]map[string]*validate.SchemaValidator),
+	}
+	o.ID, _ = op["operationId"].(string)
+
+	// the parameters of the path are shared by all its operations
+	params, _ := item["parameters"].([]interface{})
+	opParams, _ := op["parameters"].([]interface{})
+	for _, rawParam := range append(params, opParams...) {
+		param, err := resolve(root, rawParam)
+		if err != nil {
+			return nil, err
+		}
+
+		p := paramValidator{}
+		p.name, _ = param["name"].(string)
+		p.in, _ = param["in"].(string)
+		p.required, _ = param["required"].(bool)
+		if p.in == "header" {
+			p.name = http.CanonicalHeaderKey(p.name)
+		}
+
+		rawSchema, _ := param["schema"].(map[string]interface{})
+		p.schemaType, _ = rawSchema["type"].(string)
+		p.schema, err = newSchemaValidator(root, rawSchema, p.name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to prepare parameter %v: %w", p.name, err)
+		}
+
+		o.params = append(o.params, p)
+	}
+
+	if rawBody, ok := op["requestBody"]; ok {
+		body, err := resolve(root, rawBody)
+		if err != nil {
+			return nil, err
+		}
+		o.bodyRequired, _ = body["required"].(bool)
+
+		o.body, err = contentValidators(root, body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to prepare request body: %w", err)
+		}
+	}
+
+	responses, _ := op["responses"].(map[string]interface{})
+	for status, rawResponse := range responses {
+		response, err := resolve(root, rawResponse)
+		if err != nil {
+			return nil, err
+		}
+
+		o.responses[status], err = contentValidators(root, response)
+		if err != nil {
+			return nil, fmt.Errorf("unable to prepare response %v: %w", status, err)
+		}
+	}
+
+	return o, nil
+}
+
+// contentValidators returns the validators of the schemas of the content by media type
+// Media types without schema have nil validator
+func contentValidators(root, object map[string]interface{}) (map[string]*validate.SchemaValidator, error) {
+	validators := make(map[string]*validate.SchemaValidator)
+
+	content, _ := object["content"].(map[string]interface{})
+	for media, rawMedia := range content {
+		m, _ := rawMedia.(map[string]interface{})
+		rawSchema, ok := m["schema"].(map[string]interface{})
+		if !ok {
+			validators[media] = nil
+			continue
+		}
+
+		v, err := newSchemaValidator(root, rawSchema, "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to prepare schema of %v: %w", media, err)
+		}
+		validators[media] = v
+	}
+
+	return validators, nil
+}
+
+// newSchemaValidator returns the validator of the schema, the references are resolved against the root
+// name is the name of the validated value in the violations, it's empty for the bodies
+func newSchemaValidator(root, rawSchema map[string]interface{}, name string) (*validate.SchemaValidator, error) {
+	b, err := json.Marshal(rawSchema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal schema: %w", err)
+	}
+
+	var schema openapispec.Schema
+	err = json.Unmarshal(b, &schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal schema: %w", err)
+	}
+
+	err = openapispec.ExpandSchema(&schema, root, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve references of schema: %w", err)
+	}
+
+	return validate.NewSchemaValidator(&schema, root, name, strfmt.Default), nil
+}
+
+// resolve returns the object the value refers to with $ref or the value itself
+// Only local references, e.g. #/components/parameters/Slug, are supported
+func resolve(root map[string]interface{}, value interface{}) (map[string]interface{}, error) {
+	object, _ := value.(map[string]interface{})
+	ref, ok := object["$ref"].(string)
+	if !ok {
+		return object, nil
+	}
+
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+
+	var current interface{} = root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unable to resolve reference %q", ref)
+		}
+		current, ok = m[token]
+		if !ok {
+			return nil, fmt.Errorf("unable to resolve reference %q", ref)
+		}
+	}
+
+	return resolve(root, current)
+}
+
+// convertParam converts the value of the parameter to the type of its schema
+func convertParam(value, schemaType string) (interface{}, error) {
+	switch schemaType {
+	case "integer":
+		return strconv.ParseInt(value, 10, 64)
+	case "number":
+		return strconv.ParseFloat(value, 64)
+	case "boolean":
+		return strconv.ParseBool(value)
+	default:
+		return value, nil
+	}
+}
+
+// violationsOf returns the violations of the validation result
+func violationsOf(result *validate.Result, in, field string) []Violation {
+	if result == nil {
+		return nil
+	}
+
+	var violations []Violation
+	for _, err := range flatten(result.Errors) {
+		v := Violation{
+			In:      in,
+			Field:   field,
+			Code:    "schema",
+			Message: strings.TrimPrefix(err.Error(), "."),
+		}
+		if in != "body" && in != "response" {
+			// the schema validator treats every value as a body
+			v.Message = strings.Replace(v.Message, " in body ", " in "+in+" ", 1)
+		}
+
+		if ve, ok := err.(*errors.Validation); ok {
+			if ve.Name != "" && ve.Name != "." {
+				v.Field = ve.Name
+			}
+			v.Code = violationCode(ve.Code())
+			if ve.Code() == errors.UnallowedPropertyCode {
+				v.Field = strings.TrimPrefix(strings.Trim(v.Field, ".")+"."+fmt.Sprint(ve.Value), ".")
+			}
+		}
+
+		violations = append(violations, v)
+	}
+
+	return violations
+}
+
+// flatten returns the errors with the composite errors replaced by their errors
+func flatten(errs []error) []error {
+	var flat []error
+	for _, err := range errs {
+		if ce, ok := err.(*errors.CompositeError); ok {
+			flat = append(flat, flatten(ce.Errors)...)
+			continue
+		}
+		flat = append(flat, err)
+	}
+
+	return flat
+}
+
+// violationCode returns the stable code of the go-openapi validation error code
+// The codes are the same as the validation tags of the request structs where they mean the same
+func violationCode(code int32) string {
+	switch code {
+	case errors.InvalidTypeCode:
+		return "type"
+	case errors.RequiredFailCode:
+		return "required"
+	case errors.TooLongFailCode, errors.MaxFailCode, errors.MaxItemsFailCode, errors.TooManyPropertiesCode:
+		return "max"
+	case errors.TooShortFailCode, errors.MinFailCode, errors.MinItemsFailCode, errors.TooFewPropertiesCode:
+		return "min"
+	case errors.PatternFailCode:
+		return "pattern"
+	case errors.EnumFailCode:
+		return "oneof"
+	case errors.UnallowedPropertyCode:
+		return "unknown_field"
+	default:
+		return "schema"
+	}
+}
+
+// mediaType returns the media type of the content type without parameters
+func mediaType(contentType string) string {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	return media
+}
+
+// isJSON returns true if the media type is JSON, e.g. application/json or application/problem+json
+func isJSON(media string) bool {
+	return media == "application/json" || strings.HasSuffix(media, "+json")
+}
@@ -0,0 +1,207 @@
+// Package ratelimit provides token bucket rate limiting of the clients per group of requests
+package ratelimit
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// GroupRead is a group of requests that only read data
+	GroupRead = "read"
+
+	// GroupWrite is a group of requests that change data
+	GroupWrite = "write"
+)
+
+// Limit defines the token bucket of a group: every client can make Burst requests at once
+// and then Rate requests per second. Zero Rate means the group isn't limited
+type Limit struct {
+	// number of tokens added to the bucket per second
+	Rate float64 `json:"rate"`
+
+	// maximum number of tokens in the bucket
+	Burst int `json:"burst"`
+}
+
+// ClientStatus defines the state of the client's bucket
+type ClientStatus struct {
+	// client's key, e.g. ip:10.0.0.1
+	Client string `json:"client"`
+
+	// group of requests
+	Group string `json:"group"`
+
+	// number of requests the client can make right now
+	Tokens float64 `json:"tokens"`
+
+	// when the client made the last request
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Status defines the configured limits and the state of the clients' buckets
+type Status struct {
+	// limits per group
+	Limits map[string]Limit `json:"limits"`
+
+	// clients that made requests recently, full buckets of idle clients are forgotten
+	Clients []ClientStatus `json:"clients"`
+}
+
+type bucketKey struct {
+	group  string
+	client string
+}
+
+type bucket struct {
+	tokens   float64
+	updated  time.Time
+	lastSeen time.Time
+}
+
+// Limiter limits the rate of requests per client and group
+type Limiter struct {
+	mu          sync.Mutex
+	limits      map[string]Limit
+	buckets     map[bucketKey]*bucket
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+// New returns a new Limiter with the given limits per group
+// Requests of the groups without limits are always allowed
+func New(limits map[string]Limit) *Limiter {
+	l := &Limiter{
+		limits:  make(map[string]Limit, len(limits)),
+		buckets: make(map[bucketKey]*bucket),
+		now:     time.Now,
+	}
+	for group, limit := range limits {
+		// the bucket must hold at least one token, otherwise nothing is allowed
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		l.limits[group] = limit
+	}
+	l.lastCleanup = l.now()
+
+	return l
+}
+
+// Allow takes a token from the client's bucket of the group
+// If the bucket is empty, it returns false and how long the client should wait for the next token
+func (l *Limiter) Allow(group, client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, ok := l.limits[group]
+	if !ok || limit.Rate <= 0 {
+		return true, 0
+	}
+
+	now := l.now()
+	l.cleanup(now)
+
+	key := bucketKey{group: group, client: client}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.refill(limit, now)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// Limited reports whether the client's bucket of the group is empty without taking a token from it
+// If it is, it returns how long the client should wait for the next token
+func (l *Limiter) Limited(group, client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, ok := l.limits[group]
+	if !ok || limit.Rate <= 0 {
+		return false, 0
+	}
+
+	b, ok := l.buckets[bucketKey{group: group, client: client}]
+	if !ok {
+		return false, 0
+	}
+	b.refill(limit, l.now())
+
+	if b.tokens < 1 {
+		return true, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+
+	return false, 0
+}
+
+// Status returns the configured limits and the state of the clients' buckets
+func (l *Limiter) Status() Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	status := Status{
+		Limits:  make(map[string]Limit, len(l.limits)),
+		Clients: make([]ClientStatus, 0, len(l.buckets)),
+	}
+	for group, limit := range l.limits {
+		status.Limits[group] = limit
+	}
+	for key, b := range l.buckets {
+		b.refill(l.limits[key.group], now)
+		status.Clients = append(status.Clients, ClientStatus{
+			Client:   key.client,
+			Group:    key.group,
+			Tokens:   math.Floor(b.tokens*100) / 100,
+			LastSeen: b.lastSeen,
+		})
+	}
+	sort.Slice(status.Clients, func(i, j int) bool {
+		if status.Clients[i].Client != status.Clients[j].Client {
+			return status.Clients[i].Client < status.Clients[j].Client
+		}
+		return status.Clients[i].Group < status.Clients[j].Group
+	})
+
+	return status
+}
+
+// cleanup forgets the buckets that are full again, so the memory doesn't grow with the number of clients
+// It's done at most once a minute
+func (l *Limiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < time.Minute {
+		return
+	}
+	l.lastCleanup = now
+
+	for key, b := range l.buckets {
+		limit := l.limits[key.group]
+		b.refill(limit, now)
+		if b.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// refill adds the tokens accumulated since the last update
+func (b *bucket) refill(limit Limit, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	b.updated = now
+}
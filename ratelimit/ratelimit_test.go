@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns the limiter with the clock moved by the returned function
+func newTestLimiter(limits map[string]Limit) (*Limiter, func(d time.Duration)) {
+	now := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	l := New(limits)
+	l.now = func() time.Time { return now }
+	l.lastCleanup = now
+
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestAllow(t *testing.T) {
+	l, advance := newTestLimiter(map[string]Limit{GroupWrite: {Rate: 2, Burst: 3}})
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow(GroupWrite, "ip:10.0.0.1")
+		if !ok {
+			t.Fatalf("request %v within the burst is limited", i+1)
+		}
+	}
+
+	ok, wait := l.Allow(GroupWrite, "ip:10.0.0.1")
+	if ok {
+		t.Fatal("request over the burst is allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms", wait)
+	}
+
+	// the buckets of the clients are separate
+	ok, _ = l.Allow(GroupWrite, "ip:10.0.0.2")
+	if !ok {
+		t.Error("request of another client is limited")
+	}
+
+	// one token is added in half a second
+	advance(500 * time.Millisecond)
+	ok, _ = l.Allow(GroupWrite, "ip:10.0.0.1")
+	if !ok {
+		t.Error("request after the refill is limited")
+	}
+	ok, _ = l.Allow(GroupWrite, "ip:10.0.0.1")
+	if ok {
+		t.Error("second request after the refill of one token is allowed")
+	}
+}
+
+func TestAllowUnlimitedGroups(t *testing.T) {
+	l, _ := newTestLimiter(map[string]Limit{GroupRead: {Rate: 0, Burst: 1}})
+
+	for _, group := range []string{GroupRead, GroupWrite} {
+		for i := 0; i < 10; i++ {
+			ok, _ := l.Allow(group, "ip:10.0.0.1")
+			if !ok {
+				t.Fatalf("request of the unlimited group %v is limited", group)
+			}
+		}
+	}
+}
+
+func TestNewRaisesBurst(t *testing.T) {
+	l, _ := newTestLimiter(map[string]Limit{GroupWrite: {Rate: 1}})
+
+	if burst := l.Status().Limits[GroupWrite].Burst; burst != 1 {
+		t.Errorf("burst = %v, want 1", burst)
+	}
+	ok, _ := l.Allow(GroupWrite, "ip:10.0.0.1")
+	if !ok {
+		t.Error("first request is limited with zero burst")
+	}
+}
+
+func TestLimited(t *testing.T) {
+	l, advance := newTestLimiter(map[string]Limit{GroupWrite: {Rate: 1, Burst: 1}})
+
+	limited, _ := l.Limited(GroupWrite, "ip:10.0.0.1")
+	if limited {
+		t.Fatal("unknown client is limited")
+	}
+	// the check doesn't take a token
+	ok, _ := l.Allow(GroupWrite, "ip:10.0.0.1")
+	if !ok {
+		t.Fatal("request after the check is limited")
+	}
+
+	limited, wait := l.Limited(GroupWrite, "ip:10.0.0.1")
+	if !limited || wait != time.Second {
+		t.Errorf("limited = %v, wait = %v, want true and 1s", limited, wait)
+	}
+
+	advance(time.Second)
+	limited, _ = l.Limited(GroupWrite, "ip:10.0.0.1")
+	if limited {
+		t.Error("client is limited after the refill")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	l, advance := newTestLimiter(map[string]Limit{GroupWrite: {Rate: 1, Burst: 2}})
+
+	l.Allow(GroupWrite, "ip:10.0.0.2")
+	l.Allow(GroupWrite, "ip:10.0.0.1")
+	l.Allow(GroupWrite, "ip:10.0.0.1")
+
+	status := l.Status()
+	if len(status.Clients) != 2 {
+		t.Fatalf("clients = %v, want 2", status.Clients)
+	}
+	if status.Clients[0].Client != "ip:10.0.0.1" || status.Clients[0].Tokens != 0 {
+		t.Errorf("first client = %+v, want ip:10.0.0.1 without tokens", status.Clients[0])
+	}
+	if status.Clients[1].Client != "ip:10.0.0.2" || status.Clients[1].Tokens != 1 {
+		t.Errorf("second client = %+v, want ip:10.0.0.2 with 1 token", status.Clients[1])
+	}
+
+	// the full buckets are forgotten by the cleanup
+	advance(time.Minute)
+	l.Allow(GroupWrite, "ip:10.0.0.3")
+	status = l.Status()
+	if len(status.Clients) != 1 || status.Clients[0].Client != "ip:10.0.0.3" {
+		t.Errorf("clients after cleanup = %+v, want only ip:10.0.0.3", status.Clients)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/handlers"
+	"github.com/peyuaa/segmentify/health"
+	"github.com/peyuaa/segmentify/lifecycle"
+	"github.com/peyuaa/segmentify/openapi"
+	"github.com/peyuaa/segmentify/ratelimit"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/gorilla/mux"
+)
+
+// routerOptions defines the settings of the handlers
+type routerOptions struct {
+	// handler exposing the metrics
+	metricsHandler http.Handler
+
+	// health of the service reported to the probes
+	health *health.Health
+
+	// directory the files with users' segments history are served from
+	historyDir string
+
+	// how long the responses to the requests with idempotency keys are stored
+	idempotencyKeyTTL time.Duration
+
+	// validator of the requests against the OpenAPI document, nil disables the validation
+	openAPIValidator *openapi.Validator
+
+	// validate the responses against the OpenAPI document too
+	validateResponses bool
+
+	// metrics and probes are served by the admin listener instead of the public one
+	adminListener bool
+}
+
+// newRouter returns the router with all the handlers of the service
+// The API is served under /v1 prefix, the unversioned paths are its deprecated aliases
+func newRouter(sh *handlers.Segments, rl *ratelimit.Limiter, opts routerOptions) *mux.Router {
+	sm := mux.NewRouter()
+	sm.NotFoundHandler = http.HandlerFunc(sh.NotFound)
+	sm.MethodNotAllowedHandler = http.HandlerFunc(sh.MethodNotAllowed)
+
+	// handlers for documentation, they are available without authentication
+	docR := sm.Methods(http.MethodGet).Subrouter()
+	redocOpts := middleware.RedocOpts{
+		SpecURL: handlers.APIPrefix + "/openapi.yaml",
+	}
+	dh := middleware.Redoc(redocOpts, nil)
+	docR.Handle("/docs", dh)
+	docR.HandleFunc(handlers.APIPrefix+"/openapi.yaml", openapi.ServeSpec)
+
+	if !opts.adminListener {
+		registerOperational(sm, sh, opts)
+	}
+
+	// the current version of the API
+	v1R := sm.PathPrefix(handlers.APIPrefix).Subrouter()
+	registerAPI(v1R, handlers.APIPrefix, sh, rl, opts)
+
+	// the paths without version are kept for the old clients
+	legacyR := sm.NewRoute().Subrouter()
+	legacyR.Use(sh.MiddlewareDeprecated)
+	registerAPI(legacyR, "", sh, rl, opts)
+
+	return sm
+}
+
+// newAdminRouter returns the router of the admin listener with pprof, metrics, probes and runtime controls
+// operational is its subrouter with the metrics and the probes described by the OpenAPI document
+// The metrics and the probes are available without authentication, pprof and the runtime controls only for admins
+func newAdminRouter(sh *handlers.Segments, l *log.Logger, lm *lifecycle.Manager, opts routerOptions) (router, operational *mux.Router) {
+	router = mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(sh.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(sh.MethodNotAllowed)
+
+	operational = router.NewRoute().Subrouter()
+	registerOperational(operational, sh, opts)
+
+	// pprof and the runtime controls require the credentials of an admin, every change is recorded to the audit log
+	controlR := router.NewRoute().Subrouter()
+	controlR.Use(sh.MiddlewareAuthenticate)
+	controlR.Use(sh.MiddlewareAudit)
+	controlR.Use(sh.MiddlewareRequireRole(data.RoleAdmin))
+
+	// profiles of the Go runtime, the named ones are served by pprof.Index
+	pprofR := controlR.PathPrefix("/debug/pprof").Subrouter()
+	pprofR.HandleFunc("/cmdline", pprof.Cmdline)
+	pprofR.HandleFunc("/profile", pprof.Profile)
+	pprofR.HandleFunc("/symbol", pprof.Symbol)
+	pprofR.HandleFunc("/trace", pprof.Trace)
+	pprofR.PathPrefix("/").HandlerFunc(pprof.Index)
+
+	// runtime controls
+	controlR.Methods(http.MethodGet).Path("/log/level").Handler(sh.GetLogLevel(l))
+	controlR.Methods(http.MethodPut).Path("/log/level").Handler(sh.SetLogLevel(l))
+
+	controlR.Methods(http.MethodGet).Path("/workers").Handler(sh.GetWorkers(lm))
+	workerR := controlR.Methods(http.MethodPost).PathPrefix("/workers/{name:[a-z_]+}").Subrouter()
+	workerR.Path("/pause").Handler(sh.PauseWorker(lm))
+	workerR.Path("/resume").Handler(sh.ResumeWorker(lm))
+	workerR.Path("/run").Handler(sh.RunWorker(lm))
+
+	return router, operational
+}
+
+// registerOperational registers the metrics and the probes in the router, they're available without authentication
+func registerOperational(r *mux.Router, sh *handlers.Segments, opts routerOptions) {
+	// metrics are scraped by Prometheus
+	r.Methods(http.MethodGet).Path("/metrics").Handler(opts.metricsHandler)
+
+	// probes of the orchestrators don't have credentials
+	r.Methods(http.MethodGet).Path("/healthz").Handler(sh.Healthz(opts.health))
+	r.Methods(http.MethodGet).Path("/readyz").Handler(sh.Readyz(opts.health))
+}
+
+// registerAPI registers the handlers of the API in the router, prefix is the path prefix of the router
+func registerAPI(r *mux.Router, prefix string, sh *handlers.Segments, rl *ratelimit.Limiter, opts routerOptions) {
+	// handlers for API, every request must be authenticated with an API key
+	apiR := r.NewRoute().Subrouter()
+	apiR.Use(sh.MiddlewareAuthenticate)
+	// the authenticated callers are limited by their identity
+	apiR.Use(sh.MiddlewareRateLimit(rl))
+	// every mutating call is recorded to the audit log
+	apiR.Use(sh.MiddlewareAudit)
+	// retries of POST and DELETE requests with the same Idempotency-Key get the first response
+	apiR.Use(sh.MiddlewareIdempotency(opts.idempotencyKeyTTL))
+	// requests violating the OpenAPI document are rejected before they reach the handlers
+	if opts.openAPIValidator != nil {
+		apiR.Use(sh.MiddlewareOpenAPI(opts.openAPIValidator, opts.validateResponses))
+	}
+
+	// readers can get segments, user's segments and history
+	getR := apiR.Methods(http.MethodGet).Subrouter()
+	getR.Use(sh.MiddlewareRequireRole(data.RoleReader))
+	// serve directory with user history files
+	getR.PathPrefix("/history/").Handler(http.StripPrefix(prefix+"/history/", http.FileServer(http.Dir(opts.historyDir))))
+
+	getR.HandleFunc("/segments", sh.GetSegments)
+	getR.HandleFunc("/segments/{slug:[a-zA-Z_0-9]+}", sh.GetBySlug)
+	getR.HandleFunc("/segments/users/{id:[0-9]+}", sh.GetActiveSegments)
+	getR.HandleFunc("/segments/users/{id:[0-9]+}/history", sh.UserHistory)
+
+	// writers can change segments and user's segments
+	writeR := apiR.NewRoute().Subrouter()
+	writeR.Use(sh.MiddlewareRequireRole(data.RoleWriter))
+	writeR.Use(sh.MiddlewareChangeMeta)
+
+	postR := writeR.Methods(http.MethodPost).Subrouter()
+	segR := postR.Path("/segments").Subrouter()
+	segR.HandleFunc("", sh.CreateSegment)
+	segR.Use(sh.MiddlewareValidateSegment)
+
+	userR := postR.Path("/segments/users").Subrouter()
+	userR.HandleFunc("", sh.ChangeUsersSegments)
+	userR.Use(sh.MiddlewareValidateUser)
+
+	putR := writeR.Methods(http.MethodPut).Subrouter()
+	setR := putR.Path("/segments/users/{id:[0-9]+}").Subrouter()
+	setR.HandleFunc("", sh.SetUsersSegments)
+	setR.Use(sh.MiddlewareValidateSetUserSegments)
+
+	deleteR := writeR.Methods(http.MethodDelete).Subrouter()
+	deleteR.HandleFunc("/segments/{slug:[a-zA-Z_0-9]+}", sh.Delete)
+
+	// admins can manage API keys
+	adminR := apiR.PathPrefix("/admin").Subrouter()
+	adminR.Use(sh.MiddlewareRequireRole(data.RoleAdmin))
+
+	adminR.Methods(http.MethodGet).Path("/api-keys").HandlerFunc(sh.GetAPIKeys)
+	adminR.Methods(http.MethodGet).Path("/rate-limits").HandlerFunc(sh.GetRateLimits(rl))
+	adminR.Methods(http.MethodDelete).Path("/api-keys/{id:[0-9]+}").HandlerFunc(sh.RevokeAPIKey)
+
+	keyR := adminR.Methods(http.MethodPost).Path("/api-keys").Subrouter()
+	keyR.HandleFunc("", sh.CreateAPIKey)
+	keyR.Use(sh.MiddlewareValidateAPIKey)
+
+	// admins can review the audit log
+	auditR := apiR.Methods(http.MethodGet).Path("/audit").Subrouter()
+	auditR.HandleFunc("", sh.GetAuditLog)
+	auditR.Use(sh.MiddlewareRequireRole(data.RoleAdmin))
+}
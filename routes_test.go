@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peyuaa/segmentify/data"
+	"github.com/peyuaa/segmentify/handlers"
+	"github.com/peyuaa/segmentify/health"
+	"github.com/peyuaa/segmentify/lifecycle"
+	"github.com/peyuaa/segmentify/openapi"
+	"github.com/peyuaa/segmentify/ratelimit"
+
+	"github.com/charmbracelet/log"
+)
+
+// TestRoutesMatchOpenAPIDocument checks that every route of the API and the operational endpoints
+// is described by the embedded OpenAPI document and every operation of the document has a route
+func TestRoutesMatchOpenAPIDocument(t *testing.T) {
+	spec, err := openapi.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := log.New(io.Discard)
+	sh := handlers.NewSegments(l, data.NewValidation(), nil, nil)
+	rl := ratelimit.New(nil)
+	hc := health.New(time.Second)
+	opts := routerOptions{
+		metricsHandler: http.NotFoundHandler(),
+		health:         hc,
+		historyDir:     t.TempDir(),
+	}
+
+	t.Run("public listener", func(t *testing.T) {
+		err := spec.CheckRoutes(newRouter(sh, rl, opts))
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("admin listener", func(t *testing.T) {
+		opts := opts
+		opts.adminListener = true
+		lm := lifecycle.New(l, hc, lifecycle.Options{})
+
+		_, operational := newAdminRouter(sh, l, lm, opts)
+		err := spec.CheckRoutes(newRouter(sh, rl, opts), operational)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestAdminRouterRequiresCredentials checks that pprof and the runtime controls of the admin listener
+// aren't available without credentials, while the probes and the metrics are
+func TestAdminRouterRequiresCredentials(t *testing.T) {
+	l := log.New(io.Discard)
+	sh := handlers.NewSegments(l, data.NewValidation(), nil, nil)
+	hc := health.New(time.Second)
+	opts := routerOptions{
+		metricsHandler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		health:         hc,
+		adminListener:  true,
+	}
+	lm := lifecycle.New(l, hc, lifecycle.Options{})
+	lm.Every("cleanup", time.Hour, func(context.Context) error { return nil })
+
+	router, _ := newAdminRouter(sh, l, lm, opts)
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/metrics", http.StatusOK},
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodGet, "/debug/pprof/", http.StatusUnauthorized},
+		{http.MethodGet, "/debug/pprof/cmdline", http.StatusUnauthorized},
+		{http.MethodGet, "/log/level", http.StatusUnauthorized},
+		{http.MethodPut, "/log/level", http.StatusUnauthorized},
+		{http.MethodGet, "/workers", http.StatusUnauthorized},
+		{http.MethodPost, "/workers/cleanup/pause", http.StatusUnauthorized},
+		{http.MethodPost, "/workers/cleanup/run", http.StatusUnauthorized},
+	} {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(tc.method, tc.path, strings.NewReader(`{"level": "debug"}`)))
+		if rw.Code != tc.status {
+			t.Errorf("%v %v: status = %v, want %v", tc.method, tc.path, rw.Code, tc.status)
+		}
+	}
+
+	if status, _ := lm.Worker("cleanup"); status.Paused {
+		t.Error("worker is paused without credentials")
+	}
+}
@@ -0,0 +1,101 @@
+// Package tracing sets up OpenTelemetry tracing of the service
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is a name of the service in the traces, it can be replaced by OTEL_SERVICE_NAME environment variable
+const ServiceName = "segmentify"
+
+// instrumentationName is a name of the tracer used by the service
+const instrumentationName = "github.com/peyuaa/segmentify"
+
+// Exporters of the spans
+const (
+	// ExporterNone doesn't record the spans, trace context is still propagated
+	ExporterNone = "none"
+
+	// ExporterStdout writes the spans to the standard output
+	ExporterStdout = "stdout"
+
+	// ExporterOTLP sends the spans to OpenTelemetry collector using OTLP over HTTP,
+	// the collector is configured by the standard OTEL_EXPORTER_OTLP_* environment variables, localhost:4318 by default
+	ExporterOTLP = "otlp"
+)
+
+// ErrUnknownExporter is an error returned when the exporter isn't one of ExporterNone, ExporterStdout and ExporterOTLP
+var ErrUnknownExporter = errors.New("unknown tracing exporter")
+
+// Setup sets up the global tracer provider exporting the spans with the exporter
+// and W3C Trace Context and Baggage propagation.
+// The returned function flushes the remaining spans and stops the exporter, it must be called on shutdown
+func Setup(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		spanExporter sdktrace.SpanExporter
+		err          error
+	)
+	switch exporter {
+	case "", ExporterNone:
+		// the global tracer provider doesn't record the spans by default
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownExporter, exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %v exporter: %w", exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tracing resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// Start starts a span with the name, the span is a child of the span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records the error in the span if it isn't nil and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}